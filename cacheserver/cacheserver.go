@@ -31,14 +31,19 @@ package main
 
 import (
 	"net/http"
+	"encoding/json"
 	"jmh/goweb/webber"
 	"jmh/goweb/logger"
 	"github.com/patrickmn/go-cache"
 	"io/ioutil"
-	//"os"
+	"os"
+	"os/signal"
+	"syscall"
 	"flag"
 	"time"
 	"fmt"
+	"strings"
+	"sync"
 )
 
 // uncomment to enable profiling on the /debug/pprof/ endpoint
@@ -50,9 +55,19 @@ var cleanupInterval time.Duration = 14*60*24*time.Minute
 
 // our caches
 var CacheMap map[string]*cache.Cache
+var cacheMapLock sync.Mutex
+
+// reads of our caches, by cache and hit or miss
+var cacheReads = webber.DefaultMetrics.Counter("cacheserver_reads_total", "Cache reads, by cache and result (hit or miss)", "cache", "result")
+
+func cacheName(dbName string, collName string, keyName string) string {
+	return dbName + "." + collName + "." + keyName
+}
 
 func getCache(dbName string, collName string, keyName string) *cache.Cache {
-	mapKey := dbName + "." + collName + "." + keyName
+	mapKey := cacheName(dbName, collName, keyName)
+	cacheMapLock.Lock()
+	defer cacheMapLock.Unlock()
 	c, ok := CacheMap[mapKey]
 	if (!ok) {
 		// create it
@@ -63,6 +78,17 @@ func getCache(dbName string, collName string, keyName string) *cache.Cache {
 	return c
 }
 
+// cacheSizes reports the number of items in each cache, for the metrics endpoint
+func cacheSizes() []webber.MetricSample {
+	cacheMapLock.Lock()
+	defer cacheMapLock.Unlock()
+	samples := make([]webber.MetricSample, 0, len(CacheMap))
+	for name, c := range CacheMap {
+		samples = append(samples, webber.MetricSample{Labels: map[string]string{"cache": name}, Value: float64(c.ItemCount())})
+	}
+	return samples
+}
+
 
 
 // This is our api/cache handler
@@ -108,20 +134,22 @@ func (h CacheHandler) HandleGet (w http.ResponseWriter, r *http.Request) {
 	if ( len(pathParts) == 4 ) {
 		c := getCache(pathParts[0], pathParts[1], pathParts[2])
 		if ( c != nil) {
-			r, present := c.Get(pathParts[3])
+			v, present := c.Get(pathParts[3])
 			if ( present) {
+				cacheReads.Inc(cacheName(pathParts[0], pathParts[1], pathParts[2]), "hit")
 				w.Header().Set("Content-type", "application/json")
-				w.Write(r.([]byte))
+				w.Write(v.([]byte))
 			} else {
-				http.Error(w, "", http.StatusNotFound)
+				cacheReads.Inc(cacheName(pathParts[0], pathParts[1], pathParts[2]), "miss")
+				webber.ReturnError(w, r, http.StatusNotFound, "Not found")
 			}
 		} else {
-			logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintf("Cannot read cache for %s / %s / %s", pathParts[0], pathParts[1], pathParts[2]), nil)
-			http.Error(w, "Cannot read Cache", http.StatusInternalServerError)
+			webber.GetLogger(r).Errorf("Cannot read cache for %s / %s / %s", pathParts[0], pathParts[1], pathParts[2])
+			webber.ReturnError(w, r, http.StatusInternalServerError, "Cannot read Cache")
 		}
 	} else {
-		logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintf("Invalid path specified: %s", apiPath), nil)
-		http.Error(w, "Invalid path specified", http.StatusBadRequest)
+		webber.GetLogger(r).Errorf("Invalid path specified: %s", apiPath)
+		webber.ReturnError(w, r, http.StatusBadRequest, "Invalid path specified")
 	}
 }
 
@@ -139,22 +167,122 @@ func (h CacheHandler) HandlePost (w http.ResponseWriter, r *http.Request) {
 				c.Set(pathParts[3], body, cache.DefaultExpiration)	
 				fmt.Fprintf(w, "%d bytes written", len(body))
 			} else {
-				logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintf("Error reading POST body: %s", err.Error()), nil)
-				http.Error(w, "Error ready data:" + err.Error(), http.StatusBadRequest)
+				webber.GetLogger(r).Errorf("Error reading POST body: %s", err.Error())
+				webber.ReturnError(w, r, http.StatusBadRequest, "Error ready data:" + err.Error())
 			}
 		} else {
-			logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintf("Cannot create cache for %s / %s / %s", pathParts[0], pathParts[1], pathParts[2]), nil)
-			http.Error(w, "Cannot Create Cache", http.StatusInternalServerError)
+			webber.GetLogger(r).Errorf("Cannot create cache for %s / %s / %s", pathParts[0], pathParts[1], pathParts[2])
+			webber.ReturnError(w, r, http.StatusInternalServerError, "Cannot Create Cache")
 		}
 	} else {
-		logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintf("Invalid path specified: %s", apiPath), nil)
-		http.Error(w, "Invalid path specified", http.StatusBadRequest)
+		webber.GetLogger(r).Errorf("Invalid path specified: %s", apiPath)
+		webber.ReturnError(w, r, http.StatusBadRequest, "Invalid path specified")
 	}
 
 }
 
 
 
+// This is our api/ratelimit handler, which keeps token buckets for webber.CacheServerRateLimitStore
+// so a service's instances share their rate limits
+//
+
+/*
+APIs
+
+POST /<key>  -d {"Rate": <requests per second>, "Burst": <most requests at once>}
+takes a token from the bucket for <key>, returning a webber.RateLimitResult.  Each api key name
+has its own buckets, so one service can't use up (or reset) another's limits.
+
+*/
+
+type RateLimitHandler struct {
+	basePath string
+	store *webber.MemoryRateLimitStore
+}
+
+func NewRateLimitHandler(basePath string) *RateLimitHandler {
+	f := new(RateLimitHandler)
+	f.basePath = "/" + basePath + "/"
+	f.store = webber.NewMemoryRateLimitStore()
+	return f
+}
+
+func (h RateLimitHandler) Name() string {
+	return "RateLimitHandler"
+}
+
+func (h RateLimitHandler) BasePath() string {
+	return h.basePath
+}
+
+func (h RateLimitHandler) HandleGet (w http.ResponseWriter, r *http.Request) {
+	webber.ReturnError(w, r, http.StatusMethodNotAllowed, "Unsupported method")
+}
+
+func (h RateLimitHandler) HandlePost (w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path[len(h.basePath):]
+	var limit webber.RateLimit
+	err := json.NewDecoder(r.Body).Decode(&limit)
+	if ( err != nil || len(key) == 0 || limit.Burst <= 0 ) {
+		webber.ReturnError(w, r, http.StatusBadRequest, "A key and a limit with a Burst are required")
+		return
+	}
+	// buckets are kept per caller, the name being the same for all of a service's (rotated) keys
+	caller := webber.GetAPIKeyName(r)
+	if len(caller) == 0 {
+		caller = "-"
+	}
+	res, _ := h.store.Take(r.Context(), caller + "/" + key, limit)
+	webber.ReturnJson(w, res)
+}
+
+
+
+// manageAPIKeys issues or rotates an api key in the APIKeyFile and prints the new key.  Scopes are
+// a comma separated list of METHODS:prefix, with methods separated by |.  Returns the exit code.
+func manageAPIKeys(config *webber.ServerConfig, newName string, scopeList string, rotateName string, grace time.Duration) int {
+	if len(config.APIKeyFile) == 0 {
+		fmt.Println("No APIKeyFile set in the config")
+		return 1
+	}
+	keyStore, err := webber.NewFileAPIKeyStore(config.APIKeyFile)
+	if err != nil {
+		fmt.Println("Can't read api key file ", config.APIKeyFile, ": ", err)
+		return 1
+	}
+
+	var key string
+	if len(rotateName) > 0 {
+		key, err = webber.RotateAPIKey(keyStore, rotateName, grace)
+	} else {
+		scopes := []webber.APIKeyScope{}
+		if len(scopeList) == 0 {
+			// unrestricted
+			scopes = append(scopes, webber.APIKeyScope{})
+		} else {
+			for _, sc := range strings.Split(scopeList, ",") {
+				parts := strings.SplitN(sc, ":", 2)
+				if len(parts) != 2 {
+					fmt.Println("Invalid scope ", sc, ", should be METHODS:prefix")
+					return 1
+				}
+				var methods []string
+				if len(parts[0]) > 0 {
+					methods = strings.Split(parts[0], "|")
+				}
+				scopes = append(scopes, webber.APIKeyScope{Methods: methods, PathPrefix: parts[1]})
+			}
+		}
+		key, err = webber.GenerateAPIKey(keyStore, newName, scopes, time.Time{})
+	}
+	if err != nil {
+		fmt.Println("Failed to create api key: ", err)
+		return 1
+	}
+	fmt.Println(key)
+	return 0
+}
 
 
 // main func - we'll load our config, set up a logger,create an AppServer, and add our cache handler
@@ -167,6 +295,10 @@ func main() {
 	AppCluster := flag.String("cluster", "", "Name for the cluster")
 	AWSRegion := flag.String("awsregion", "", "What AWS region we should look for resources in")
 	DBPath := flag.String("dbpath", "", "Path to the db")
+	NewAPIKey := flag.String("newapikey", "", "issue a new api key to the named service, print it and exit")
+	APIKeyScopes := flag.String("apikeyscopes", "", "scopes for -newapikey, e.g. GET:/api/cache/hikes/,GET|POST:/api/cache/test/.  Default is everything")
+	RotateAPIKey := flag.String("rotateapikey", "", "issue a replacement api key to the named service, print it and exit")
+	APIKeyGrace := flag.Duration("apikeygrace", 24*time.Hour, "how long the old keys remain valid after -rotateapikey")
 	flag.Parse()
 
 	// read our config
@@ -180,22 +312,60 @@ func main() {
 		config.DBPath = *DBPath
 	}
 
+	// handle any api key management commands
+	if len(*NewAPIKey) > 0 || len(*RotateAPIKey) > 0 {
+		os.Exit(manageAPIKeys(config, *NewAPIKey, *APIKeyScopes, *RotateAPIKey, *APIKeyGrace))
+	}
+
 	
 	////////////////////////////
 	// set up our logger
 	// fill out the AppInfo struct so the logger knows who it is writting logs for:
 	app := logger.AppInfo{Name:config.AppName, Version:config.AppVersion, Instance:*AppInstance,Cluster:*AppCluster}
-	fhLogger := logger.NewFirehoseLogger(app, config.AWSRegion, config.AWSProfile, config.LoggerFirehoseDeliveryStream)
-	logger.StdLogger = fhLogger
-	logger.StdLogger.StdOutOn(true)
+	appLogger, err := webber.NewLoggerFromConfig(app, config)
+	if err != nil {
+		logger.Criticalf("Can't create logger: %s", err)
+		os.Exit(1)
+	}
+	logger.StdLogger = appLogger
 	logger.StdLogger.LOG(logger.INFO, "", "cache-server starting up", nil)
 
+	// export trace spans if the config asks for it
+	if err := webber.EnableTracingFromConfig(config); err != nil {
+		logger.Errorf("Can't enable tracing: %s", err)
+	}
+
 	// initialize the map of caches
 	CacheMap = make(map[string]*cache.Cache)
 
 	// create an App Server
 	as := webber.NewAppServer(config)
 
+	// if we have an api key file, every call needs a valid api key
+	if len(config.APIKeyFile) > 0 {
+		keyStore, err := webber.NewFileAPIKeyStore(config.APIKeyFile)
+		if err != nil {
+			logger.Criticalf("Can't read api key file %s: %s", config.APIKeyFile, err)
+			os.Exit(1)
+		}
+		as.Use(webber.NewAPIKeyAuth(keyStore).Middleware())
+		// the api keys protect changing log levels too
+		as.EnableLogLevels(config.ApiBase + "/admin/loglevel", nil)
+	} else {
+		logger.StdLogger.LOG(logger.WARN, "", "No APIKeyFile configured, cache is unauthenticated", nil)
+	}
+
+	// apply any rate limits in the config.  We keep the buckets ourselves, since we are the
+	// shared store for everyone else
+	limiter, err := webber.NewRateLimiterFromConfig(config, webber.NewMemoryRateLimitStore())
+	if err != nil {
+		logger.Criticalf("Invalid rate limits: %s", err)
+		os.Exit(1)
+	}
+	if limiter != nil {
+		as.Use(limiter.Middleware())
+	}
+
 	//////////////////////////////////
 	// create a couple of handlers
 
@@ -203,6 +373,27 @@ func main() {
 	ch := NewCacheHandler(config.ApiBase + "/cache")
 	as.RegisterHandler(ch)
 
+	// and the shared rate limit buckets to <apibase>/ratelimit
+	as.RegisterHandler(NewRateLimitHandler(config.ApiBase + "/ratelimit"))
+
+	// serve request and cache metrics on /metrics
+	webber.DefaultMetrics.RegisterCollector("cacheserver_items", "Items in each cache", webber.MetricGauge, cacheSizes)
+	as.EnableMetrics("metrics")
+
+	// health probes and version info on /healthz, /readyz and /version
+	as.EnableHealth(webber.NewHealth().AddReadinessCheck("logger", webber.LoggerCheck(logger.StdLogger)))
+
+	// send any buffered logs and spans before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		logger.StdLogger.LOG(logger.INFO, "", "Shutting down", nil)
+		webber.ShutdownTracing()
+		logger.CloseLogger(logger.StdLogger)
+		os.Exit(0)
+	}()
+
 	// now start the server
 	http.HandleFunc("/", as.Handler)
 	http.ListenAndServe(config.Port, nil)
@@ -0,0 +1,65 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"fmt"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newAWSSession creates a session for the AWS loggers
+//
+// parameters:
+//	region : the AWS region
+//	profileName : the profile in ~/.aws/credentials to use
+//	endpoint : the service's endpoint, e.g. "http://localhost:4566" for a local stand in, or "" for AWS's
+//
+// Returns:
+//	the session
+//
+func newAWSSession(region string, profileName string, endpoint string) *session.Session {
+	fmt.Println("Creating new AWS Session for region ", region, " and profile ", profileName)
+	config := aws.Config{Region: aws.String(region)}
+	if len(endpoint) > 0 {
+		config.Endpoint = aws.String(endpoint)
+	}
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		Profile: profileName,
+		Config: config,
+	}))
+}
+
+// recordInfo is what the batching loggers need from a queued entry
+type recordInfo struct {
+	Timestamp int64 `json:"@timestamp"`
+	CorrelationId string `json:"correlation_id"`
+}
+
+// readRecordInfo returns the timestamp and correlation id of a queued entry's json
+func readRecordInfo(data []byte) recordInfo {
+	var info recordInfo
+	json.Unmarshal(data, &info)
+	return info
+}
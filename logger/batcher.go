@@ -0,0 +1,503 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+	"path/filepath"
+	"encoding/base64"
+)
+
+// BatchConfig controls how a batching logger buffers entries and sends them in the background
+type BatchConfig struct {
+	MaxRecords int				// entries per batch, default 500
+	MaxBytes int				// bytes per batch, default 4MB
+	Interval time.Duration		// the longest an entry waits before its batch is sent, default 1 second
+	MaxBuffered int				// entries held in memory, default 10000.  Beyond that they are spilled to disk, or dropped
+	MaxAttempts int				// sends per entry before it is spilled to disk, or dropped, default 5.  Spilled entries get
+								// MaxAttempts more sends once replayed, then are dropped
+	SpillDir string				// where entries are kept while the destination is unavailable, "" to drop them
+	MaxRecordBytes int			// the largest entry the destination accepts, larger ones are dropped rather than failing
+								// their batch.  Each logger sets its destination's limit, and only allows a lower one
+}
+
+// DefaultBatchConfig returns the default batch settings, which suit firehose's PutRecordBatch limits
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{MaxRecords: 500, MaxBytes: 4 * 1024 * 1024, Interval: time.Second, MaxBuffered: 10000, MaxAttempts: 5}
+}
+
+// withDefaults fills in any unset fields
+func (c BatchConfig) withDefaults() BatchConfig {
+	d := DefaultBatchConfig()
+	if c.MaxRecords <= 0 {
+		c.MaxRecords = d.MaxRecords
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = d.MaxBytes
+	}
+	if c.Interval <= 0 {
+		c.Interval = d.Interval
+	}
+	if c.MaxBuffered <= 0 {
+		c.MaxBuffered = d.MaxBuffered
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = d.MaxAttempts
+	}
+	return c
+}
+
+// withRecordLimit keeps MaxRecordBytes within max, the destination's own limit
+func (c BatchConfig) withRecordLimit(max int) BatchConfig {
+	if c.MaxRecordBytes <= 0 || c.MaxRecordBytes > max {
+		c.MaxRecordBytes = max
+	}
+	return c
+}
+
+// BatchStats counts what a batching logger has done with its entries
+type BatchStats struct {
+	Buffered int		// entries waiting in memory
+	Sent int64			// entries delivered
+	Retried int64		// entries that failed and were queued again
+	Spilled int64		// entries written to the spill directory
+	Dropped int64		// entries lost, because there was no room and nowhere to spill them, they were too big,
+						// or they kept failing
+}
+
+// sendBatchFunc sends records, returning the indexes of any that failed individually (to be
+// retried), or an error if the whole batch failed
+type sendBatchFunc func(records [][]byte) (failed []int, err error)
+
+type batchRecord struct {
+	data []byte
+	attempts int		// sends that failed, kept in spill files so a record the destination always rejects is dropped in the end
+}
+
+// batcher buffers records and sends them in batches from a background goroutine, retrying records
+// that fail and spilling them to disk while the destination is unavailable.  Spilled records are
+// sent once the destination is working again, including by the next process to use the same
+// SpillDir and name.
+type batcher struct {
+	name string
+	fileName string				// name, safe to use in spill file names
+	config BatchConfig
+	send sendBatchFunc
+
+	mu sync.Mutex
+	queue []batchRecord
+	stats BatchStats
+	closed bool
+	lastErr error
+	lastErrTime time.Time
+	retryAt time.Time			// don't send before this, after a batch failed
+	backoff time.Duration
+	haveSpill bool				// there may be spill files to send
+	spillSeq int
+
+	sendMu sync.Mutex			// one send at a time, from the worker or Flush
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newBatcher creates a batcher and starts its worker
+//
+// parameters:
+//	name : names the spill files and error messages, e.g. "firehose-mystream"
+//	config : the batch settings
+//	send : sends a batch
+//
+// Returns:
+//	a pointer to the batcher
+//
+func newBatcher(name string, config BatchConfig, send sendBatchFunc) *batcher {
+	b := new(batcher)
+	b.name = name
+	b.fileName = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+	b.config = config.withDefaults()
+	b.send = send
+	b.wake = make(chan struct{}, 1)
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+	// send anything a previous run left behind
+	b.haveSpill = len(b.config.SpillDir) > 0
+	go b.run()
+	return b
+}
+
+// add queues a record, waking the worker if there's a full batch.  A record bigger than MaxRecordBytes
+// is dropped, as the destination would fail it and the batch it was sent with.
+func (b *batcher) add(data []byte) {
+	var spill []batchRecord
+	b.mu.Lock()
+	if b.closed {
+		b.stats.Dropped++
+		b.mu.Unlock()
+		return
+	}
+	if b.config.MaxRecordBytes > 0 && len(data) > b.config.MaxRecordBytes {
+		b.stats.Dropped++
+		b.mu.Unlock()
+		fmt.Println("Dropped a log of", len(data), "bytes for", b.name, ", the limit is", b.config.MaxRecordBytes)
+		return
+	}
+	if len(b.queue) >= b.config.MaxBuffered {
+		if len(b.config.SpillDir) == 0 {
+			b.stats.Dropped++
+			b.mu.Unlock()
+			return
+		}
+		// move everything waiting to disk, to be sent when the destination catches up
+		spill = b.queue
+		b.queue = nil
+	}
+	b.queue = append(b.queue, batchRecord{data: data})
+	full := len(b.queue) >= b.config.MaxRecords
+	b.mu.Unlock()
+
+	if spill != nil {
+		b.spill(spill)
+	}
+	if full {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.sendPending(true, false)
+		case <-b.wake:
+			b.sendPending(false, false)
+		}
+	}
+}
+
+// take removes the next batch from the queue, or returns nil if there isn't one to send
+func (b *batcher) take(all bool) []batchRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.queue) == 0 || (!all && len(b.queue) < b.config.MaxRecords) {
+		return nil
+	}
+	n, size := 0, 0
+	for n < len(b.queue) && n < b.config.MaxRecords {
+		size += len(b.queue[n].data)
+		if n > 0 && size > b.config.MaxBytes {
+			break
+		}
+		n++
+	}
+	batch := append([]batchRecord(nil), b.queue[:n]...)
+	b.queue = b.queue[n:]
+	return batch
+}
+
+// sendPending sends batches until the queue is empty (or, if all is false, until there isn't a
+// full batch), or a send fails.  Unless force is set, it waits out the backoff after a failure.
+func (b *batcher) sendPending(all bool, force bool) error {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	b.mu.Lock()
+	wait := time.Now().Before(b.retryAt)
+	b.mu.Unlock()
+	if wait && !force {
+		return nil
+	}
+	for {
+		for {
+			batch := b.take(all)
+			if batch == nil {
+				break
+			}
+			if err := b.sendBatch(batch); err != nil {
+				return err
+			}
+		}
+		// send what was replayed now, so a good send of it ends the outage even if nothing new is logged
+		if !b.replaySpill() {
+			return nil
+		}
+	}
+}
+
+// sendBatch sends one batch, requeuing the records that failed
+func (b *batcher) sendBatch(batch []batchRecord) error {
+	records := make([][]byte, len(batch))
+	for i, r := range batch {
+		records[i] = r.data
+	}
+	failed, err := b.send(records)
+
+	var retry, giveUp, drop []batchRecord
+	if err != nil {
+		failed = make([]int, len(batch))
+		for i := range batch {
+			failed[i] = i
+		}
+	}
+	for _, i := range failed {
+		r := batch[i]
+		r.attempts++
+		if r.attempts >= 2 * b.config.MaxAttempts {
+			// failed before it was spilled and again after, it isn't going to be sent
+			drop = append(drop, r)
+		} else if r.attempts % b.config.MaxAttempts == 0 {
+			giveUp = append(giveUp, r)
+		} else {
+			retry = append(retry, r)
+		}
+	}
+
+	b.mu.Lock()
+	b.stats.Sent += int64(len(batch) - len(failed))
+	b.stats.Dropped += int64(len(drop))
+	b.stats.Retried += int64(len(retry))
+	// retries go to the front, so they're next
+	b.queue = append(retry, b.queue...)
+	if err != nil || len(failed) > 0 {
+		if err == nil {
+			err = fmt.Errorf("%d of %d records failed", len(failed), len(batch))
+		}
+		b.lastErr = err
+		b.lastErrTime = time.Now()
+		b.backoff = b.backoff * 2
+		if b.backoff < b.config.Interval {
+			b.backoff = b.config.Interval
+		}
+		if b.backoff > time.Minute {
+			b.backoff = time.Minute
+		}
+		b.retryAt = time.Now().Add(b.backoff)
+	} else {
+		b.lastErr = nil
+		b.backoff = 0
+		b.retryAt = time.Time{}
+	}
+	b.mu.Unlock()
+
+	if len(giveUp) > 0 {
+		b.spill(giveUp)
+	}
+	if len(drop) > 0 {
+		fmt.Println("Dropped", len(drop), "logs for", b.name, "after", 2 * b.config.MaxAttempts, "failed sends")
+	}
+	if err != nil {
+		fmt.Println("Failed to send logs to", b.name, ":", err)
+	}
+	return err
+}
+
+// spill writes records to a new file in SpillDir, or drops them if there isn't one
+func (b *batcher) spill(records []batchRecord) {
+	if len(b.config.SpillDir) == 0 {
+		b.mu.Lock()
+		b.stats.Dropped += int64(len(records))
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Lock()
+	b.spillSeq++
+	path := filepath.Join(b.config.SpillDir, fmt.Sprintf("%s-%s-%06d.spill", b.fileName, time.Now().UTC().Format("20060102T150405.000"), b.spillSeq))
+	b.mu.Unlock()
+
+	err := writeSpillFile(path, records)
+	b.mu.Lock()
+	if err != nil {
+		fmt.Println("Failed to spill logs for", b.name, ":", err)
+		b.stats.Dropped += int64(len(records))
+	} else {
+		b.stats.Spilled += int64(len(records))
+		b.haveSpill = true
+	}
+	b.mu.Unlock()
+}
+
+func writeSpillFile(path string, records []batchRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// written to a temp name then renamed, so a half written file is never replayed
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	// a line per record: its failed attempts and its base64 data
+	for _, r := range records {
+		fmt.Fprintf(w, "%d %s\n", r.attempts, base64.StdEncoding.EncodeToString(r.data))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path + ".tmp", path)
+}
+
+// replaySpill moves the oldest spill file back into the queue, if there's room and the destination
+// is working or its backoff has passed.  Returns true if it took a spill file.  The sender lock must
+// be held.
+func (b *batcher) replaySpill() bool {
+	b.mu.Lock()
+	room := b.config.MaxBuffered - len(b.queue)
+	working := b.lastErr == nil || !time.Now().Before(b.retryAt)
+	ok := b.haveSpill && !b.closed && working && room >= b.config.MaxBuffered / 2
+	b.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	files, _ := filepath.Glob(filepath.Join(b.config.SpillDir, b.fileName + "-[0-9]*.spill"))
+	if len(files) == 0 {
+		b.mu.Lock()
+		b.haveSpill = false
+		b.mu.Unlock()
+		return false
+	}
+	sort.Strings(files)
+	records, err := readSpillFile(files[0])
+	if err != nil {
+		fmt.Println("Failed to read spilled logs for", b.name, ":", err)
+		// move it aside so it isn't tried forever, and go on to the next one
+		os.Rename(files[0], files[0] + ".bad")
+		return true
+	}
+	if len(records) > room {
+		// a file spilled with a bigger MaxBuffered, wait for more room
+		return false
+	}
+	os.Remove(files[0])
+	b.mu.Lock()
+	b.queue = append(b.queue, records...)
+	b.mu.Unlock()
+	return true
+}
+
+func readSpillFile(path string) ([]batchRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []batchRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		// files from before the attempts were kept have just the data
+		attempts := 0
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			if attempts, err = strconv.Atoi(line[:i]); err != nil {
+				return nil, err
+			}
+			line = line[i+1:]
+		}
+		data, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, batchRecord{data: data, attempts: attempts})
+	}
+	return records, scanner.Err()
+}
+
+// flush sends everything queued now, ignoring any backoff
+func (b *batcher) flush() error {
+	return b.sendPending(true, true)
+}
+
+// close stops the worker and flushes.  Anything that can't be sent is spilled (or dropped).
+func (b *batcher) close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+	close(b.stop)
+	<-b.done
+
+	err := b.flush()
+	b.mu.Lock()
+	left := b.queue
+	b.queue = nil
+	b.mu.Unlock()
+	if len(left) > 0 {
+		b.spill(left)
+		if err == nil {
+			err = errors.New("not all logs could be sent")
+		}
+	}
+	return err
+}
+
+// status returns the error from the last send, or nil if it worked
+func (b *batcher) status() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lastErr != nil {
+		return fmt.Errorf("last send to %s failed at %s: %s", b.name, b.lastErrTime.Format(time.RFC3339), b.lastErr)
+	}
+	return nil
+}
+
+func (b *batcher) getStats() BatchStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats
+	s.Buffered = len(b.queue)
+	return s
+}
@@ -0,0 +1,300 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"errors"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// PutLogEvents limits: an event is at most 256KB and a batch at most 1MB, counting 26 bytes for
+// each event, and a batch covers at most 24 hours
+const (
+	cloudWatchMaxEventBytes = 256 * 1024 - 26
+	cloudWatchMaxBytes = 768 * 1024
+	cloudWatchMaxRecords = 10000
+	cloudWatchMaxSpan = 24 * time.Hour
+)
+
+// CloudWatchLogsAPI is the part of the CloudWatch Logs client the logger uses, so tests can supply a fake
+type CloudWatchLogsAPI interface {
+	PutLogEvents(*cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error)
+	CreateLogGroup(*cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error)
+	CreateLogStream(*cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	DescribeLogStreams(*cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
+}
+
+// CloudWatchConfig says where a CloudWatchLogger writes
+type CloudWatchConfig struct {
+	LogGroup string			// the log group, e.g. "/goweb/webbertut"
+	LogStream string		// the log stream, default the app's name and instance, or the host name
+	CreateLogGroup bool		// create the log group if it doesn't exist.  Groups are often made with retention settings, so this is off by default
+	CreateLogStream bool	// create the log stream if it doesn't exist
+	Endpoint string			// the CloudWatch Logs endpoint, e.g. "http://localhost:4566" for a local stand in, or "" for AWS's
+	Batch BatchConfig		// batch settings.  Batches are limited to CloudWatch's 768KB (after overhead) and 10000 events
+}
+
+// CloudWatchLogger sends entries to a CloudWatch Logs stream in batches from a background
+// goroutine, as FirehoseLogger does.  Call Close at shutdown to send what's left.
+type CloudWatchLogger struct {
+	AWSSession *session.Session
+	Client CloudWatchLogsAPI
+	LogGroup string
+	LogStream string
+	AlsoToStdout bool
+	App AppInfo
+
+	config CloudWatchConfig
+	sequenceToken *string		// only used by the batcher's sender
+	batches *batcher
+}
+
+// NewCloudWatchLogger creates an AWS session and a CloudWatch Logs client, and a logger that uses them
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	region : the AWS region the log group is in
+//	profileName : the profile stored in ~/.aws/credentials that provides the creds for accessing AWS
+//	config : the log group and stream to write to
+//
+// Returns:
+//	a pointer to the CloudWatchLogger
+//
+func NewCloudWatchLogger(app AppInfo, region string, profileName string, config CloudWatchConfig) *CloudWatchLogger {
+	sess := newAWSSession(region, profileName, config.Endpoint)
+	l := NewCloudWatchLoggerWithClient(app, cloudwatchlogs.New(sess), config)
+	l.AWSSession = sess
+	return l
+}
+
+// NewCloudWatchLoggerWithClient creates a CloudWatchLogger that sends with client.  The log group
+// and stream are created (if the config allows) the first time they're found to be missing.
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	client : the CloudWatch Logs client, e.g. cloudwatchlogs.New(sess)
+//	config : the log group and stream to write to
+//
+// Returns:
+//	a pointer to the CloudWatchLogger
+//
+func NewCloudWatchLoggerWithClient(app AppInfo, client CloudWatchLogsAPI, config CloudWatchConfig) *CloudWatchLogger {
+	l := new(CloudWatchLogger)
+	l.Client = client
+	l.App = app
+	l.LogGroup = config.LogGroup
+	l.LogStream = config.LogStream
+	if len(l.LogStream) == 0 {
+		l.LogStream = defaultStreamName(app)
+	}
+	l.config = config
+
+	batch := config.Batch.withDefaults()
+	if batch.MaxBytes > cloudWatchMaxBytes {
+		batch.MaxBytes = cloudWatchMaxBytes
+	}
+	if batch.MaxRecords > cloudWatchMaxRecords {
+		batch.MaxRecords = cloudWatchMaxRecords
+	}
+	batch = batch.withRecordLimit(cloudWatchMaxEventBytes)
+	l.batches = newBatcher("cloudwatch-" + l.LogGroup + "-" + l.LogStream, batch, l.sendBatch)
+	return l
+}
+
+// defaultStreamName names a stream after the app and instance, or the host
+func defaultStreamName(app AppInfo) string {
+	if len(app.Name) > 0 && len(app.Instance) > 0 {
+		return app.Name + "-" + app.Instance
+	}
+	host, _ := os.Hostname()
+	if len(app.Name) > 0 {
+		return app.Name + "-" + host
+	}
+	return host
+}
+
+func (l *CloudWatchLogger) StdOutOn(alsoToStdOut bool) {
+	l.AlsoToStdout = alsoToStdOut
+}
+
+// LOG queues the entry to be sent with the next batch
+func (l *CloudWatchLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(l.App, level, correlationid, msg, keys))
+}
+
+// WriteEntry queues the entry, as from the logger's App
+func (l *CloudWatchLogger) WriteEntry(entry LogEntry) {
+	entry.App = l.App
+	data, _ := json.Marshal(entry)
+	if l.AlsoToStdout {
+		fmt.Println(entry.Text())
+	}
+	l.batches.add(data)
+}
+
+// sendBatch puts the records as events, oldest first.  PutLogEvents only takes 24 hours of events
+// at a time, so a batch covering more is sent in several calls.  If one fails, its records and the
+// ones after it are returned as failed, so the ones already sent aren't sent again.
+func (l *CloudWatchLogger) sendBatch(records [][]byte) ([]int, error) {
+	order := make([]int, len(records))
+	times := make([]int64, len(records))
+	for i, data := range records {
+		order[i] = i
+		times[i] = readRecordInfo(data).Timestamp
+	}
+	sort.SliceStable(order, func(a, b int) bool { return times[order[a]] < times[order[b]] })
+
+	for start := 0; start < len(order); {
+		end := start
+		var events []*cloudwatchlogs.InputLogEvent
+		for end < len(order) && times[order[end]] - times[order[start]] <= int64(cloudWatchMaxSpan / time.Millisecond) {
+			i := order[end]
+			events = append(events, &cloudwatchlogs.InputLogEvent{Message: aws.String(string(records[i])), Timestamp: aws.Int64(times[i])})
+			end++
+		}
+
+		out, err := l.put(events, true)
+		if err != nil {
+			if start == 0 {
+				return nil, err
+			}
+			return order[start:], nil
+		}
+		if out != nil && out.RejectedLogEventsInfo != nil {
+			// too old or too new for CloudWatch, they'll never be accepted
+			fmt.Println("CloudWatch rejected log events for", l.LogGroup, l.LogStream, ":", out.RejectedLogEventsInfo)
+		}
+		start = end
+	}
+	return nil, nil
+}
+
+// put sends the events, creating the group and stream or refreshing the sequence token if that's
+// what's wrong, then trying once more if retry is set
+func (l *CloudWatchLogger) put(events []*cloudwatchlogs.InputLogEvent, retry bool) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	out, err := l.Client.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+		LogGroupName: aws.String(l.LogGroup),
+		LogStreamName: aws.String(l.LogStream),
+		LogEvents: events,
+		SequenceToken: l.sequenceToken,
+	})
+	if err == nil {
+		if out != nil {
+			l.sequenceToken = out.NextSequenceToken
+		}
+		return out, nil
+	}
+
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return nil, err
+	}
+	switch aerr.Code() {
+	case cloudwatchlogs.ErrCodeDataAlreadyAcceptedException:
+		// sent before, but we didn't hear back
+		l.refreshSequenceToken()
+		return nil, nil
+	case cloudwatchlogs.ErrCodeInvalidSequenceTokenException:
+		if retry && l.refreshSequenceToken() == nil {
+			return l.put(events, false)
+		}
+	case cloudwatchlogs.ErrCodeResourceNotFoundException:
+		if retry && (l.config.CreateLogGroup || l.config.CreateLogStream) && l.create() == nil {
+			return l.put(events, false)
+		}
+	}
+	return nil, err
+}
+
+// refreshSequenceToken reads the stream's current sequence token
+func (l *CloudWatchLogger) refreshSequenceToken() error {
+	out, err := l.Client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName: aws.String(l.LogGroup),
+		LogStreamNamePrefix: aws.String(l.LogStream),
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range out.LogStreams {
+		if aws.StringValue(s.LogStreamName) == l.LogStream {
+			l.sequenceToken = s.UploadSequenceToken
+			return nil
+		}
+	}
+	return fmt.Errorf("log stream %s not found in %s", l.LogStream, l.LogGroup)
+}
+
+// create creates the log group and stream, as the config allows.  Ones that already exist are fine.
+func (l *CloudWatchLogger) create() error {
+	if l.config.CreateLogGroup {
+		fmt.Println("Creating CloudWatch log group", l.LogGroup)
+		_, err := l.Client.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{LogGroupName: aws.String(l.LogGroup)})
+		if err != nil && !alreadyExists(err) {
+			return err
+		}
+	}
+	if !l.config.CreateLogStream {
+		return nil
+	}
+	fmt.Println("Creating CloudWatch log stream", l.LogStream, "in", l.LogGroup)
+	_, err := l.Client.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{LogGroupName: aws.String(l.LogGroup), LogStreamName: aws.String(l.LogStream)})
+	if err != nil && !alreadyExists(err) {
+		return err
+	}
+	l.sequenceToken = nil
+	return nil
+}
+
+func alreadyExists(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException
+}
+
+// Flush sends everything buffered now, returning an error if any of it couldn't be sent
+func (l *CloudWatchLogger) Flush() error {
+	return l.batches.flush()
+}
+
+// Close sends everything buffered and stops the background sender.  Anything that still can't be
+// sent is spilled to disk, if there's a SpillDir.
+func (l *CloudWatchLogger) Close() error {
+	return l.batches.close()
+}
+
+// Stats returns counts of the entries sent, retried, spilled and dropped
+func (l *CloudWatchLogger) Stats() BatchStats {
+	return l.batches.getStats()
+}
+
+// Status returns the error from the most recent attempt to send logs, or nil if it worked
+func (l *CloudWatchLogger) Status() error {
+	return l.batches.status()
+}
@@ -0,0 +1,113 @@
+package logger
+
+import (
+	"sync"
+	"time"
+	"testing"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// fakeCloudWatch checks sequence tokens and event order like CloudWatch Logs, and only has the
+// log group and stream once they're created
+type fakeCloudWatch struct {
+	mu sync.Mutex
+	group, stream bool
+	token int
+	events []*cloudwatchlogs.InputLogEvent
+}
+
+func (f *fakeCloudWatch) PutLogEvents(in *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.group || !f.stream {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log stream does not exist.", nil)
+	}
+	if f.token > 0 && aws.StringValue(in.SequenceToken) != string(rune('a' + f.token)) {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeInvalidSequenceTokenException, "The given sequenceToken is invalid.", nil)
+	}
+	for i := 1; i < len(in.LogEvents); i++ {
+		if *in.LogEvents[i].Timestamp < *in.LogEvents[i - 1].Timestamp {
+			return nil, awserr.New("InvalidParameterException", "Log events in a single PutLogEvents request must be in chronological order.", nil)
+		}
+	}
+	f.events = append(f.events, in.LogEvents...)
+	f.token++
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String(string(rune('a' + f.token)))}, nil
+}
+
+func (f *fakeCloudWatch) CreateLogGroup(in *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.group = true
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (f *fakeCloudWatch) CreateLogStream(in *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.group {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	}
+	f.stream = true
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+func (f *fakeCloudWatch) DescribeLogStreams(in *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := &cloudwatchlogs.LogStream{LogStreamName: in.LogStreamNamePrefix, UploadSequenceToken: aws.String(string(rune('a' + f.token)))}
+	return &cloudwatchlogs.DescribeLogStreamsOutput{LogStreams: []*cloudwatchlogs.LogStream{s}}, nil
+}
+
+// the group and stream are only created if the config allows, events are sent oldest first, and a
+// stale sequence token is refreshed
+func TestCloudWatchLogger(t *testing.T) {
+	fake := new(fakeCloudWatch)
+	config := CloudWatchConfig{LogGroup: "/goweb/test", Batch: BatchConfig{Interval: time.Hour}}
+	l := NewCloudWatchLoggerWithClient(AppInfo{Name: "test", Instance: "1"}, fake, config)
+	l.LOG(INFO, "", "first", nil)
+	if err := l.Flush(); err == nil || fake.group {
+		t.Fatalf("TestCloudWatchLogger expected to fail without creating the group, got %v", err)
+	}
+	l.Close()
+
+	config.CreateLogGroup, config.CreateLogStream = true, true
+	l = NewCloudWatchLoggerWithClient(AppInfo{Name: "test", Instance: "1"}, fake, config)
+	if l.LogStream != "test-1" {
+		t.Fatalf("TestCloudWatchLogger expected the stream to be named for the app, got %s", l.LogStream)
+	}
+	now := time.Now()
+	for _, offset := range []time.Duration{0, -time.Second, time.Second} {
+		e := NewLogEntry(AppInfo{}, INFO, "", offset.String(), nil)
+		e.Timestamp = now.Add(offset).UnixNano()/1000000
+		l.WriteEntry(e)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatalf("TestCloudWatchLogger Flush failed: %s", err)
+	}
+
+	// another writer moved the token on
+	fake.mu.Lock()
+	fake.token++
+	fake.mu.Unlock()
+	l.LOG(WARN, "", "after", nil)
+	if err := l.Close(); err != nil {
+		t.Fatalf("TestCloudWatchLogger expected the sequence token to be refreshed, got %s", err)
+	}
+	if len(fake.events) != 4 || readRecordInfo([]byte(*fake.events[0].Message)).Timestamp != now.Add(-time.Second).UnixNano()/1000000 {
+		t.Fatalf("TestCloudWatchLogger expected 4 events oldest first, got %d", len(fake.events))
+	}
+
+	// a batch covering more than 24 hours is sent in several calls, without counting as a failure
+	l = NewCloudWatchLoggerWithClient(AppInfo{Name: "test", Instance: "1"}, fake, config)
+	for _, offset := range []time.Duration{0, -25 * time.Hour, -50 * time.Hour} {
+		e := NewLogEntry(AppInfo{}, INFO, "", offset.String(), nil)
+		e.Timestamp = now.Add(offset).UnixNano()/1000000
+		l.WriteEntry(e)
+	}
+	if err := l.Close(); err != nil || l.Stats().Retried != 0 || l.Stats().Sent != 3 || len(fake.events) != 7 {
+		t.Fatalf("TestCloudWatchLogger expected 3 events sent without retries, got %v and %+v", err, l.Stats())
+	}
+}
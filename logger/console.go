@@ -0,0 +1,81 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"io"
+	"sync"
+	"encoding/json"
+)
+
+// ConsoleLogger writes entries to stdout (or any writer), one per line, either as text for
+// people to read or as json for log shippers
+type ConsoleLogger struct {
+	Out io.Writer
+	JSON bool			// if true, entries are written as json, otherwise as text
+	App AppInfo
+
+	mu sync.Mutex
+}
+
+// NewConsoleLogger creates a ConsoleLogger
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	out : where to write, usually os.Stdout
+//	asJSON : true to write json lines, false for text
+//
+// Returns:
+//	a pointer to a ConsoleLogger struct
+//
+func NewConsoleLogger(app AppInfo, out io.Writer, asJSON bool) *ConsoleLogger {
+	l := new(ConsoleLogger)
+	l.Out = out
+	l.JSON = asJSON
+	l.App = app
+	return l
+}
+
+// StdOutOn does nothing, a ConsoleLogger already writes to stdout
+func (l *ConsoleLogger) StdOutOn(alsoToStdOut bool) {
+}
+
+func (l *ConsoleLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(l.App, level, correlationid, msg, keys))
+}
+
+// WriteEntry writes the entry, as from the logger's App
+func (l *ConsoleLogger) WriteEntry(entry LogEntry) {
+	entry.App = l.App
+	var line []byte
+	if l.JSON {
+		line, _ = json.Marshal(entry)
+	} else {
+		line = []byte(entry.Text())
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	l.Out.Write(line)
+	l.mu.Unlock()
+}
@@ -0,0 +1,288 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+)
+
+// ElasticsearchConfig says where an ElasticsearchLogger writes
+type ElasticsearchConfig struct {
+	URL string				// the cluster, e.g. "https://logs.example.com:9200"
+	Index string			// the index prefix, default "logs".  Entries go to prefix-YYYY.MM.DD, by their UTC @timestamp
+	Username string			// for basic auth, "" for none
+	Password string
+	APIKey string			// the base64 encoded api key, sent as "Authorization: ApiKey ...", "" for none
+	CreateTemplate bool		// install an index template, prefix-template, for prefix-* before the first batch, mapping the entry's fields
+	Timeout time.Duration	// the longest a _bulk request may take, default 30 seconds
+	Batch BatchConfig		// batch settings
+}
+
+// ElasticsearchLogger sends entries to an Elasticsearch or OpenSearch cluster's _bulk api, in
+// batches from a background goroutine, as FirehoseLogger does.  Entries go to an index per day.
+// Entries the cluster is too busy for are retried; ones it rejects (e.g. mapping errors) are
+// reported and dropped.  Call Close at shutdown to send what's left.
+type ElasticsearchLogger struct {
+	Client *http.Client
+	URL string
+	Index string
+	AlsoToStdout bool
+	App AppInfo
+
+	config ElasticsearchConfig
+	templateTried bool		// only used by sendBatch, which the batcher calls one at a time
+	batches *batcher
+}
+
+// NewElasticsearchLogger creates a logger that sends to an Elasticsearch or OpenSearch cluster.
+// The indexes are created by the cluster as entries arrive, so it must allow that.
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	config : the cluster to write to
+//
+// Returns:
+//	a pointer to the ElasticsearchLogger
+//
+func NewElasticsearchLogger(app AppInfo, config ElasticsearchConfig) *ElasticsearchLogger {
+	l := new(ElasticsearchLogger)
+	if len(config.Index) == 0 {
+		config.Index = "logs"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	l.Client = &http.Client{Timeout: config.Timeout}
+	l.URL = strings.TrimRight(config.URL, "/")
+	l.Index = config.Index
+	l.App = app
+	l.config = config
+	l.batches = newBatcher("elasticsearch-" + config.Index, config.Batch, l.sendBatch)
+	return l
+}
+
+func (l *ElasticsearchLogger) StdOutOn(alsoToStdOut bool) {
+	l.AlsoToStdout = alsoToStdOut
+}
+
+// LOG queues the entry to be sent with the next batch
+func (l *ElasticsearchLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(l.App, level, correlationid, msg, keys))
+}
+
+// WriteEntry queues the entry, as from the logger's App
+func (l *ElasticsearchLogger) WriteEntry(entry LogEntry) {
+	entry.App = l.App
+	data, _ := json.Marshal(entry)
+	if l.AlsoToStdout {
+		fmt.Println(entry.Text())
+	}
+	l.batches.add(data)
+}
+
+// IndexName returns the index an entry logged at timestamp goes to
+//
+// parameters:
+//	timestamp : the entry's @timestamp, in milliseconds since the epoch
+//
+// Returns:
+//	the index, e.g. "logs-2018.06.30"
+//
+func (l *ElasticsearchLogger) IndexName(timestamp int64) string {
+	t := time.Now()
+	if timestamp > 0 {
+		t = time.Unix(0, timestamp * int64(time.Millisecond))
+	}
+	return l.Index + "-" + t.UTC().Format("2006.01.02")
+}
+
+// TemplateName returns the name of the index template installed when CreateTemplate is set.  It
+// isn't just the prefix, so the default "logs" doesn't replace Elasticsearch's own "logs" template.
+func (l *ElasticsearchLogger) TemplateName() string {
+	return l.Index + "-template"
+}
+
+// IndexTemplate returns the index template installed when CreateTemplate is set.  @timestamp is
+// a date, the message is text, and the level, ids, app info and keys are keywords.  Its priority
+// is above the built in templates' (e.g. Elasticsearch's logs-*-* at 100), so it wins for its indexes.
+func (l *ElasticsearchLogger) IndexTemplate() map[string]interface{} {
+	keyword := map[string]interface{}{"type": "keyword"}
+	return map[string]interface{}{
+		"index_patterns": []string{l.Index + "-*"},
+		"priority": 200,
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{"keys": map[string]interface{}{"path_match": "keys.*", "mapping": keyword}},
+				},
+				"properties": map[string]interface{}{
+					"@timestamp": map[string]interface{}{"type": "date", "format": "epoch_millis"},
+					"level": keyword,
+					"correlation_id": keyword,
+					"message": map[string]interface{}{"type": "text"},
+					"appinfo": map[string]interface{}{"properties": map[string]interface{}{
+						"name": keyword, "version": keyword, "cluster": keyword, "instance": keyword,
+					}},
+				},
+			},
+		},
+	}
+}
+
+// elasticsearchError is the error for a response that wasn't 2xx, as opposed to the request failing
+type elasticsearchError struct {
+	msg string
+}
+
+func (e *elasticsearchError) Error() string {
+	return e.msg
+}
+
+// do sends a request to the cluster with the configured auth, returning the response body, or an
+// error if the request failed or the cluster didn't return 2xx (an *elasticsearchError)
+func (l *ElasticsearchLogger) do(method string, path string, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, l.URL + path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if len(l.config.APIKey) > 0 {
+		req.Header.Set("Authorization", "ApiKey " + l.config.APIKey)
+	} else if len(l.config.Username) > 0 {
+		req.SetBasicAuth(l.config.Username, l.config.Password)
+	}
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := string(data)
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return nil, &elasticsearchError{fmt.Sprintf("%s %s returned %s: %s", method, path, resp.Status, msg)}
+	}
+	return data, nil
+}
+
+// bulkResponse is the part of the _bulk response the logger uses
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items []map[string]struct {
+		Status int `json:"status"`
+		Error json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// sendBatch indexes a batch of records with _bulk, returning the indexes of any the cluster was
+// too busy for, or an error if the request failed
+func (l *ElasticsearchLogger) sendBatch(records [][]byte) ([]int, error) {
+	if l.config.CreateTemplate && !l.templateTried {
+		// if the cluster refuses the template (e.g. it's too old for composable templates, or the user
+		// can't manage them) the logs are sent without it, and the cluster maps the fields itself.  If
+		// the cluster can't be reached, the batch couldn't be sent either, so try again next time.
+		template, _ := json.Marshal(l.IndexTemplate())
+		_, err := l.do("PUT", "/_index_template/" + l.TemplateName(), "application/json", template)
+		if _, refused := err.(*elasticsearchError); err != nil && !refused {
+			return nil, err
+		}
+		l.templateTried = true
+		if err != nil {
+			fmt.Println("Failed to install the index template for", l.Index, ", sending logs without it:", err)
+		}
+	}
+
+	var body bytes.Buffer
+	for _, data := range records {
+		action, _ := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": l.IndexName(readRecordInfo(data).Timestamp)}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(data)
+		body.WriteByte('\n')
+	}
+	data, err := l.do("POST", "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var resp bulkResponse
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Errors {
+		return nil, nil
+	}
+	if len(resp.Items) != len(records) {
+		return nil, errors.New("_bulk returned the wrong number of items")
+	}
+	var failed []int
+	rejected := 0
+	var reason json.RawMessage
+	for i, item := range resp.Items {
+		for _, result := range item {
+			switch {
+			case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+				failed = append(failed, i)
+			case result.Status >= 300:
+				rejected++
+				reason = result.Error
+			}
+		}
+	}
+	if rejected > 0 {
+		fmt.Println("Elasticsearch rejected", rejected, "log entries, e.g.", string(reason))
+	}
+	return failed, nil
+}
+
+// Flush sends everything buffered now, returning an error if any of it couldn't be sent
+func (l *ElasticsearchLogger) Flush() error {
+	return l.batches.flush()
+}
+
+// Close sends everything buffered and stops the background sender.  Anything that still can't be
+// sent is spilled to disk, if there's a SpillDir.
+func (l *ElasticsearchLogger) Close() error {
+	return l.batches.close()
+}
+
+// Stats returns counts of the entries sent, retried, spilled and dropped
+func (l *ElasticsearchLogger) Stats() BatchStats {
+	return l.batches.getStats()
+}
+
+// Status returns the error from the most recent attempt to send logs, or nil if it worked
+func (l *ElasticsearchLogger) Status() error {
+	return l.batches.status()
+}
@@ -0,0 +1,96 @@
+package logger
+
+import (
+	"sync"
+	"time"
+	"bufio"
+	"strings"
+	"testing"
+	"net/http"
+	"encoding/json"
+	"net/http/httptest"
+)
+
+// an httptest stand in for the cluster: it throttles the first document of the first _bulk request
+// and rejects documents with the message "bad"
+type fakeElasticsearch struct {
+	mu sync.Mutex
+	templates int
+	bulks int
+	indexed map[string][]string		// messages by index
+	auth string
+}
+
+func (f *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = r.Header.Get("Authorization")
+	switch {
+	case r.Method == "PUT" && r.URL.Path == "/_index_template/hikes-template":
+		f.templates++
+		w.Write([]byte(`{"acknowledged":true}`))
+	case r.Method == "PUT" && r.URL.Path == "/_index_template/denied-template":
+		http.Error(w, `{"error":{"type":"security_exception"}}`, http.StatusForbidden)
+	case r.Method == "POST" && r.URL.Path == "/_bulk":
+		f.bulks++
+		var items []interface{}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			json.Unmarshal(scanner.Bytes(), &action)
+			scanner.Scan()
+			var entry LogEntry
+			json.Unmarshal(scanner.Bytes(), &entry)
+			index := action["index"]["_index"]
+			switch {
+			case f.bulks == 1 && len(items) == 0:
+				items = append(items, map[string]interface{}{"index": map[string]interface{}{"status": 429, "error": map[string]string{"type": "es_rejected_execution_exception"}}})
+			case entry.Message == "bad":
+				items = append(items, map[string]interface{}{"index": map[string]interface{}{"status": 400, "error": map[string]string{"type": "mapper_parsing_exception"}}})
+			default:
+				f.indexed[index] = append(f.indexed[index], entry.Message)
+				items = append(items, map[string]interface{}{"index": map[string]interface{}{"status": 201}})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": true, "items": items})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// entries go to daily indexes after the template is installed, busy entries are retried and
+// rejected ones aren't
+func TestElasticsearchLogger(t *testing.T) {
+	fake := &fakeElasticsearch{indexed: map[string][]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	l := NewElasticsearchLogger(AppInfo{Name: "test"}, ElasticsearchConfig{URL: server.URL + "/", Index: "hikes", APIKey: "a2V5",
+		CreateTemplate: true, Batch: BatchConfig{Interval: time.Hour}})
+	day := time.Date(2018, 6, 30, 23, 57, 0, 0, time.UTC)
+	for i, msg := range []string{"one", "two", "bad", "three"} {
+		e := NewLogEntry(AppInfo{}, INFO, "", msg, nil)
+		e.Timestamp = day.Add(time.Duration(i) * time.Minute).UnixNano()/1000000
+		l.WriteEntry(e)
+	}
+	if err := l.Flush(); err == nil || !strings.Contains(l.Status().Error(), "1 of 4") {
+		t.Fatalf("TestElasticsearchLogger expected the busy entry to be reported, got %v", l.Status())
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("TestElasticsearchLogger Close failed: %s", err)
+	}
+	if fake.templates != 1 || fake.auth != "ApiKey a2V5" {
+		t.Fatalf("TestElasticsearchLogger expected one template and api key auth, got %d and %q", fake.templates, fake.auth)
+	}
+	if strings.Join(fake.indexed["hikes-2018.06.30"], ",") != "two,one" || strings.Join(fake.indexed["hikes-2018.07.01"], ",") != "three" {
+		t.Fatalf("TestElasticsearchLogger got indexes %v", fake.indexed)
+	}
+
+	// logs are still sent if the cluster won't take the template
+	l = NewElasticsearchLogger(AppInfo{Name: "test"}, ElasticsearchConfig{URL: server.URL, Index: "denied", CreateTemplate: true,
+		Batch: BatchConfig{Interval: time.Hour}})
+	l.LOG(INFO, "", "untemplated", nil)
+	if err := l.Close(); err != nil || len(fake.indexed[l.IndexName(0)]) != 1 {
+		t.Fatalf("TestElasticsearchLogger expected the entry to be sent without the template, got %v and %v", err, fake.indexed)
+	}
+}
@@ -0,0 +1,200 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"fmt"
+	"time"
+)
+
+// FieldLogger is a child logger that adds a correlation id and fields to every entry, e.g. the
+// user and request a function is working on.  String fields go in the entry's Keys, anything
+// else (counts, durations, errors) in its Fields.
+type FieldLogger struct {
+	logger Logger
+	correlationId string
+	fields map[string]interface{}
+}
+
+// With returns a child of l that adds fields to every entry
+//
+// parameters:
+//	l : the logger to log through, or nil for whatever StdLogger is when each entry is logged
+//	fields : the fields to add, e.g. {"user": "dog", "attempt": 2}
+//
+// Returns:
+//	a pointer to the FieldLogger
+//
+// Example:
+//	log := logger.With(nil, map[string]interface{}{"hike": name}).WithCorrelationId(corrId)
+//	log.Infof("hike %s has %d reviews", name, len(reviews))
+//	log.Errorf("can't save review: %s", err)
+//
+func With(l Logger, fields map[string]interface{}) *FieldLogger {
+	f := new(FieldLogger)
+	f.logger = l
+	f.fields = make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		f.fields[k] = v
+	}
+	return f
+}
+
+// With returns a child of f with more fields, which replace f's if they have the same names
+func (f *FieldLogger) With(fields map[string]interface{}) *FieldLogger {
+	c := With(f.logger, f.fields)
+	c.correlationId = f.correlationId
+	for k, v := range fields {
+		c.fields[k] = v
+	}
+	return c
+}
+
+// WithCorrelationId returns a child of f that logs with the correlation id
+func (f *FieldLogger) WithCorrelationId(correlationid string) *FieldLogger {
+	c := f.With(nil)
+	c.correlationId = correlationid
+	return c
+}
+
+func (f *FieldLogger) target() Logger {
+	if f.logger == nil {
+		return StdLogger
+	}
+	return f.logger
+}
+
+// LOG logs with the child's fields and the given keys.  An empty correlationid uses the child's.
+func (f *FieldLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	if len(correlationid) == 0 {
+		correlationid = f.correlationId
+	}
+	entry := NewFieldEntry(level, correlationid, msg, f.fields)
+	if len(keys) > 0 {
+		if entry.Keys == nil {
+			entry.Keys = make(map[string]string, len(keys))
+		}
+		for k, v := range keys {
+			entry.Keys[k] = v
+		}
+	}
+	WriteEntry(f.target(), entry)
+}
+
+// WriteEntry adds the child's correlation id (if the entry has none) and fields to the entry
+func (f *FieldLogger) WriteEntry(entry LogEntry) {
+	if len(entry.CorrelationId) == 0 {
+		entry.CorrelationId = f.correlationId
+	}
+	child := NewFieldEntry(entry.Level, entry.CorrelationId, entry.Message, f.fields)
+	for k, v := range entry.Keys {
+		child.setField(k, v)
+	}
+	for k, v := range entry.Fields {
+		child.setField(k, v)
+	}
+	child.Timestamp = entry.Timestamp
+	WriteEntry(f.target(), child)
+}
+
+func (f *FieldLogger) StdOutOn(alsoToStdOut bool) {
+	f.target().StdOutOn(alsoToStdOut)
+}
+
+func (f *FieldLogger) Enabled(level LogLevel, component string) bool {
+	if c, ok := f.fields[ComponentKey].(string); ok && len(component) == 0 {
+		component = c
+	}
+	return Enabled(f.target(), level, component)
+}
+
+// Log logs msg with the child's fields and more
+func (f *FieldLogger) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	if len(fields) == 0 {
+		f.LOG(level, "", msg, nil)
+	} else {
+		f.With(fields).LOG(level, "", msg, nil)
+	}
+}
+
+// Logf formats the message with fmt.Sprintf, if the level is enabled
+func (f *FieldLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	if f.Enabled(level, "") {
+		f.LOG(level, "", fmt.Sprintf(format, args...), nil)
+	}
+}
+
+func (f *FieldLogger) Tracef(format string, args ...interface{}) { f.Logf(TRACE, format, args...) }
+func (f *FieldLogger) Debugf(format string, args ...interface{}) { f.Logf(DEBUG, format, args...) }
+func (f *FieldLogger) Infof(format string, args ...interface{}) { f.Logf(INFO, format, args...) }
+func (f *FieldLogger) Warnf(format string, args ...interface{}) { f.Logf(WARN, format, args...) }
+func (f *FieldLogger) Errorf(format string, args ...interface{}) { f.Logf(ERROR, format, args...) }
+func (f *FieldLogger) Criticalf(format string, args ...interface{}) { f.Logf(CRITICAL, format, args...) }
+
+// these log to StdLogger, with no correlation id or keys
+//
+// Example:
+//	logger.Errorf("Can't connect to db: %s", err)
+//
+func Tracef(format string, args ...interface{}) { With(nil, nil).Logf(TRACE, format, args...) }
+func Debugf(format string, args ...interface{}) { With(nil, nil).Logf(DEBUG, format, args...) }
+func Infof(format string, args ...interface{}) { With(nil, nil).Logf(INFO, format, args...) }
+func Warnf(format string, args ...interface{}) { With(nil, nil).Logf(WARN, format, args...) }
+func Errorf(format string, args ...interface{}) { With(nil, nil).Logf(ERROR, format, args...) }
+func Criticalf(format string, args ...interface{}) { With(nil, nil).Logf(CRITICAL, format, args...) }
+
+// NewFieldEntry creates an entry timestamped now, with string fields in Keys and the rest in
+// Fields.  The App is left for the logger to fill in.
+func NewFieldEntry(level LogLevel, correlationid string, msg string, fields map[string]interface{}) LogEntry {
+	entry := NewLogEntry(AppInfo{}, level, correlationid, msg, nil)
+	for k, v := range fields {
+		entry.setField(k, v)
+	}
+	return entry
+}
+
+// setField adds a field to Keys if it's a string, or Fields as something json can encode
+func (e *LogEntry) setField(name string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if e.Keys == nil {
+			e.Keys = make(map[string]string)
+		}
+		e.Keys[name] = v
+		delete(e.Fields, name)
+		return
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	case time.Time:
+		// json encodes it as RFC 3339
+	case fmt.Stringer:
+		value = v.String()
+	}
+	if e.Fields == nil {
+		e.Fields = make(map[string]interface{})
+	}
+	e.Fields[name] = value
+	delete(e.Keys, name)
+}
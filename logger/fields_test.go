@@ -0,0 +1,62 @@
+package logger
+
+import (
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"log/slog"
+	"encoding/json"
+)
+
+// child loggers carry their correlation id and fields, and non-string fields keep their type in json
+func TestFieldLogger(t *testing.T) {
+	var out bytes.Buffer
+	console := NewConsoleLogger(AppInfo{Name: "test"}, &out, true)
+	log := With(NewLevelFilter(console, INFO), map[string]interface{}{"hike": "tiger", "attempt": 2}).WithCorrelationId("c1")
+	log.Debugf("not logged %d", 1)
+	log.With(map[string]interface{}{"took": 1500 * time.Millisecond, "err": errors.New("timeout")}).Warnf("save of %s failed", "tiger")
+
+	var entry LogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("TestFieldLogger expected one json entry, got %q", out.String())
+	}
+	if entry.Message != "save of tiger failed" || entry.CorrelationId != "c1" || entry.Keys["hike"] != "tiger" || entry.App.Name != "test" {
+		t.Fatalf("TestFieldLogger got %+v", entry)
+	}
+	if entry.Fields["attempt"] != float64(2) || entry.Fields["took"] != "1.5s" || entry.Fields["err"] != "timeout" {
+		t.Fatalf("TestFieldLogger got fields %+v", entry.Fields)
+	}
+
+	// loggers that only take strings get the fields as keys
+	rec := NewRecordingLogger()
+	WriteEntry(&componentLogger{logger: struct{ Logger }{rec}, component: "db"}, entry)
+	if keys := rec.Entries()[0].Keys; keys["attempt"] != "2" || keys[ComponentKey] != "db" {
+		t.Fatalf("TestFieldLogger expected fields as keys, got %+v", keys)
+	}
+}
+
+// slog records go to a Logger, and Logger entries go to a slog handler
+func TestSlog(t *testing.T) {
+	rec := NewRecordingLogger()
+	s := slog.New(NewSlogHandler(NewLevelFilter(rec, INFO))).With(CorrelationIdKey, "c2")
+	s.WithGroup("req").Info("handled", "method", "GET", "status", 200)
+	s.Debug("not logged")
+	entries := rec.Entries()
+	if len(entries) != 1 || entries[0].CorrelationId != "c2" || entries[0].Keys["req.method"] != "GET" || entries[0].Fields["req.status"] != int64(200) {
+		t.Fatalf("TestSlog expected one INFO entry from slog, got %+v", entries)
+	}
+
+	var out bytes.Buffer
+	l := NewSlogLogger(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	l.LOG(INFO, "", "not logged", nil)
+	With(l, map[string]interface{}{"count": 3}).WithCorrelationId("c3").Errorf("cache %s down", "hikes")
+	line := out.String()
+	if !strings.Contains(line, `level=ERROR msg="cache hikes down" correlation_id=c3 count=3`) || strings.Contains(line, "not logged") {
+		t.Fatalf("TestSlog got %q", line)
+	}
+	if SlogLevel(CRITICAL) <= slog.LevelError || LevelFromSlog(SlogLevel(TRACE)) != TRACE {
+		t.Fatalf("TestSlog levels don't round trip")
+	}
+}
@@ -0,0 +1,215 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"strings"
+	"path/filepath"
+	"encoding/json"
+)
+
+// rotatedLayout is the timestamp added to rotated file names
+const rotatedLayout = "2006-01-02T15-04-05.000"
+
+// RotatingFileLogger writes json entries to a file, one per line.  When the file reaches MaxSize it
+// is renamed with a timestamp and a new one started, and old files beyond MaxBackups or MaxAge are
+// deleted.
+type RotatingFileLogger struct {
+	Path string
+	MaxSize int64				// bytes before the file is rotated, default 100MB
+	MaxAge time.Duration		// rotated files older than this are deleted, 0 to keep them
+	MaxBackups int				// the most rotated files to keep, 0 to keep them all
+	AlsoToStdout bool			// if true, also outputs to stdout with fmt.Println
+	App AppInfo
+
+	mu sync.Mutex
+	file *os.File
+	size int64
+	lastErr error
+	closed bool
+}
+
+// NewRotatingFileLogger opens (or creates) the log file, creating its directory if needed
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	path : the log file, e.g. "logs/webbertut.log".  Rotated files are named like "logs/webbertut-2018-06-01T17-04-05.000.log"
+//	maxSize : bytes before the file is rotated, 0 for the default of 100MB
+//	maxAge : how long to keep rotated files, 0 to keep them
+//	maxBackups : how many rotated files to keep, 0 to keep them all
+//
+// Returns:
+//	a pointer to a RotatingFileLogger struct, or an error if the file can't be opened
+//
+func NewRotatingFileLogger(app AppInfo, path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFileLogger, error) {
+	l := new(RotatingFileLogger)
+	l.Path = path
+	l.MaxSize = maxSize
+	if l.MaxSize <= 0 {
+		l.MaxSize = 100 * 1024 * 1024
+	}
+	l.MaxAge = maxAge
+	l.MaxBackups = maxBackups
+	l.App = app
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file for appending.  l.mu must be held (or l not yet shared).
+func (l *RotatingFileLogger) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+func (l *RotatingFileLogger) StdOutOn(alsoToStdOut bool) {
+	l.AlsoToStdout = alsoToStdOut
+}
+
+func (l *RotatingFileLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(l.App, level, correlationid, msg, keys))
+}
+
+// WriteEntry writes the entry, as from the logger's App
+func (l *RotatingFileLogger) WriteEntry(entry LogEntry) {
+	entry.App = l.App
+	data, _ := json.Marshal(entry)
+	data = append(data, '\n')
+	if l.AlsoToStdout {
+		fmt.Println(entry.Text())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if l.file != nil && l.size > 0 && l.size + int64(len(data)) > l.MaxSize {
+		l.lastErr = l.rotate()
+	}
+	if l.file == nil {
+		// a rotate failed to reopen the file, try again
+		if l.lastErr = l.open(); l.lastErr != nil {
+			fmt.Println("Failed to open log file: ", l.lastErr)
+			return
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	l.lastErr = err
+	if err != nil {
+		fmt.Println("Failed to write log file: ", err)
+	}
+}
+
+// Rotate starts a new file now, whatever the size of the current one
+func (l *RotatingFileLogger) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rotate()
+}
+
+// rotate renames the current file and opens a new one.  l.mu must be held.
+func (l *RotatingFileLogger) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	ext := filepath.Ext(l.Path)
+	base := strings.TrimSuffix(l.Path, ext)
+	backup := base + "-" + time.Now().UTC().Format(rotatedLayout) + ext
+	if err := os.Rename(l.Path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l.removeOld(base, ext)
+	return l.open()
+}
+
+// removeOld deletes the rotated files beyond MaxBackups or older than MaxAge
+func (l *RotatingFileLogger) removeOld(base string, ext string) {
+	if l.MaxBackups <= 0 && l.MaxAge <= 0 {
+		return
+	}
+	var backups []string
+	matches, _ := filepath.Glob(base + "-*" + ext)
+	for _, m := range matches {
+		// skip other files that happen to match, like app-access.log
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, base + "-"), ext)
+		if _, err := time.Parse(rotatedLayout, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// the timestamps sort by name, newest last
+	sort.Strings(backups)
+	cutoff := time.Now().Add(-l.MaxAge)
+	for i, b := range backups {
+		remove := l.MaxBackups > 0 && i < len(backups) - l.MaxBackups
+		if !remove && l.MaxAge > 0 {
+			if info, err := os.Stat(b); err == nil && info.ModTime().Before(cutoff) {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(b)
+		}
+	}
+}
+
+// Close closes the log file.  Nothing more is logged after it.
+func (l *RotatingFileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Status returns the error from the last write or rotation, or nil if it worked
+func (l *RotatingFileLogger) Status() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastErr
+}
@@ -24,20 +24,32 @@ package logger
 
 import (
 	"fmt"
-	"time"
 	"encoding/json"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
 )
 
+// firehoseMaxRecordBytes is PutRecordBatch's limit on a record, before base64 encoding
+const firehoseMaxRecordBytes = 1000 * 1024
 
+// FirehoseAPI is the part of the firehose client the logger uses, so tests can supply a fake
+type FirehoseAPI interface {
+	ListDeliveryStreams(*firehose.ListDeliveryStreamsInput) (*firehose.ListDeliveryStreamsOutput, error)
+	PutRecordBatch(*firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+}
+
+// FirehoseLogger buffers entries and sends them to a firehose delivery stream in batches from a
+// background goroutine, so LOG doesn't wait for the network.  Call Close at shutdown to send
+// what's left.
 type FirehoseLogger struct {
 	AWSSession *session.Session
-	FirehoseClient *firehose.Firehose
+	FirehoseClient FirehoseAPI
 	DeliveryStreamName string
 	AlsoToStdout bool  // if true, also outputs to stdout with fmt.Println
 	App AppInfo
+
+	batches *batcher
 }
 
 
@@ -58,13 +70,26 @@ type FirehoseLogger struct {
 //	a pointer to an FirehoseLogger struct
 //
 func NewFirehoseLogger(app AppInfo, region string, profileName string, deliveryStreamName string) *FirehoseLogger {
-	fmt.Println("FireHoseLogger creating new AWS Session for region ", region, " and profile ", profileName)
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Profile: profileName, 
-		Config: aws.Config{Region: aws.String(region)},
-	}))
-	return NewFirehoseLoggerFromSession(app, sess, deliveryStreamName)
+	return NewFirehoseLoggerWithConfig(app, region, profileName, deliveryStreamName, DefaultBatchConfig())
+}
 
+// NewFirehoseLoggerWithConfig is NewFirehoseLogger with batch settings, e.g. a SpillDir
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	region : the AWS region to create everything in.  
+//	profileName : The profile stored in ~/.aws/credentials that provides the creds for accessing AWS
+//	deliveryStream : The name of the firehose delivery stream to use for the log
+//	config : the batch settings
+//
+// Returns:
+//	a pointer to an FirehoseLogger struct
+//
+func NewFirehoseLoggerWithConfig(app AppInfo, region string, profileName string, deliveryStreamName string, config BatchConfig) *FirehoseLogger {
+	sess := newAWSSession(region, profileName, "")
+	f := NewFirehoseLoggerWithClient(app, firehose.New(sess), deliveryStreamName, config)
+	f.AWSSession = sess
+	return f
 }
 
 // NewFirehoseLoggerFromSession uses an existing AWSSession and creates a Kinesis Firehose Client.
@@ -83,16 +108,34 @@ func NewFirehoseLogger(app AppInfo, region string, profileName string, deliveryS
 //
 func NewFirehoseLoggerFromSession(app AppInfo, sess *session.Session, deliveryStreamName string) *FirehoseLogger {
 	fmt.Println("NewAWSLogger being created for region ", *(sess.Config.Region), " on deliverystream ", deliveryStreamName)
-	f := new(FirehoseLogger)
+	f := NewFirehoseLoggerWithClient(app, firehose.New(sess), deliveryStreamName, DefaultBatchConfig())
 	f.AWSSession = sess
-	f.FirehoseClient = firehose.New(f.AWSSession)
+	return f
+}
+
+// NewFirehoseLoggerWithClient creates a FirehoseLogger that sends with client, batching as config
+// says.  Use it to set the batch size, interval and spill directory, or to test with a fake client.
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	client : the firehose client, e.g. firehose.New(sess)
+//	deliveryStream : The name of the firehose delivery stream to use for the log
+//	config : the batch settings, e.g. DefaultBatchConfig() with a SpillDir
+//
+// Returns:
+//	a pointer to an FirehoseLogger struct
+//
+func NewFirehoseLoggerWithClient(app AppInfo, client FirehoseAPI, deliveryStreamName string, config BatchConfig) *FirehoseLogger {
+	f := new(FirehoseLogger)
+	f.FirehoseClient = client
 	f.DeliveryStreamName = deliveryStreamName
 	f.AlsoToStdout = false
 	f.App = app
+	f.batches = newBatcher("firehose-" + deliveryStreamName, config.withRecordLimit(firehoseMaxRecordBytes), f.sendBatch)
 
 	// check for existing delivery streams.  
 	dl, err := f.FirehoseClient.ListDeliveryStreams(nil)
-	if ( err == nil ) {
+	if ( err == nil && dl != nil ) {
 		// look for the stream we're supposed to use:
 		for _, n := range dl.DeliveryStreamNames {
 			if *n == deliveryStreamName {
@@ -116,26 +159,66 @@ func (l *FirehoseLogger) StdOutOn(alsoToStdOut bool) {
 	l.AlsoToStdout = alsoToStdOut
 }
 
+// LOG queues the entry to be sent with the next batch
 func (l *FirehoseLogger) LOG (level LogLevel, correlationid string, msg string, keys map[string]string ) {
+	l.WriteEntry(NewLogEntry(l.App, level, correlationid, msg, keys))
+}
 
-	entry := LogEntry{Level: level, Timestamp:time.Now().UnixNano()/1000000, CorrelationId:correlationid, Message:msg, App:l.App, Keys:keys}
+// WriteEntry queues the entry, as from the logger's App
+func (l *FirehoseLogger) WriteEntry(entry LogEntry) {
+	entry.App = l.App
 	data, _ := json.Marshal(entry)
-
-	var r firehose.Record
-	r.SetData([]byte(data))
-
-	var p firehose.PutRecordInput
-	p.SetDeliveryStreamName(l.DeliveryStreamName)
-	p.SetRecord(&r)
-
-	_, err := l.FirehoseClient.PutRecord(&p)
 	if ( l.AlsoToStdout) {
 		fmt.Println(entry)
 	}
+	l.batches.add(data)
+}
 
-	if ( err != nil ) {
-		// what do we do now?  Log an error ha ha?
-		fmt.Println("Failed to PutRecord to firehose client: ", err)
+// sendBatch puts a batch of records, returning the indexes of any firehose rejected
+func (l *FirehoseLogger) sendBatch(records [][]byte) ([]int, error) {
+	recs := make([]*firehose.Record, len(records))
+	for i, data := range records {
+		recs[i] = new(firehose.Record).SetData(data)
 	}
+	var p firehose.PutRecordBatchInput
+	p.SetDeliveryStreamName(l.DeliveryStreamName)
+	p.SetRecords(recs)
 
-}
\ No newline at end of file
+	out, err := l.FirehoseClient.PutRecordBatch(&p)
+	if err != nil {
+		return nil, err
+	}
+	var failed []int
+	if out != nil && aws.Int64Value(out.FailedPutCount) > 0 {
+		for i, r := range out.RequestResponses {
+			if r != nil && r.ErrorCode != nil {
+				failed = append(failed, i)
+			}
+		}
+	}
+	return failed, nil
+}
+
+// Flush sends everything buffered now, returning an error if any of it couldn't be sent (it stays
+// buffered to be retried)
+func (l *FirehoseLogger) Flush() error {
+	return l.batches.flush()
+}
+
+// Close sends everything buffered and stops the background sender.  Anything that still can't be
+// sent is spilled to disk, if there's a SpillDir.  Entries logged after Close are dropped.
+func (l *FirehoseLogger) Close() error {
+	return l.batches.close()
+}
+
+// Stats returns counts of the entries sent, retried, spilled and dropped
+func (l *FirehoseLogger) Stats() BatchStats {
+	return l.batches.getStats()
+}
+
+// Status returns the error from the most recent attempt to send logs to firehose, or nil if it
+// worked (or nothing has been sent yet).  Health checks use this to report a logger that can't
+// deliver logs.
+func (l *FirehoseLogger) Status() error {
+	return l.batches.status()
+}
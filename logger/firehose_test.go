@@ -0,0 +1,209 @@
+package logger
+
+import (
+	"sync"
+	"time"
+	"errors"
+	"testing"
+	"path/filepath"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+)
+
+// fakeFirehose records the entries it's sent.  It can fail every call, or reject the first record
+// of the next batch.
+type fakeFirehose struct {
+	mu sync.Mutex
+	down bool
+	rejectNext bool
+	batches int
+	msgs []string
+}
+
+func (f *fakeFirehose) ListDeliveryStreams(*firehose.ListDeliveryStreamsInput) (*firehose.ListDeliveryStreamsOutput, error) {
+	return &firehose.ListDeliveryStreamsOutput{DeliveryStreamNames: []*string{aws.String("logs")}}, nil
+}
+
+func (f *fakeFirehose) PutRecordBatch(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return nil, errors.New("service unavailable")
+	}
+	f.batches++
+	out := new(firehose.PutRecordBatchOutput)
+	for i, r := range in.Records {
+		entry := new(firehose.PutRecordBatchResponseEntry)
+		if i == 0 && f.rejectNext {
+			f.rejectNext = false
+			entry.ErrorCode = aws.String("ServiceUnavailableException")
+			out.FailedPutCount = aws.Int64(1)
+		} else {
+			var e LogEntry
+			json.Unmarshal(r.Data, &e)
+			f.msgs = append(f.msgs, e.Message)
+		}
+		out.RequestResponses = append(out.RequestResponses, entry)
+	}
+	return out, nil
+}
+
+func (f *fakeFirehose) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.msgs...)
+}
+
+// entries go in batches of MaxRecords, and records firehose rejects are sent again
+func TestFirehoseBatches(t *testing.T) {
+	fake := &fakeFirehose{rejectNext: true}
+	l := NewFirehoseLoggerWithClient(AppInfo{Name: "test"}, fake, "logs", BatchConfig{MaxRecords: 10, Interval: time.Hour})
+	for i := 0; i < 25; i++ {
+		l.LOG(INFO, "", "entry", nil)
+	}
+	if err := l.Flush(); err == nil {
+		t.Fatalf("TestFirehoseBatches expected the rejected record to be reported")
+	}
+	if l.Status() == nil {
+		t.Fatalf("TestFirehoseBatches expected Status to report the failure")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("TestFirehoseBatches Close failed: %s", err)
+	}
+	stats := l.Stats()
+	if len(fake.sent()) != 25 || stats.Sent != 25 || stats.Retried != 1 || stats.Buffered != 0 || fake.batches < 3 {
+		t.Fatalf("TestFirehoseBatches got %d sent in %d batches, stats %+v", len(fake.sent()), fake.batches, stats)
+	}
+	if l.Status() != nil {
+		t.Fatalf("TestFirehoseBatches expected Status to clear once sends work, got %s", l.Status())
+	}
+}
+
+// while firehose is down entries are spilled on Close, and the next logger with the same SpillDir sends them
+func TestFirehoseSpill(t *testing.T) {
+	dir := t.TempDir()
+	config := BatchConfig{Interval: time.Hour, SpillDir: dir}
+	down := &fakeFirehose{down: true}
+	l := NewFirehoseLoggerWithClient(AppInfo{Name: "test"}, down, "logs", config)
+	l.LOG(ERROR, "", "first", nil)
+	l.LOG(ERROR, "", "second", nil)
+	if err := l.Close(); err == nil {
+		t.Fatalf("TestFirehoseSpill expected Close to fail while firehose is down")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spill"))
+	if len(files) != 1 || l.Stats().Spilled != 2 {
+		t.Fatalf("TestFirehoseSpill expected 1 spill file with 2 entries, got %v and %+v", files, l.Stats())
+	}
+	l.LOG(ERROR, "", "after close", nil)
+
+	up := new(fakeFirehose)
+	l = NewFirehoseLoggerWithClient(AppInfo{Name: "test"}, up, "logs", config)
+	l.LOG(INFO, "", "third", nil)
+	l.Flush()
+	l.Flush()
+	l.Close()
+	sent := up.sent()
+	if len(sent) != 3 || sent[1] != "first" || sent[2] != "second" {
+		t.Fatalf("TestFirehoseSpill expected the spilled entries to be sent, got %v", sent)
+	}
+	if files, _ = filepath.Glob(filepath.Join(dir, "*.spill")); len(files) != 0 {
+		t.Fatalf("TestFirehoseSpill expected the spill file to be removed, got %v", files)
+	}
+}
+
+// a record the destination always rejects is spilled, replayed once, then dropped rather than spilled again
+func TestBatcherDropsRejected(t *testing.T) {
+	dir := t.TempDir()
+	b := newBatcher("rejects", BatchConfig{Interval: time.Hour, MaxAttempts: 2, SpillDir: dir}, func(records [][]byte) ([]int, error) {
+		var failed []int
+		for i, r := range records {
+			if string(r) == "bad" {
+				failed = append(failed, i)
+			}
+		}
+		return failed, nil
+	})
+	defer b.close()
+	b.add([]byte("bad"))
+	b.flush()
+	b.flush()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.spill")); len(files) != 1 {
+		t.Fatalf("TestBatcherDropsRejected expected the record to be spilled, got %v", files)
+	}
+	// a good send lets the spill file be replayed
+	b.add([]byte("good"))
+	b.flush()
+	if stats := b.getStats(); stats.Buffered != 1 {
+		t.Fatalf("TestBatcherDropsRejected expected the record to be replayed, got %+v", stats)
+	}
+	b.flush()
+	b.flush()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spill"))
+	if stats := b.getStats(); len(files) != 0 || stats.Dropped != 1 || stats.Spilled != 1 || stats.Buffered != 0 {
+		t.Fatalf("TestBatcherDropsRejected expected the record to be dropped, got %v and %+v", files, stats)
+	}
+}
+
+// an entry over the destination's record limit is dropped, so it doesn't fail the batch it's sent with
+func TestBatcherDropsOversized(t *testing.T) {
+	var sent int
+	b := newBatcher("oversized", BatchConfig{Interval: time.Hour, MaxRecordBytes: 10}, func(records [][]byte) ([]int, error) {
+		for _, r := range records {
+			if len(r) > 10 {
+				return nil, errors.New("record too large")
+			}
+		}
+		sent += len(records)
+		return nil, nil
+	})
+	defer b.close()
+	b.add([]byte("one"))
+	b.add([]byte("much too long for the limit"))
+	b.add([]byte("two"))
+	if err := b.flush(); err != nil || sent != 2 {
+		t.Fatalf("TestBatcherDropsOversized expected the other entries to be sent, got %d and %v", sent, err)
+	}
+	if stats := b.getStats(); stats.Dropped != 1 || stats.Sent != 2 {
+		t.Fatalf("TestBatcherDropsOversized unexpected stats %+v", stats)
+	}
+}
+
+// once the backoff has passed, spilled entries are replayed and sent without anything new being logged
+func TestBatcherReplaysAfterOutage(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	down := true
+	var sent int
+	b := newBatcher("outage", BatchConfig{Interval: 20 * time.Millisecond, MaxAttempts: 1, SpillDir: dir}, func(records [][]byte) ([]int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			return nil, errors.New("service unavailable")
+		}
+		sent += len(records)
+		return nil, nil
+	})
+	defer b.close()
+	b.add([]byte("a"))
+	b.add([]byte("b"))
+	b.flush()
+	if stats := b.getStats(); stats.Spilled != 2 || stats.Buffered != 0 {
+		t.Fatalf("TestBatcherReplaysAfterOutage expected the entries to be spilled, got %+v", stats)
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats := b.getStats(); stats.Sent == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spill"))
+	if stats := b.getStats(); stats.Sent != 2 || len(files) != 0 || b.status() != nil {
+		t.Fatalf("TestBatcherReplaysAfterOutage expected the spilled entries to be sent, got %v, %v and %+v", b.status(), files, stats)
+	}
+}
@@ -0,0 +1,185 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"fmt"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// PutRecords limits: the longest partition key, at most 1MB per record, and at most 500 records
+// and 5MB, counting the partition keys, per call
+const (
+	kinesisMaxPartitionKey = 256
+	kinesisMaxRecordBytes = 1024 * 1024 - kinesisMaxPartitionKey
+	kinesisMaxRecords = 500
+	kinesisMaxBytes = 5 * 1024 * 1024 - kinesisMaxRecords * kinesisMaxPartitionKey
+)
+
+// KinesisAPI is the part of the Kinesis client the logger uses, so tests can supply a fake
+type KinesisAPI interface {
+	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+// KinesisConfig says where a KinesisLogger writes
+type KinesisConfig struct {
+	Stream string			// the Kinesis data stream
+	Endpoint string			// the Kinesis endpoint, e.g. "http://localhost:4566" for a local stand in, or "" for AWS's
+	Batch BatchConfig		// batch settings.  Limited to PutRecords' 500 records and 5MB
+}
+
+// KinesisLogger sends entries to a Kinesis data stream in batches from a background goroutine, as
+// FirehoseLogger does.  Entries are partitioned by correlation id, so the entries for a request
+// stay in order on one shard.  Call Close at shutdown to send what's left.
+type KinesisLogger struct {
+	AWSSession *session.Session
+	Client KinesisAPI
+	Stream string
+	AlsoToStdout bool
+	App AppInfo
+
+	batches *batcher
+}
+
+// NewKinesisLogger creates an AWS session and a Kinesis client, and a logger that uses them
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	region : the AWS region the stream is in
+//	profileName : the profile stored in ~/.aws/credentials that provides the creds for accessing AWS
+//	config : the stream to write to
+//
+// Returns:
+//	a pointer to the KinesisLogger
+//
+func NewKinesisLogger(app AppInfo, region string, profileName string, config KinesisConfig) *KinesisLogger {
+	sess := newAWSSession(region, profileName, config.Endpoint)
+	l := NewKinesisLoggerWithClient(app, kinesis.New(sess), config)
+	l.AWSSession = sess
+	return l
+}
+
+// NewKinesisLoggerWithClient creates a KinesisLogger that sends with client.  The stream must
+// already exist.
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	client : the Kinesis client, e.g. kinesis.New(sess)
+//	config : the stream to write to
+//
+// Returns:
+//	a pointer to the KinesisLogger
+//
+func NewKinesisLoggerWithClient(app AppInfo, client KinesisAPI, config KinesisConfig) *KinesisLogger {
+	l := new(KinesisLogger)
+	l.Client = client
+	l.Stream = config.Stream
+	l.App = app
+
+	batch := config.Batch.withDefaults()
+	if batch.MaxBytes > kinesisMaxBytes {
+		batch.MaxBytes = kinesisMaxBytes
+	}
+	if batch.MaxRecords > kinesisMaxRecords {
+		batch.MaxRecords = kinesisMaxRecords
+	}
+	batch = batch.withRecordLimit(kinesisMaxRecordBytes)
+	l.batches = newBatcher("kinesis-" + config.Stream, batch, l.sendBatch)
+	return l
+}
+
+func (l *KinesisLogger) StdOutOn(alsoToStdOut bool) {
+	l.AlsoToStdout = alsoToStdOut
+}
+
+// LOG queues the entry to be sent with the next batch
+func (l *KinesisLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(l.App, level, correlationid, msg, keys))
+}
+
+// WriteEntry queues the entry, as from the logger's App
+func (l *KinesisLogger) WriteEntry(entry LogEntry) {
+	entry.App = l.App
+	data, _ := json.Marshal(entry)
+	if l.AlsoToStdout {
+		fmt.Println(entry.Text())
+	}
+	l.batches.add(data)
+}
+
+// partitionKey returns the entry's correlation id, or a random key for entries without one
+func partitionKey(data []byte) string {
+	key := readRecordInfo(data).CorrelationId
+	if len(key) == 0 {
+		key = GenerateCorrelationId()
+	}
+	if len(key) > kinesisMaxPartitionKey {
+		key = key[:kinesisMaxPartitionKey]
+	}
+	return key
+}
+
+// sendBatch puts a batch of records, returning the indexes of any Kinesis rejected
+func (l *KinesisLogger) sendBatch(records [][]byte) ([]int, error) {
+	entries := make([]*kinesis.PutRecordsRequestEntry, len(records))
+	for i, data := range records {
+		entries[i] = &kinesis.PutRecordsRequestEntry{Data: data, PartitionKey: aws.String(partitionKey(data))}
+	}
+	out, err := l.Client.PutRecords(&kinesis.PutRecordsInput{StreamName: aws.String(l.Stream), Records: entries})
+	if err != nil {
+		return nil, err
+	}
+	var failed []int
+	if out != nil && aws.Int64Value(out.FailedRecordCount) > 0 {
+		for i, r := range out.Records {
+			if r != nil && r.ErrorCode != nil {
+				failed = append(failed, i)
+			}
+		}
+	}
+	return failed, nil
+}
+
+// Flush sends everything buffered now, returning an error if any of it couldn't be sent
+func (l *KinesisLogger) Flush() error {
+	return l.batches.flush()
+}
+
+// Close sends everything buffered and stops the background sender.  Anything that still can't be
+// sent is spilled to disk, if there's a SpillDir.
+func (l *KinesisLogger) Close() error {
+	return l.batches.close()
+}
+
+// Stats returns counts of the entries sent, retried, spilled and dropped
+func (l *KinesisLogger) Stats() BatchStats {
+	return l.batches.getStats()
+}
+
+// Status returns the error from the most recent attempt to send logs, or nil if it worked
+func (l *KinesisLogger) Status() error {
+	return l.batches.status()
+}
@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"sync"
+	"time"
+	"testing"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// fakeKinesis throttles the first record of its first batch
+type fakeKinesis struct {
+	mu sync.Mutex
+	calls int
+	keys []string
+	largest int
+}
+
+func (f *fakeKinesis) PutRecords(in *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(in.Records) > f.largest {
+		f.largest = len(in.Records)
+	}
+	out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for i, r := range in.Records {
+		if f.calls == 1 && i == 0 {
+			out.FailedRecordCount = aws.Int64(1)
+			out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{ErrorCode: aws.String("ProvisionedThroughputExceededException")})
+			continue
+		}
+		f.keys = append(f.keys, aws.StringValue(r.PartitionKey))
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("1"), ShardId: aws.String("shardId-000000000000")})
+	}
+	return out, nil
+}
+
+// records are partitioned by correlation id, and throttled records are sent again
+func TestKinesisLogger(t *testing.T) {
+	fake := new(fakeKinesis)
+	l := NewKinesisLoggerWithClient(AppInfo{Name: "test"}, fake, KinesisConfig{Stream: "logs", Batch: BatchConfig{Interval: time.Hour}})
+	l.LOG(INFO, "req1", "one", nil)
+	l.LOG(INFO, "req2", "two", nil)
+	l.LOG(INFO, "", "three", nil)
+	if err := l.Flush(); err == nil {
+		t.Fatalf("TestKinesisLogger expected the throttled record to be reported")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("TestKinesisLogger Close failed: %s", err)
+	}
+	if len(fake.keys) != 3 || fake.keys[0] != "req2" || fake.keys[2] != "req1" || len(fake.keys[1]) == 0 || l.Stats().Retried != 1 {
+		t.Fatalf("TestKinesisLogger got partition keys %v and stats %+v", fake.keys, l.Stats())
+	}
+
+	// batches are kept within PutRecords' limit whatever the config says
+	fake = &fakeKinesis{calls: 1}
+	l = NewKinesisLoggerWithClient(AppInfo{Name: "test"}, fake, KinesisConfig{Stream: "logs", Batch: BatchConfig{MaxRecords: 1000, Interval: time.Hour}})
+	for i := 0; i < 600; i++ {
+		l.LOG(INFO, "", "entry", nil)
+	}
+	if err := l.Close(); err != nil || fake.largest != kinesisMaxRecords || len(fake.keys) != 600 {
+		t.Fatalf("TestKinesisLogger expected batches of at most %d, got %d and %v", kinesisMaxRecords, fake.largest, err)
+	}
+}
@@ -0,0 +1,230 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"sort"
+	"sync"
+)
+
+// ComponentKey is the key that names the component (package, handler, etc.) an entry comes from.
+// LevelFilter can have a different minimum level for each component.
+const ComponentKey = "component"
+
+// LevelFilter passes entries at or above its minimum level to another logger.  Components can
+// have their own minimum, e.g. DEBUG for the one being investigated.  Levels can be changed while
+// the program is running.
+type LevelFilter struct {
+	Logger Logger			// where entries that pass go
+
+	mu sync.RWMutex
+	level LogLevel
+	components map[string]LogLevel
+}
+
+// NewLevelFilter creates a LevelFilter
+//
+// parameters:
+//	l : the logger to pass entries to
+//	min : the least severe level passed, e.g. INFO
+//
+// Returns:
+//	a pointer to the LevelFilter
+//
+// Example:
+//	f := logger.NewLevelFilter(multi, logger.INFO)
+//	f.SetComponentLevel("HikeServer", logger.DEBUG)
+//	logger.StdLogger = f
+//
+func NewLevelFilter(l Logger, min LogLevel) *LevelFilter {
+	f := new(LevelFilter)
+	f.Logger = l
+	f.level = min
+	f.components = make(map[string]LogLevel)
+	return f
+}
+
+// Level returns the minimum level for components without their own
+func (f *LevelFilter) Level() LogLevel {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.level
+}
+
+// SetLevel sets the minimum level for components without their own
+func (f *LevelFilter) SetLevel(min LogLevel) {
+	f.mu.Lock()
+	f.level = min
+	f.mu.Unlock()
+}
+
+// SetComponentLevel sets the minimum level for entries whose ComponentKey is component
+func (f *LevelFilter) SetComponentLevel(component string, min LogLevel) {
+	f.mu.Lock()
+	f.components[component] = min
+	f.mu.Unlock()
+}
+
+// ClearComponentLevel removes the component's own level, so it uses Level again
+func (f *LevelFilter) ClearComponentLevel(component string) {
+	f.mu.Lock()
+	delete(f.components, component)
+	f.mu.Unlock()
+}
+
+// ComponentLevels returns a copy of the components' levels
+func (f *LevelFilter) ComponentLevels() map[string]LogLevel {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	levels := make(map[string]LogLevel, len(f.components))
+	for c, l := range f.components {
+		levels[c] = l
+	}
+	return levels
+}
+
+// Components returns the names of the components with their own level, sorted
+func (f *LevelFilter) Components() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	names := make([]string, 0, len(f.components))
+	for c := range f.components {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enabled returns true if an entry at level from component ("" for none) would be passed on
+func (f *LevelFilter) Enabled(level LogLevel, component string) bool {
+	f.mu.RLock()
+	min, ok := f.components[component]
+	if !ok || len(component) == 0 {
+		min = f.level
+	}
+	f.mu.RUnlock()
+	return level.Enabled(min)
+}
+
+func (f *LevelFilter) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	if f.Enabled(level, keys[ComponentKey]) {
+		f.Logger.LOG(level, correlationid, msg, keys)
+	}
+}
+
+func (f *LevelFilter) WriteEntry(entry LogEntry) {
+	if f.Enabled(entry.Level, entry.Keys[ComponentKey]) {
+		WriteEntry(f.Logger, entry)
+	}
+}
+
+func (f *LevelFilter) StdOutOn(alsoToStdOut bool) {
+	f.Logger.StdOutOn(alsoToStdOut)
+}
+
+// Status returns the wrapped logger's status, if it has one
+func (f *LevelFilter) Status() error {
+	return statusOf(f.Logger)
+}
+
+// Close closes the wrapped logger
+func (f *LevelFilter) Close() error {
+	return CloseLogger(f.Logger)
+}
+
+// Enabled returns true if l would log an entry at level from component, so callers can skip
+// building expensive messages.  Loggers without an Enabled(LogLevel, string) bool method log
+// everything.
+//
+// Example:
+//	if logger.Enabled(logger.StdLogger, logger.DEBUG, "") {
+//		logger.StdLogger.LOG(logger.DEBUG, corrId, dumpRequest(r), nil)
+//	}
+//
+func Enabled(l Logger, level LogLevel, component string) bool {
+	if e, ok := l.(interface{ Enabled(LogLevel, string) bool }); ok {
+		return e.Enabled(level, component)
+	}
+	return true
+}
+
+// componentLogger adds its component to every entry
+type componentLogger struct {
+	logger Logger
+	component string
+}
+
+// Component returns a logger that adds ComponentKey with the component's name to every entry
+// logged through l, so a LevelFilter can filter them by component.
+//
+// parameters:
+//	l : the logger to log through, or nil for whatever StdLogger is when each entry is logged
+//	component : the component's name, e.g. "cache"
+//
+// Example:
+//	var cacheLog = logger.Component(nil, "cache")
+//	...
+//	cacheLog.LOG(logger.DEBUG, corrId, "cache miss", map[string]string{"key": key})
+//
+func Component(l Logger, component string) Logger {
+	return &componentLogger{logger: l, component: component}
+}
+
+func (c *componentLogger) target() Logger {
+	if c.logger == nil {
+		return StdLogger
+	}
+	return c.logger
+}
+
+func (c *componentLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	c.target().LOG(level, correlationid, msg, c.addComponent(keys))
+}
+
+func (c *componentLogger) WriteEntry(entry LogEntry) {
+	entry.Keys = c.addComponent(entry.Keys)
+	WriteEntry(c.target(), entry)
+}
+
+func (c *componentLogger) addComponent(keys map[string]string) map[string]string {
+	withComponent := make(map[string]string, len(keys) + 1)
+	for k, v := range keys {
+		withComponent[k] = v
+	}
+	withComponent[ComponentKey] = c.component
+	return withComponent
+}
+
+func (c *componentLogger) StdOutOn(alsoToStdOut bool) {
+	c.target().StdOutOn(alsoToStdOut)
+}
+
+// Enabled ignores component, using the logger's own
+func (c *componentLogger) Enabled(level LogLevel, component string) bool {
+	return Enabled(c.target(), level, c.component)
+}
+
+// Unwrap returns the wrapped logger
+func (f *LevelFilter) Unwrap() Logger {
+	return f.Logger
+}
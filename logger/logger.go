@@ -23,11 +23,20 @@
 package logger
 
 import (
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
 	"crypto/rand"
 	"encoding/hex"
 )
 
-var StdLogger Logger
+// StdLogger is the logger used by webber and the other goweb packages.  It writes to stdout until
+// the program sets it to something else, so it is never nil.
+var StdLogger Logger = NewLevelFilter(NewRedactingLogger(NewConsoleLogger(AppInfo{}, os.Stdout, false), DefaultRedactor()), INFO)
 
 // TODO
 // 
@@ -40,8 +49,27 @@ const (
 	ERROR = "ERROR"
 	WARN = "WARN"
 	INFO = "INFO"
+	DEBUG = "DEBUG"
+	TRACE = "TRACE"
 )
 
+// levelRanks orders the levels, least severe first
+var levelRanks = map[LogLevel]int{TRACE: 1, DEBUG: 2, INFO: 3, WARN: 4, ERROR: 5, CRITICAL: 6}
+
+// Enabled returns true if level is at least as severe as min, e.g. ERROR.Enabled(WARN) is true
+func (level LogLevel) Enabled(min LogLevel) bool {
+	return levelRanks[level] >= levelRanks[min]
+}
+
+// ParseLevel returns the LogLevel named by s (case insensitive), e.g. "warn"
+func ParseLevel(s string) (LogLevel, error) {
+	level := LogLevel(strings.ToUpper(strings.TrimSpace(s)))
+	if _, ok := levelRanks[level]; !ok {
+		return level, errors.New("unknown log level " + s)
+	}
+	return level, nil
+}
+
 // the AppInfo struct is used for providing information about the app/service that is doing
 // the logging. 
 type AppInfo struct {
@@ -64,6 +92,12 @@ type Logger interface {
 	StdOutOn(alsoToStdOut bool)
 }
 
+// EntryWriter is implemented by loggers that can write a whole LogEntry, keeping its Fields as
+// they are.  Loggers that can't get the fields as strings in Keys, see WriteEntry.
+type EntryWriter interface {
+	WriteEntry(entry LogEntry)
+}
+
 // this is the data that will be sent to the remote log collector
 type LogEntry struct {
 	Level LogLevel  `json:"level"`
@@ -72,12 +106,86 @@ type LogEntry struct {
 	App AppInfo `json:"appinfo"`			
 	Message string  `json:"message"`
 	Keys map[string]string `json:"keys"`
+	Fields map[string]interface{} `json:"fields,omitempty"`	// values that aren't strings, e.g. counts and durations
+}
+
+// NewLogEntry creates an entry timestamped now
+func NewLogEntry(app AppInfo, level LogLevel, correlationid string, msg string, keys map[string]string) LogEntry {
+	return LogEntry{Level: level, Timestamp: time.Now().UnixNano()/1000000, CorrelationId: correlationid, Message: msg, App: app, Keys: keys}
+}
+
+// AllKeys returns Keys with the Fields added as strings, for loggers that only handle strings
+func (e LogEntry) AllKeys() map[string]string {
+	if len(e.Fields) == 0 {
+		return e.Keys
+	}
+	keys := make(map[string]string, len(e.Keys) + len(e.Fields))
+	for k, v := range e.Keys {
+		keys[k] = v
+	}
+	for k, v := range e.Fields {
+		keys[k] = fmt.Sprint(v)
+	}
+	return keys
+}
+
+// Text formats the entry on one line for people to read, e.g.
+//	2018-06-01T17:04:05.123Z WARN [4f2a...] Rate limit exceeded client_ip=10.1.2.3
+func (e LogEntry) Text() string {
+	var b strings.Builder
+	b.WriteString(time.Unix(0, e.Timestamp * int64(time.Millisecond)).UTC().Format("2006-01-02T15:04:05.000Z"))
+	b.WriteString(" " + string(e.Level))
+	if len(e.CorrelationId) > 0 {
+		b.WriteString(" [" + e.CorrelationId + "]")
+	}
+	b.WriteString(" " + e.Message)
+	keys := e.AllKeys()
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		v := keys[k]
+		if len(v) == 0 || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(" " + k + "=" + v)
+	}
+	return b.String()
 }
 
 ///////////////////////////////////////////////////
 // Helper funcs
 //
 
+// WriteEntry writes entry to l, whole if l is an EntryWriter, otherwise through LOG with the
+// Fields added to Keys
+func WriteEntry(l Logger, entry LogEntry) {
+	if w, ok := l.(EntryWriter); ok {
+		w.WriteEntry(entry)
+	} else {
+		l.LOG(entry.Level, entry.CorrelationId, entry.Message, entry.AllKeys())
+	}
+}
+
+// statusOf returns l's status, if it has a Status() error method
+func statusOf(l Logger) error {
+	if st, ok := l.(interface{ Status() error }); ok {
+		return st.Status()
+	}
+	return nil
+}
+
+// CloseLogger flushes and closes l, if it buffers or holds files or connections (has a Close()
+// error method).  Call it on StdLogger at shutdown.
+func CloseLogger(l Logger) error {
+	if c, ok := l.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 // returns a randomly generated 16 digit hex value
 func GenerateCorrelationId() string {
 	u := make([]byte, 16)
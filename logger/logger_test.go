@@ -0,0 +1,118 @@
+package logger
+
+import (
+	"os"
+	"net"
+	"time"
+	"bytes"
+	"strings"
+	"testing"
+	"path/filepath"
+	"encoding/json"
+)
+
+// each sink in a MultiLogger only gets entries at or above its level, and StdLogger works without setup
+func TestMultiLogger(t *testing.T) {
+	StdLogger.LOG(INFO, "", "StdLogger is usable before it is set", nil)
+
+	all, errs := NewRecordingLogger(), NewRecordingLogger()
+	m := NewMultiLogger().Add(all, INFO).Add(errs, ERROR)
+	m.LOG(INFO, "c1", "starting", nil)
+	m.LOG(WARN, "c1", "slow", nil)
+	m.LOG(CRITICAL, "c1", "down", map[string]string{"db": "mongo"})
+	if len(all.Entries()) != 3 || len(errs.Entries()) != 1 || errs.Entries()[0].Keys["db"] != "mongo" {
+		t.Fatalf("TestMultiLogger expected 3 and 1 entries, got %d and %d", len(all.Entries()), len(errs.Entries()))
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatalf("TestMultiLogger expected an unknown level to fail")
+	}
+}
+
+// a LevelFilter drops entries below its level, or the component's own level
+func TestLevelFilter(t *testing.T) {
+	rec := NewRecordingLogger()
+	f := NewLevelFilter(rec, INFO)
+	f.SetComponentLevel("cache", TRACE)
+	cache := Component(f, "cache")
+	f.LOG(DEBUG, "", "dropped", nil)
+	f.LOG(WARN, "", "kept", nil)
+	cache.LOG(TRACE, "", "cache miss", map[string]string{"key": "k1"})
+	if !Enabled(cache, TRACE, "") || Enabled(f, DEBUG, "") {
+		t.Fatalf("TestLevelFilter Enabled doesn't match the levels")
+	}
+
+	f.ClearComponentLevel("cache")
+	cache.LOG(DEBUG, "", "dropped now", nil)
+	entries := rec.Entries()
+	if len(entries) != 2 || entries[1].Keys[ComponentKey] != "cache" || entries[1].Keys["key"] != "k1" {
+		t.Fatalf("TestLevelFilter expected 2 entries, got %+v", entries)
+	}
+}
+
+func TestConsoleLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := NewConsoleLogger(AppInfo{Name: "test"}, &out, false)
+	l.LOG(WARN, "abc", "Rate limit exceeded", map[string]string{"path": "/api/x", "ua": "curl 7"})
+	line := out.String()
+	if !strings.HasSuffix(line, ` WARN [abc] Rate limit exceeded path=/api/x ua="curl 7"` + "\n") {
+		t.Fatalf("TestConsoleLogger got %q", line)
+	}
+
+	out.Reset()
+	l.JSON = true
+	l.LOG(INFO, "abc", "hello", nil)
+	var e LogEntry
+	if err := json.Unmarshal(out.Bytes(), &e); err != nil || e.Message != "hello" || e.App.Name != "test" {
+		t.Fatalf("TestConsoleLogger expected a json entry, got %q", out.String())
+	}
+}
+
+// files are rotated at MaxSize and only MaxBackups rotated files are kept
+func TestRotatingFileLogger(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "app.log")
+	os.MkdirAll(filepath.Join(dir, "logs"), 0755)
+	os.WriteFile(filepath.Join(dir, "logs", "app-access.log"), []byte("not ours"), 0644)
+
+	l, err := NewRotatingFileLogger(AppInfo{Name: "test"}, path, 200, 0, 2)
+	if err != nil {
+		t.Fatalf("TestRotatingFileLogger failed to open: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		l.LOG(INFO, "", "an entry long enough that two don't fit in one file", nil)
+		time.Sleep(2 * time.Millisecond)
+	}
+	l.Close()
+	l.LOG(INFO, "", "after close", nil)
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "logs", "app-*.log"))
+	if len(backups) != 3 {
+		t.Fatalf("TestRotatingFileLogger expected 2 rotated files and app-access.log, got %v", backups)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Count(string(data), "\n") != 1 || l.Status() != nil {
+		t.Fatalf("TestRotatingFileLogger expected one entry in the current file, got %q", data)
+	}
+}
+
+func TestSyslogLogger(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("TestSyslogLogger can't listen: %s", err)
+	}
+	defer conn.Close()
+	l, err := NewSyslogLogger(AppInfo{Name: "webbertut"}, "udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("TestSyslogLogger failed to dial: %s", err)
+	}
+	defer l.Close()
+	l.LOG(ERROR, "abc", "disk full", nil)
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	// <11> is user facility (1) * 8 + err severity (3)
+	if err != nil || !strings.HasPrefix(string(buf[:n]), "<11>") || !strings.Contains(string(buf[:n]), `"message":"disk full"`) {
+		t.Fatalf("TestSyslogLogger got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,111 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"sync"
+)
+
+type sink struct {
+	logger Logger
+	minLevel LogLevel
+}
+
+// MultiLogger sends each entry to several loggers, each with its own minimum level, e.g.
+// everything to the console but only errors to firehose
+type MultiLogger struct {
+	mu sync.RWMutex
+	sinks []sink
+}
+
+// NewMultiLogger creates a MultiLogger with no loggers
+func NewMultiLogger() *MultiLogger {
+	return new(MultiLogger)
+}
+
+// Add adds a logger that gets entries at minLevel or above.  Returns m so calls can be chained.
+//
+// Example:
+//	logger.StdLogger = logger.NewMultiLogger().Add(console, logger.INFO).Add(fhLogger, logger.ERROR)
+//
+func (m *MultiLogger) Add(l Logger, minLevel LogLevel) *MultiLogger {
+	m.mu.Lock()
+	m.sinks = append(m.sinks, sink{l, minLevel})
+	m.mu.Unlock()
+	return m
+}
+
+func (m *MultiLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sinks {
+		if level.Enabled(s.minLevel) {
+			s.logger.LOG(level, correlationid, msg, keys)
+		}
+	}
+}
+
+// WriteEntry writes the entry to each logger whose level it meets
+func (m *MultiLogger) WriteEntry(entry LogEntry) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sinks {
+		if entry.Level.Enabled(s.minLevel) {
+			WriteEntry(s.logger, entry)
+		}
+	}
+}
+
+// StdOutOn is passed on to every logger
+func (m *MultiLogger) StdOutOn(alsoToStdOut bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sinks {
+		s.logger.StdOutOn(alsoToStdOut)
+	}
+}
+
+// Status returns the first error reported by a logger that has a Status() error method, or nil
+func (m *MultiLogger) Status() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sinks {
+		if err := statusOf(s.logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every logger that has a Close() error method, returning the first error
+func (m *MultiLogger) Close() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var first error
+	for _, s := range m.sinks {
+		if err := CloseLogger(s.logger); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
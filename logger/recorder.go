@@ -0,0 +1,80 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"sync"
+)
+
+// NopLogger discards everything
+type NopLogger struct{}
+
+// NewNopLogger creates a NopLogger
+func NewNopLogger() *NopLogger {
+	return new(NopLogger)
+}
+
+func (l *NopLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {}
+func (l *NopLogger) StdOutOn(alsoToStdOut bool) {}
+func (l *NopLogger) WriteEntry(entry LogEntry) {}
+
+// RecordingLogger keeps every entry in memory, for tests to check what was logged
+type RecordingLogger struct {
+	App AppInfo
+
+	mu sync.Mutex
+	entries []LogEntry
+}
+
+// NewRecordingLogger creates an empty RecordingLogger
+func NewRecordingLogger() *RecordingLogger {
+	return new(RecordingLogger)
+}
+
+func (l *RecordingLogger) StdOutOn(alsoToStdOut bool) {}
+
+func (l *RecordingLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(l.App, level, correlationid, msg, keys))
+}
+
+// WriteEntry writes the entry, as from the logger's App
+func (l *RecordingLogger) WriteEntry(entry LogEntry) {
+	entry.App = l.App
+	l.mu.Lock()
+	l.entries = append(l.entries, entry)
+	l.mu.Unlock()
+}
+
+// Entries returns a copy of the entries logged so far, oldest first
+func (l *RecordingLogger) Entries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]LogEntry(nil), l.entries...)
+}
+
+// Reset discards the entries logged so far
+func (l *RecordingLogger) Reset() {
+	l.mu.Lock()
+	l.entries = nil
+	l.mu.Unlock()
+}
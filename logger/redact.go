@@ -0,0 +1,227 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces the values of sensitive keys
+const Redacted = "[REDACTED]"
+
+// DefaultRedactedKeys are the key names whose values are never logged.  Names match ignoring
+// case, '-' and '_' (so "api_key" also covers "apiKey" and "X-Api-Key"), and a name also matches the last part of a dotted key, e.g. "req.password".
+var DefaultRedactedKeys = []string{"password", "passwd", "secret", "token", "access_token", "refresh_token", "id_token",
+	"authorization", "proxy_authorization", "cookie", "set_cookie", "x_api_key", "api_key", "session_key"}
+
+type redactPattern struct {
+	name string
+	re *regexp.Regexp
+	replace func(match string) string
+}
+
+// Redactor removes sensitive data from log entries: the values of keys with sensitive names, and
+// anything in the message or values that matches a pattern, e.g. bearer tokens, email addresses
+// and card numbers
+type Redactor struct {
+	keys map[string]bool
+	patterns []redactPattern
+}
+
+// NewRedactor creates a Redactor that redacts nothing
+func NewRedactor() *Redactor {
+	r := new(Redactor)
+	r.keys = make(map[string]bool)
+	return r
+}
+
+// DefaultRedactor creates a Redactor for DefaultRedactedKeys, "password=..." style pairs in messages,
+// bearer and basic credentials, JWTs, AWS access key ids, email addresses and card numbers
+func DefaultRedactor() *Redactor {
+	r := NewRedactor().RedactKeys(DefaultRedactedKeys...)
+	r.AddPattern("secret", regexp.MustCompile(`(?i)\b(password|passwd|secret|token|api[_-]?key|session[_-]?key)(["']?\s*[=:]\s*["']?)[^\s"'&,;]+`), "${1}${2}" + Redacted)
+	r.AddPattern("credentials", regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9\-._~+/]+=*`), "${1} " + Redacted)
+	r.AddPattern("jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), "[REDACTED:jwt]")
+	r.AddPattern("aws-key", regexp.MustCompile(`\b(AKIA|ASIA)[A-Z0-9]{16}\b`), "[REDACTED:aws-key]")
+	r.AddPattern("email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[REDACTED:email]")
+	r.patterns = append(r.patterns, redactPattern{name: "card", re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), replace: func(m string) string {
+		if luhn(m) {
+			return "[REDACTED:card]"
+		}
+		return m
+	}})
+	return r
+}
+
+// RedactKeys adds key names whose values are replaced with Redacted.  Returns r so calls can be chained.
+func (r *Redactor) RedactKeys(names ...string) *Redactor {
+	for _, n := range names {
+		r.keys[normalizeKey(n)] = true
+	}
+	return r
+}
+
+// AddPattern replaces matches of re in messages and values with replacement, which can refer to
+// re's groups as in regexp.ReplaceAllString, e.g. "${1}=[REDACTED]".  Returns r so calls can be chained.
+func (r *Redactor) AddPattern(name string, re *regexp.Regexp, replacement string) *Redactor {
+	r.patterns = append(r.patterns, redactPattern{name: name, re: re, replace: func(m string) string {
+		return re.ReplaceAllString(m, replacement)
+	}})
+	return r
+}
+
+var keySeparators = strings.NewReplacer("-", "", "_", "")
+
+// normalizeKey returns the form key names are compared in: lower case, without '-' or '_'
+func normalizeKey(name string) string {
+	return keySeparators.Replace(strings.ToLower(name))
+}
+
+// SensitiveKey returns true if the key's value is always redacted
+func (r *Redactor) SensitiveKey(name string) bool {
+	n := normalizeKey(name)
+	if r.keys[n] {
+		return true
+	}
+	if i := strings.LastIndex(n, "."); i >= 0 {
+		return r.keys[n[i+1:]]
+	}
+	return false
+}
+
+// RedactString replaces everything in s that matches a pattern
+func (r *Redactor) RedactString(s string) string {
+	for _, p := range r.patterns {
+		s = p.re.ReplaceAllStringFunc(s, p.replace)
+	}
+	return s
+}
+
+// Redact returns a copy of the entry with its message, keys and fields redacted
+func (r *Redactor) Redact(entry LogEntry) LogEntry {
+	entry.Message = r.RedactString(entry.Message)
+	if len(entry.Keys) > 0 {
+		keys := make(map[string]string, len(entry.Keys))
+		for k, v := range entry.Keys {
+			if r.SensitiveKey(k) {
+				keys[k] = Redacted
+			} else {
+				keys[k] = r.RedactString(v)
+			}
+		}
+		entry.Keys = keys
+	}
+	if len(entry.Fields) > 0 {
+		fields := make(map[string]interface{}, len(entry.Fields))
+		for k, v := range entry.Fields {
+			if r.SensitiveKey(k) {
+				fields[k] = Redacted
+			} else if s, ok := v.(string); ok {
+				fields[k] = r.RedactString(s)
+			} else {
+				fields[k] = v
+			}
+		}
+		entry.Fields = fields
+	}
+	return entry
+}
+
+// luhn returns true if the digits in s pass the Luhn check card numbers have
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n % 2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum % 10 == 0
+}
+
+// RedactingLogger redacts every entry before passing it on, so no sink sees sensitive data
+type RedactingLogger struct {
+	Logger Logger
+	Redactor *Redactor
+}
+
+// NewRedactingLogger creates a RedactingLogger
+//
+// parameters:
+//	l : the logger to pass redacted entries to
+//	r : the redactor, e.g. DefaultRedactor()
+//
+// Returns:
+//	a pointer to the RedactingLogger
+//
+// Example:
+//	redactor := logger.DefaultRedactor().RedactKeys("ssn")
+//	logger.StdLogger = logger.NewRedactingLogger(multi, redactor)
+//
+func NewRedactingLogger(l Logger, r *Redactor) *RedactingLogger {
+	rl := new(RedactingLogger)
+	rl.Logger = l
+	rl.Redactor = r
+	return rl
+}
+
+func (l *RedactingLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(AppInfo{}, level, correlationid, msg, keys))
+}
+
+func (l *RedactingLogger) WriteEntry(entry LogEntry) {
+	WriteEntry(l.Logger, l.Redactor.Redact(entry))
+}
+
+func (l *RedactingLogger) StdOutOn(alsoToStdOut bool) {
+	l.Logger.StdOutOn(alsoToStdOut)
+}
+
+func (l *RedactingLogger) Enabled(level LogLevel, component string) bool {
+	return Enabled(l.Logger, level, component)
+}
+
+// Status returns the wrapped logger's status, if it has one
+func (l *RedactingLogger) Status() error {
+	return statusOf(l.Logger)
+}
+
+// Close closes the wrapped logger
+func (l *RedactingLogger) Close() error {
+	return CloseLogger(l.Logger)
+}
+
+// Unwrap returns the wrapped logger
+func (l *RedactingLogger) Unwrap() Logger {
+	return l.Logger
+}
@@ -0,0 +1,42 @@
+package logger
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// sensitive keys and anything matching a pattern are redacted before the sink gets the entry
+func TestRedactingLogger(t *testing.T) {
+	rec := NewRecordingLogger()
+	redactor := DefaultRedactor().RedactKeys("ssn").AddPattern("account", regexp.MustCompile(`ACCT-[0-9]{8}`), "[REDACTED:account]")
+	l := NewRedactingLogger(rec, redactor)
+
+	l.LOG(WARN, "c1", "login for dog@example.com with password=bark failed, Authorization: Bearer abc.def", map[string]string{
+		"Cookie": "wtmsession=12345", "req.X-Api-Key": "k1", "card": "4111 1111 1111 1111", "order": "4111111111111112", "acct": "ACCT-12345678"})
+	With(l, map[string]interface{}{"ssn": 123456789, "jwt": "eyJhbGciOi.eyJzdWIiOi.c2lnbmF0dXJl"}).Infof("saved")
+
+	entries := rec.Entries()
+	msg, keys := entries[0].Message, entries[0].Keys
+	if strings.Contains(msg, "dog@example.com") || strings.Contains(msg, "bark") || strings.Contains(msg, "abc.def") || !strings.Contains(msg, "password=" + Redacted) {
+		t.Fatalf("TestRedactingLogger message not redacted: %q", msg)
+	}
+	if keys["Cookie"] != Redacted || keys["req.X-Api-Key"] != Redacted || keys["card"] != "[REDACTED:card]" || keys["acct"] != "[REDACTED:account]" {
+		t.Fatalf("TestRedactingLogger keys not redacted: %+v", keys)
+	}
+	// not a card number, it fails the Luhn check
+	if keys["order"] != "4111111111111112" {
+		t.Fatalf("TestRedactingLogger redacted a number that isn't a card: %+v", keys)
+	}
+	for _, key := range []string{"accessToken", "refresh-token", "apiKey", "sessionKey", "X_API_KEY", "body.Set-Cookie"} {
+		if !redactor.SensitiveKey(key) {
+			t.Fatalf("TestRedactingLogger expected %s to be sensitive", key)
+		}
+	}
+	if redactor.SensitiveKey("tokens_left") {
+		t.Fatalf("TestRedactingLogger expected tokens_left not to be sensitive")
+	}
+	if entries[1].Fields["ssn"] != Redacted || entries[1].Keys["jwt"] != "[REDACTED:jwt]" {
+		t.Fatalf("TestRedactingLogger fields not redacted: %+v %+v", entries[1].Keys, entries[1].Fields)
+	}
+}
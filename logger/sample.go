@@ -0,0 +1,298 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"strings"
+)
+
+// maxTemplates is how many message templates a Sampler counts before starting its counts again,
+// so messages that don't follow a template can't use up memory
+const maxTemplates = 10000
+
+// SamplingConfig says which entries a Sampler keeps
+type SamplingConfig struct {
+	Rates map[LogLevel]int		// keep 1 in N entries of each message template at the level.  Levels not listed keep everything
+	Templates map[string]int	// keep 1 in N entries whose message starts with the prefix, whatever their level
+	DedupWindow time.Duration	// collapse identical entries within the window into one with a count, 0 for none
+}
+
+// SamplerStats counts the entries a Sampler didn't pass on, by level
+type SamplerStats struct {
+	Passed int64
+	Sampled map[LogLevel]int64		// dropped by sampling
+	Suppressed map[LogLevel]int64	// collapsed into a repeated entry
+}
+
+type dedupState struct {
+	entry LogEntry			// the first entry in the window
+	start time.Time
+	repeats int64
+}
+
+// Sampler passes on a deterministic sample of entries (the first of each message template, then
+// every Nth) and collapses repeats of the same entry within a window into one entry with a
+// "repeated" count, so a flood of identical errors doesn't flood the logs.  Templates are the
+// message with numbers replaced by "#", e.g. "Cannot read cache for user #".
+type Sampler struct {
+	Logger Logger			// where kept entries go
+
+	config SamplingConfig
+	mu sync.Mutex
+	counts map[string]int64
+	dedup map[string]*dedupState
+	stats SamplerStats
+	stop chan struct{}
+	done chan struct{}
+	closed bool
+}
+
+// NewSampler creates a Sampler.  If there's a DedupWindow, a goroutine writes the repeated entries
+// once their windows end; call Close to stop it.
+//
+// parameters:
+//	l : the logger to pass kept entries to
+//	config : what to keep
+//
+// Returns:
+//	a pointer to the Sampler
+//
+// Example:
+//	s := logger.NewSampler(multi, logger.SamplingConfig{Rates: map[logger.LogLevel]int{logger.INFO: 10}, DedupWindow: time.Minute})
+//
+func NewSampler(l Logger, config SamplingConfig) *Sampler {
+	s := new(Sampler)
+	s.Logger = l
+	s.config = config
+	s.counts = make(map[string]int64)
+	s.dedup = make(map[string]*dedupState)
+	s.stats.Sampled = make(map[LogLevel]int64)
+	s.stats.Suppressed = make(map[LogLevel]int64)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	if config.DedupWindow > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+	return s
+}
+
+// messageTemplate returns msg with runs of digits replaced by "#"
+func messageTemplate(msg string) string {
+	var b strings.Builder
+	inNumber := false
+	for _, c := range msg {
+		if c >= '0' && c <= '9' {
+			if !inNumber {
+				b.WriteByte('#')
+			}
+			inNumber = true
+			continue
+		}
+		inNumber = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// rate returns N for the entry, 1 to keep everything
+func (s *Sampler) rate(level LogLevel, msg string) int {
+	longest, n := -1, 0
+	for prefix, r := range s.config.Templates {
+		if len(prefix) > longest && strings.HasPrefix(msg, prefix) {
+			longest, n = len(prefix), r
+		}
+	}
+	if longest < 0 {
+		n = s.config.Rates[level]
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (s *Sampler) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	s.WriteEntry(NewLogEntry(AppInfo{}, level, correlationid, msg, keys))
+}
+
+func (s *Sampler) WriteEntry(entry LogEntry) {
+	now := time.Now()
+	var flushed []LogEntry
+	s.mu.Lock()
+	if s.config.DedupWindow > 0 {
+		key := string(entry.Level) + "\x00" + entry.Message
+		if d, ok := s.dedup[key]; ok {
+			if now.Sub(d.start) < s.config.DedupWindow {
+				d.repeats++
+				s.stats.Suppressed[entry.Level]++
+				s.mu.Unlock()
+				return
+			}
+			if d.repeats > 0 {
+				flushed = append(flushed, repeatedEntry(d))
+			}
+		}
+		if len(s.dedup) < maxTemplates {
+			s.dedup[key] = &dedupState{entry: entry, start: now}
+		} else {
+			delete(s.dedup, key)
+		}
+	}
+
+	n := s.rate(entry.Level, entry.Message)
+	keep := true
+	if n > 1 {
+		key := string(entry.Level) + "\x00" + messageTemplate(entry.Message)
+		if len(s.counts) >= maxTemplates {
+			s.counts = make(map[string]int64)
+		}
+		keep = s.counts[key] % int64(n) == 0
+		s.counts[key]++
+	}
+	if keep {
+		s.stats.Passed++
+	} else {
+		s.stats.Sampled[entry.Level]++
+	}
+	s.mu.Unlock()
+
+	for _, e := range flushed {
+		WriteEntry(s.Logger, e)
+	}
+	if keep {
+		WriteEntry(s.Logger, entry)
+	}
+}
+
+// repeatedEntry is the entry that stands for the repeats in a window
+func repeatedEntry(d *dedupState) LogEntry {
+	e := d.entry
+	e.Timestamp = time.Now().UnixNano()/1000000
+	e.Message = fmt.Sprintf("%s (repeated %d times in %s)", e.Message, d.repeats, time.Since(d.start).Round(time.Second))
+	fields := make(map[string]interface{}, len(e.Fields) + 1)
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	fields["repeated"] = d.repeats
+	e.Fields = fields
+	return e
+}
+
+// run writes the repeated entries for windows that have ended
+func (s *Sampler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.DedupWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.flushDedup(false)
+		}
+	}
+}
+
+// flushDedup writes the repeated entries for ended windows, or all of them
+func (s *Sampler) flushDedup(all bool) {
+	var flushed []LogEntry
+	s.mu.Lock()
+	for key, d := range s.dedup {
+		if all || time.Since(d.start) >= s.config.DedupWindow {
+			if d.repeats > 0 {
+				flushed = append(flushed, repeatedEntry(d))
+			}
+			delete(s.dedup, key)
+		}
+	}
+	s.mu.Unlock()
+	for _, e := range flushed {
+		WriteEntry(s.Logger, e)
+	}
+}
+
+// Stats returns counts of the entries passed on and dropped
+func (s *Sampler) Stats() SamplerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := SamplerStats{Passed: s.stats.Passed, Sampled: make(map[LogLevel]int64), Suppressed: make(map[LogLevel]int64)}
+	for l, n := range s.stats.Sampled {
+		stats.Sampled[l] = n
+	}
+	for l, n := range s.stats.Suppressed {
+		stats.Suppressed[l] = n
+	}
+	return stats
+}
+
+func (s *Sampler) StdOutOn(alsoToStdOut bool) {
+	s.Logger.StdOutOn(alsoToStdOut)
+}
+
+func (s *Sampler) Enabled(level LogLevel, component string) bool {
+	return Enabled(s.Logger, level, component)
+}
+
+// Status returns the wrapped logger's status, if it has one
+func (s *Sampler) Status() error {
+	return statusOf(s.Logger)
+}
+
+// Close writes the repeated entries for every open window, then closes the wrapped logger
+func (s *Sampler) Close() error {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	if !closed {
+		close(s.stop)
+		<-s.done
+		s.flushDedup(true)
+	}
+	return CloseLogger(s.Logger)
+}
+
+// Unwrap returns the wrapped logger
+func (s *Sampler) Unwrap() Logger {
+	return s.Logger
+}
+
+// FindSampler returns the Sampler in l's chain of wrapped loggers (see Unwrap), or nil
+func FindSampler(l Logger) *Sampler {
+	for l != nil {
+		if s, ok := l.(*Sampler); ok {
+			return s
+		}
+		u, ok := l.(interface{ Unwrap() Logger })
+		if !ok {
+			return nil
+		}
+		l = u.Unwrap()
+	}
+	return nil
+}
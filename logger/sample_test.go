@@ -0,0 +1,40 @@
+package logger
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"testing"
+)
+
+// sampling keeps the first of each template then every Nth, and repeats are collapsed into one entry
+func TestSampler(t *testing.T) {
+	rec := NewRecordingLogger()
+	s := NewSampler(rec, SamplingConfig{
+		Rates: map[LogLevel]int{INFO: 3},
+		Templates: map[string]int{"Cannot read cache": 100},
+		DedupWindow: time.Hour,
+	})
+	for i := 0; i < 7; i++ {
+		s.LOG(INFO, "", fmt.Sprintf("user %d logged in", i), nil)
+		s.LOG(ERROR, "", fmt.Sprintf("Cannot read cache for user %d", i), nil)
+		s.LOG(WARN, "", "db slow", nil)
+	}
+	if n := len(rec.Entries()); n != 3 + 1 + 1 {
+		t.Fatalf("TestSampler expected 5 entries before Close, got %d: %+v", n, rec.Entries())
+	}
+	stats := s.Stats()
+	if stats.Sampled[INFO] != 4 || stats.Sampled[ERROR] != 6 || stats.Suppressed[WARN] != 6 {
+		t.Fatalf("TestSampler got stats %+v", stats)
+	}
+	if FindSampler(NewLevelFilter(NewRedactingLogger(s, NewRedactor()), INFO)) != s {
+		t.Fatalf("TestSampler FindSampler didn't find the sampler")
+	}
+
+	s.Close()
+	entries := rec.Entries()
+	last := entries[len(entries) - 1]
+	if len(entries) != 6 || !strings.HasPrefix(last.Message, "db slow (repeated 6 times") || last.Fields["repeated"] != int64(6) {
+		t.Fatalf("TestSampler expected a repeated entry on Close, got %+v", last)
+	}
+}
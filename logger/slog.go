@@ -0,0 +1,228 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package logger
+
+import (
+	"sort"
+	"time"
+	"context"
+	"log/slog"
+)
+
+// CorrelationIdKey is the slog attribute that carries an entry's correlation id
+const CorrelationIdKey = "correlation_id"
+
+// SlogLevel returns the slog level for a LogLevel.  TRACE and CRITICAL are below Debug and above
+// Error.
+func SlogLevel(level LogLevel) slog.Level {
+	switch level {
+	case TRACE:
+		return slog.LevelDebug - 4
+	case DEBUG:
+		return slog.LevelDebug
+	case WARN:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	case CRITICAL:
+		return slog.LevelError + 4
+	}
+	return slog.LevelInfo
+}
+
+// LevelFromSlog returns the LogLevel for a slog level, rounding down, e.g. slog.LevelInfo + 2 is INFO
+func LevelFromSlog(level slog.Level) LogLevel {
+	switch {
+	case level < slog.LevelDebug:
+		return TRACE
+	case level < slog.LevelInfo:
+		return DEBUG
+	case level < slog.LevelWarn:
+		return INFO
+	case level < slog.LevelError:
+		return WARN
+	case level < slog.LevelError + 4:
+		return ERROR
+	}
+	return CRITICAL
+}
+
+// SlogHandler is a slog.Handler that writes records to a Logger, so code using log/slog logs
+// to the same places as everything else.  Attributes become fields, with groups' names as
+// prefixes, e.g. "req.method", and the CorrelationIdKey attribute becomes the correlation id.
+type SlogHandler struct {
+	logger Logger
+	fields map[string]interface{}
+	correlationId string
+	prefix string
+}
+
+// NewSlogHandler creates a SlogHandler
+//
+// parameters:
+//	l : the logger to write to, or nil for whatever StdLogger is when each record is handled
+//
+// Returns:
+//	a pointer to the SlogHandler
+//
+// Example:
+//	slog.SetDefault(slog.New(logger.NewSlogHandler(nil)))
+//	slog.Info("hike saved", "hike", name, "length", 12)
+//
+func NewSlogHandler(l Logger) *SlogHandler {
+	h := new(SlogHandler)
+	h.logger = l
+	h.fields = make(map[string]interface{})
+	return h
+}
+
+func (h *SlogHandler) target() Logger {
+	if h.logger == nil {
+		return StdLogger
+	}
+	return h.logger
+}
+
+func (h *SlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	component, _ := h.fields[ComponentKey].(string)
+	return Enabled(h.target(), LevelFromSlog(level), component)
+}
+
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	c := h.clone()
+	r.Attrs(func(a slog.Attr) bool {
+		c.addAttr(c.prefix, a)
+		return true
+	})
+	entry := NewFieldEntry(LevelFromSlog(r.Level), c.correlationId, r.Message, c.fields)
+	if !r.Time.IsZero() {
+		entry.Timestamp = r.Time.UnixNano()/1000000
+	}
+	WriteEntry(h.target(), entry)
+	return nil
+}
+
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := h.clone()
+	for _, a := range attrs {
+		c.addAttr(c.prefix, a)
+	}
+	return c
+}
+
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if len(name) == 0 {
+		return h
+	}
+	c := h.clone()
+	c.prefix += name + "."
+	return c
+}
+
+func (h *SlogHandler) clone() *SlogHandler {
+	c := NewSlogHandler(h.logger)
+	for k, v := range h.fields {
+		c.fields[k] = v
+	}
+	c.correlationId = h.correlationId
+	c.prefix = h.prefix
+	return c
+}
+
+func (h *SlogHandler) addAttr(prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if len(a.Key) > 0 {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			h.addAttr(prefix, ga)
+		}
+		return
+	}
+	if len(a.Key) == 0 {
+		return
+	}
+	if a.Key == CorrelationIdKey && len(prefix) == 0 {
+		h.correlationId = v.String()
+		return
+	}
+	h.fields[prefix + a.Key] = v.Any()
+}
+
+// SlogLogger is a Logger that writes entries to a slog.Handler, for programs that have set up
+// slog and want goweb's logs to go there too.  Keys and Fields become attributes, and the
+// correlation id the CorrelationIdKey attribute.
+type SlogLogger struct {
+	Handler slog.Handler
+}
+
+// NewSlogLogger creates a SlogLogger
+//
+// parameters:
+//	h : the handler to write to, e.g. slog.Default().Handler()
+//
+// Returns:
+//	a pointer to the SlogLogger
+//
+// Example:
+//	logger.StdLogger = logger.NewSlogLogger(slog.NewJSONHandler(os.Stdout, nil))
+//
+func NewSlogLogger(h slog.Handler) *SlogLogger {
+	l := new(SlogLogger)
+	l.Handler = h
+	return l
+}
+
+// StdOutOn does nothing, the handler decides where entries go
+func (l *SlogLogger) StdOutOn(alsoToStdOut bool) {
+}
+
+func (l *SlogLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(AppInfo{}, level, correlationid, msg, keys))
+}
+
+func (l *SlogLogger) WriteEntry(entry LogEntry) {
+	level := SlogLevel(entry.Level)
+	if !l.Handler.Enabled(context.Background(), level) {
+		return
+	}
+	r := slog.NewRecord(time.Unix(0, entry.Timestamp * int64(time.Millisecond)), level, entry.Message, 0)
+	if len(entry.CorrelationId) > 0 {
+		r.AddAttrs(slog.String(CorrelationIdKey, entry.CorrelationId))
+	}
+	attrs := make([]slog.Attr, 0, len(entry.Keys) + len(entry.Fields))
+	for k, v := range entry.Keys {
+		attrs = append(attrs, slog.String(k, v))
+	}
+	for k, v := range entry.Fields {
+		attrs = append(attrs, slog.Any(k, v))
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	r.AddAttrs(attrs...)
+	l.Handler.Handle(context.Background(), r)
+}
+
+func (l *SlogLogger) Enabled(level LogLevel, component string) bool {
+	return l.Handler.Enabled(context.Background(), SlogLevel(level))
+}
@@ -0,0 +1,99 @@
+// logger - GoWeb Logging helper package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and 
+// associated documentation files (the "Software"), to deal in the Software without restriction, 
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, 
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, 
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial 
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"fmt"
+	"log/syslog"
+	"encoding/json"
+)
+
+// SyslogLogger sends json entries to syslog, at the syslog severity matching each level
+type SyslogLogger struct {
+	AlsoToStdout bool		// if true, also outputs to stdout with fmt.Println
+	App AppInfo
+
+	w *syslog.Writer
+}
+
+// NewSyslogLogger connects to a syslog daemon, tagging entries with the app name
+//
+// parameters:
+//	app : the AppInfo structure describing the service
+//	network : "udp", "tcp", or "" for the local daemon
+//	raddr : the daemon's address, e.g. "logs.example.com:514", or "" for the local daemon
+//
+// Returns:
+//	a pointer to a SyslogLogger struct, or an error if syslog can't be reached
+//
+func NewSyslogLogger(app AppInfo, network string, raddr string) (*SyslogLogger, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_USER, app.Name)
+	if err != nil {
+		return nil, err
+	}
+	l := new(SyslogLogger)
+	l.App = app
+	l.w = w
+	return l, nil
+}
+
+func (l *SyslogLogger) StdOutOn(alsoToStdOut bool) {
+	l.AlsoToStdout = alsoToStdOut
+}
+
+func (l *SyslogLogger) LOG(level LogLevel, correlationid string, msg string, keys map[string]string) {
+	l.WriteEntry(NewLogEntry(l.App, level, correlationid, msg, keys))
+}
+
+// WriteEntry writes the entry, as from the logger's App
+func (l *SyslogLogger) WriteEntry(entry LogEntry) {
+	entry.App = l.App
+	data, _ := json.Marshal(entry)
+	if l.AlsoToStdout {
+		fmt.Println(entry.Text())
+	}
+
+	var err error
+	switch entry.Level {
+	case CRITICAL:
+		err = l.w.Crit(string(data))
+	case ERROR:
+		err = l.w.Err(string(data))
+	case WARN:
+		err = l.w.Warning(string(data))
+	case DEBUG, TRACE:
+		err = l.w.Debug(string(data))
+	default:
+		err = l.w.Info(string(data))
+	}
+	if err != nil {
+		fmt.Println("Failed to write to syslog: ", err)
+	}
+}
+
+// Close closes the connection to syslog
+func (l *SyslogLogger) Close() error {
+	return l.w.Close()
+}
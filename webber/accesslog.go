@@ -0,0 +1,168 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"strconv"
+	"strings"
+	"net/http"
+	"encoding/json"
+	"jmh/goweb/logger"
+)
+
+const (
+	AccessLogJSON = "json"		// the access log entry as a json object
+	AccessLogCLF = "clf"		// Common Log Format
+)
+
+// DefaultRedactedHeaders are the headers whose values are never written to the logs
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", API_KEY_HEADER}
+
+// AccessLogConfig says how the access log middleware writes its entries
+type AccessLogConfig struct {
+	Format string				// AccessLogJSON or AccessLogCLF
+	Headers []string			// request headers to include in each entry, e.g. "Referer"
+	RedactHeaders []string		// headers whose values are replaced with "redacted", in addition to DefaultRedactedHeaders
+	Output io.Writer			// if set, entries are written here one per line instead of to logger.StdLogger
+
+	mu sync.Mutex
+}
+
+// AccessLogEntry is what is recorded for each request
+type AccessLogEntry struct {
+	Time time.Time					`json:"time"`
+	Method string					`json:"method"`
+	Path string						`json:"path"`
+	Route string					`json:"route"`
+	Proto string					`json:"proto"`
+	Status int						`json:"status"`
+	Bytes int64						`json:"bytes"`
+	LatencyMs float64				`json:"latency_ms"`
+	ClientIP string					`json:"client_ip"`
+	UserAgent string				`json:"user_agent"`
+	CorrelationId string			`json:"correlation_id"`
+	Headers map[string]string		`json:"headers,omitempty"`
+}
+
+// AccessLog returns middleware that logs each request once it has been handled.  Add it with
+// AppServer.Use (NewAppServer does this when ServerConfig.AccessLogFormat is set).
+//
+// Parameters:
+//	config : the format, headers and redaction rules to use
+//
+// Returns:
+//	Middleware : the access log middleware
+//
+// Example:
+//	as.Use(webber.AccessLog(&webber.AccessLogConfig{Format: webber.AccessLogCLF}))
+//
+func AccessLog(config *AccessLogConfig) Middleware {
+	return func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rr := newResponseRecorder(w)
+			next(rr, r)
+
+			e := AccessLogEntry{Time: start, Method: r.Method, Path: r.URL.Path, Route: h.BasePath(), Proto: r.Proto,
+				Status: rr.Status(), Bytes: rr.bytes, LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				ClientIP: GetClientIP(r), UserAgent: r.UserAgent(), CorrelationId: GetCorrelationId(r)}
+			if len(config.Headers) > 0 {
+				e.Headers = make(map[string]string)
+				for _, k := range config.Headers {
+					if v := r.Header.Get(k); len(v) > 0 {
+						e.Headers[k] = redactHeader(k, v, config.RedactHeaders)
+					}
+				}
+			}
+			config.write(&e)
+		}
+	}
+}
+
+// write formats the entry and sends it to the output or the logger
+func (config *AccessLogConfig) write(e *AccessLogEntry) {
+	var line string
+	if config.Format == AccessLogCLF {
+		line = e.CLF()
+	} else {
+		b, _ := json.Marshal(e)
+		line = string(b)
+	}
+
+	if config.Output != nil {
+		config.mu.Lock()
+		io.WriteString(config.Output, line + "\n")
+		config.mu.Unlock()
+		return
+	}
+	level := logger.LogLevel(logger.INFO)
+	if e.Status >= 500 {
+		level = logger.ERROR
+	}
+	logger.StdLogger.LOG(level, e.CorrelationId, line, e.Keys())
+}
+
+// Keys returns the entry as log keys, so log collectors can search on them
+func (e *AccessLogEntry) Keys() map[string]string {
+	keys := map[string]string{
+		"method": e.Method,
+		"path": e.Path,
+		"route": e.Route,
+		"status": strconv.Itoa(e.Status),
+		"bytes": strconv.FormatInt(e.Bytes, 10),
+		"latency_ms": strconv.FormatFloat(e.LatencyMs, 'f', 3, 64),
+		"client_ip": e.ClientIP,
+		"user_agent": e.UserAgent,
+	}
+	for k, v := range e.Headers {
+		keys["header_" + strings.ToLower(k)] = v
+	}
+	return keys
+}
+
+// CLF formats the entry in Common Log Format, e.g.
+// 127.0.0.1 - - [10/Oct/2018:13:55:36 -0700] "GET /api/hike/rainier HTTP/1.1" 200 2326
+func (e *AccessLogEntry) CLF() string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s", e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, bytes)
+}
+
+// redactHeader returns "redacted" for headers that should never be logged, otherwise the value
+func redactHeader(name string, value string, redact []string) string {
+	for _, list := range [][]string{DefaultRedactedHeaders, redact} {
+		for _, k := range list {
+			if strings.EqualFold(k, name) {
+				return "redacted"
+			}
+		}
+	}
+	return value
+}
@@ -0,0 +1,45 @@
+package webber
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"net/http"
+	"encoding/json"
+	"net/http/httptest"
+)
+
+// the access log records the outcome of the request, and never the value of sensitive headers
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	config := &AccessLogConfig{Format: AccessLogJSON, Headers: []string{"Referer", "Authorization"}, Output: &out}
+	h := &traceHandler{}
+	chain := AccessLog(config)(h, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	r := httptest.NewRequest("POST", "/trace/x", nil)
+	r.Header.Set("Referer", "http://example.com/")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set(CORRELATION_ID_HEADER, "abc123")
+	chain(httptest.NewRecorder(), r)
+
+	var e AccessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &e); err != nil {
+		t.Fatalf("TestAccessLog bad json %q: %s", out.String(), err)
+	}
+	if e.Status != 201 || e.Bytes != 5 || e.Route != "/trace" || e.ClientIP != "192.0.2.1" || e.CorrelationId != "abc123" {
+		t.Fatalf("TestAccessLog unexpected entry %+v", e)
+	}
+	if e.Headers["Referer"] != "http://example.com/" || e.Headers["Authorization"] != "redacted" {
+		t.Fatalf("TestAccessLog unexpected headers %+v", e.Headers)
+	}
+
+	out.Reset()
+	config.Format = AccessLogCLF
+	chain(httptest.NewRecorder(), httptest.NewRequest("GET", "/trace/y", nil))
+	if line := out.String(); !strings.HasPrefix(line, "192.0.2.1 - - [") || !strings.HasSuffix(line, "\"GET /trace/y HTTP/1.1\" 201 5\n") {
+		t.Fatalf("TestAccessLog unexpected CLF line %q", line)
+	}
+}
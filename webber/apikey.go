@@ -0,0 +1,448 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"strings"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"gopkg.in/mgo.v2/bson"
+	"jmh/goweb/wtmcache"
+	"jmh/goweb/logger"
+)
+
+const API_KEY_HEADER = "X-Api-Key"
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKeyScope grants access to the methods under a path prefix.  An empty Methods list means all
+// methods, and an empty PathPrefix means all paths.  The prefix matches whole path segments, so
+// "/api/cache" covers "/api/cache" and "/api/cache/hikes" but not "/api/cachestats".
+type APIKeyScope struct {
+	Methods []string	`json:"methods"`		// e.g. ["GET"] for read only
+	PathPrefix string	`json:"pathprefix"`	// e.g. "/api/cache/hikes/"
+}
+
+// allows returns true if the scope covers the method and path
+func (s *APIKeyScope) allows(method string, path string) bool {
+	if !pathHasPrefix(path, s.PathPrefix) {
+		return false
+	}
+	if len(s.Methods) == 0 {
+		return true
+	}
+	for _, m := range s.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathHasPrefix returns true if path is prefix, or is under it
+func pathHasPrefix(path string, prefix string) bool {
+	if len(prefix) == 0 || path == prefix {
+		return true
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// APIKey is the stored record for an api key.  The key itself is never stored, only its hash.
+type APIKey struct {
+	Hash string				`json:"hash"`		// sha256 of the key, see HashAPIKey
+	Name string				`json:"name"`		// name of the service the key was issued to
+	Scopes []APIKeyScope	`json:"scopes"`		// what the key may access.  No scopes means no access
+	Created time.Time		`json:"created"`
+	Expires time.Time		`json:"expires"`	// zero if the key does not expire
+}
+
+// Expired returns true if the key has passed its expiration time
+func (k *APIKey) Expired() bool {
+	return !k.Expires.IsZero() && k.Expires.Before(time.Now())
+}
+
+// Allows returns true if one of the key's scopes covers the method and path
+func (k *APIKey) Allows(method string, path string) bool {
+	for i := range k.Scopes {
+		if k.Scopes[i].allows(method, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore is the interface for the backends that api key records are stored in
+//
+//	Lookup : returns the key record with the given hash, or ErrAPIKeyNotFound
+//	FindByName : returns all the key records (including expired ones) issued to name
+//	Save : adds or replaces a key record
+type APIKeyStore interface {
+	Lookup(hash string) (*APIKey, error)
+	FindByName(name string) ([]APIKey, error)
+	Save(key APIKey) error
+}
+
+// HashAPIKey returns the hex encoded sha256 of key, which is what the stores index keys by
+func HashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// GenerateAPIKey creates a new random api key for name with the supplied scopes and saves its hash
+// to the store.  The key returned is the only copy of it, so it needs to be handed to the caller.
+//
+// Parameters:
+//	store : the store to save the key record to
+//	name : the name of the service the key is for
+//	scopes : what the key can access
+//	expires : when the key expires, or the zero time for never
+//
+// Returns:
+//	string : the new api key
+//	error : any error generating or saving the key
+//
+func GenerateAPIKey(store APIKeyStore, name string, scopes []APIKeyScope, expires time.Time) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+	rec := APIKey{Hash: HashAPIKey(key), Name: name, Scopes: scopes, Created: time.Now(), Expires: expires}
+	err = store.Save(rec)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// RotateAPIKey issues a new key to name with the same scopes as its newest existing key, and sets
+// the existing keys to expire after a grace period so callers have time to switch over.
+//
+// Parameters:
+//	store : the store the keys are in
+//	name : the name of the service whose key is being rotated
+//	grace : how long the old keys remain valid
+//
+// Returns:
+//	string : the new api key
+//	error : ErrAPIKeyNotFound if name has no keys, or any error saving the keys
+//
+func RotateAPIKey(store APIKeyStore, name string, grace time.Duration) (string, error) {
+	keys, err := store.FindByName(name)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", ErrAPIKeyNotFound
+	}
+	newest := keys[0]
+	for _, k := range keys {
+		if k.Created.After(newest.Created) {
+			newest = k
+		}
+	}
+	newKey, err := GenerateAPIKey(store, name, newest.Scopes, time.Time{})
+	if err != nil {
+		return "", err
+	}
+	graceEnd := time.Now().Add(grace)
+	for _, k := range keys {
+		if k.Expires.IsZero() || k.Expires.After(graceEnd) {
+			k.Expires = graceEnd
+			err = store.Save(k)
+			if err != nil {
+				return newKey, err
+			}
+		}
+	}
+	return newKey, nil
+}
+
+///////////////////////////////////////////////////
+// File backed key store
+//
+
+// FileAPIKeyStore keeps the key records in a json file.  The file is re-read when it changes, so keys
+// can be added or rotated by another process (e.g. the cacheserver command line) while a server runs.
+// If the file is removed, the store has no keys.
+type FileAPIKeyStore struct {
+	path string
+	mu sync.Mutex
+	fileInfo os.FileInfo		// the file as it was when we last read it, nil if it wasn't there
+	keys map[string]APIKey
+}
+
+// NewFileAPIKeyStore creates a key store backed by the json file at path.  The file is created when
+// the first key is saved if it doesn't exist.
+//
+// Parameters:
+//	path : path to the key file
+//
+// Returns:
+//	*FileAPIKeyStore : the store
+//	error : any error reading an existing file
+//
+func NewFileAPIKeyStore(path string) (*FileAPIKeyStore, error) {
+	s := new(FileAPIKeyStore)
+	s.path = path
+	s.keys = make(map[string]APIKey)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s, s.reloadIfChanged()
+}
+
+// reloadIfChanged re-reads the file if it has been replaced, or its time or size are different from
+// when we last read it (a replacement may well be older), and drops the keys if it has been removed.
+// Must hold s.mu
+func (s *FileAPIKeyStore) reloadIfChanged() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		if s.fileInfo != nil {
+			logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Api key file %s was removed, no keys are valid", s.path), nil)
+		}
+		s.keys = make(map[string]APIKey)
+		s.fileInfo = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if s.fileInfo != nil && os.SameFile(s.fileInfo, fi) && fi.ModTime().Equal(s.fileInfo.ModTime()) && fi.Size() == s.fileInfo.Size() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []APIKey
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	s.keys = make(map[string]APIKey)
+	for _, k := range list {
+		s.keys[k.Hash] = k
+	}
+	s.fileInfo = fi
+	return nil
+}
+
+func (s *FileAPIKeyStore) Lookup(hash string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.reloadIfChanged()
+	if err != nil {
+		logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintf("Error reading api key file %s: %s", s.path, err), nil)
+	}
+	k, ok := s.keys[hash]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &k, nil
+}
+
+func (s *FileAPIKeyStore) FindByName(name string) ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.reloadIfChanged()
+	var found []APIKey
+	for _, k := range s.keys {
+		if k.Name == name {
+			found = append(found, k)
+		}
+	}
+	return found, err
+}
+
+func (s *FileAPIKeyStore) Save(key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.reloadIfChanged()
+	if err != nil {
+		return err
+	}
+	s.keys[key.Hash] = key
+	list := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(s.path, data, 0600)
+	if err == nil {
+		if fi, statErr := os.Stat(s.path); statErr == nil {
+			s.fileInfo = fi
+		}
+	}
+	return err
+}
+
+///////////////////////////////////////////////////
+// wtmcache backed key store
+//
+
+// CollectionAPIKeyStore keeps the key records in a wtmcache collection, keyed on the hash
+type CollectionAPIKeyStore struct {
+	coll *wtmcache.Collection
+}
+
+// NewCollectionAPIKeyStore creates a key store in the named collection of cDb
+//
+// Parameters:
+//	cDb : the db to create the collection in
+//	collName : the name of the collection used for the keys
+//
+// Returns:
+//	*CollectionAPIKeyStore : the store
+//
+func NewCollectionAPIKeyStore(cDb *wtmcache.Db, collName string) *CollectionAPIKeyStore {
+	s := new(CollectionAPIKeyStore)
+	s.coll = cDb.NewCollection(collName, "hash", 10*time.Minute, 10*time.Minute)
+	return s
+}
+
+func (s *CollectionAPIKeyStore) Lookup(hash string) (*APIKey, error) {
+	var docTemplate APIKey
+	_, err := s.coll.Read(hash, &docTemplate)
+	if err != nil {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &docTemplate, nil
+}
+
+func (s *CollectionAPIKeyStore) FindByName(name string) ([]APIKey, error) {
+	var results []APIKey
+	err := s.coll.Query(bson.M{"name": name}, &results)
+	return results, err
+}
+
+func (s *CollectionAPIKeyStore) Save(key APIKey) error {
+	return s.coll.Write(key)
+}
+
+///////////////////////////////////////////////////
+// Authentication
+//
+
+// APIKeyAuth authenticates requests by the api key in the X-Api-Key header
+type APIKeyAuth struct {
+	Store APIKeyStore
+}
+
+// NewAPIKeyAuth creates an APIKeyAuth that checks keys against store
+func NewAPIKeyAuth(store APIKeyStore) *APIKeyAuth {
+	a := new(APIKeyAuth)
+	a.Store = store
+	return a
+}
+
+// key returns the valid (present and unexpired) key record for the request, or nil
+func (a *APIKeyAuth) key(r *http.Request) *APIKey {
+	key := r.Header.Get(API_KEY_HEADER)
+	if len(key) == 0 {
+		return nil
+	}
+	rec, err := a.Store.Lookup(HashAPIKey(key))
+	if err != nil || rec.Expired() {
+		return nil
+	}
+	return rec
+}
+
+// Authenticate checks the request has a valid api key with a scope covering the method and path.
+// If not, it writes a 401 (missing, unknown or expired key) or 403 (out of scope) to w, logs it
+// and returns false.
+//
+// Parameters:
+//	w : the response writer, used for writing the error if the caller is denied
+//	r : the request being authenticated
+//
+// Returns:
+//	bool : true if the request may proceed
+//
+func (a *APIKeyAuth) Authenticate(w http.ResponseWriter, r *http.Request) bool {
+	rec := a.key(r)
+	if rec == nil {
+		GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Missing or invalid api key for %s %s", r.Method, r.URL.Path), nil)
+		ReturnError(w, r, http.StatusUnauthorized, "Invalid api key")
+		return false
+	}
+	if !rec.Allows(r.Method, r.URL.Path) {
+		keys := map[string]string{"apikey_name": rec.Name}
+		GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Api key for %s not scoped for %s %s", rec.Name, r.Method, r.URL.Path), keys)
+		ReturnError(w, r, http.StatusForbidden, "Forbidden")
+		return false
+	}
+	if rc := GetRequestContext(r); rc != nil {
+		rc.mu.Lock()
+		rc.apiKeyName = rec.Name
+		rc.mu.Unlock()
+	}
+	return true
+}
+
+// GetAPIKeyName returns the name of the service whose api key APIKeyAuth accepted for the request,
+// or "" if it wasn't authenticated by api key.  Use it to keep one service's data apart from another's.
+func GetAPIKeyName(r *http.Request) string {
+	if rc := GetRequestContext(r); rc != nil {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return rc.apiKeyName
+	}
+	return ""
+}
+
+// Middleware returns a Middleware that only dispatches requests that pass Authenticate
+func (a *APIKeyAuth) Middleware() Middleware {
+	return func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if a.Authenticate(w, r) {
+				next(w, r)
+			}
+		}
+	}
+}
+
+// Principal is a PrincipalLoader that identifies the caller by its api key, so AccessPolicies can be
+// used with api keys as well as sessions.  The Principal's Id is the name the key was issued to.
+func (a *APIKeyAuth) Principal(r *http.Request) *Principal {
+	rec := a.key(r)
+	if rec == nil {
+		return nil
+	}
+	return &Principal{Id: rec.Name}
+}
@@ -0,0 +1,125 @@
+package webber
+
+import (
+	"os"
+	"time"
+	"testing"
+	"net/http"
+	"path/filepath"
+	"net/http/httptest"
+)
+
+// scopes cover whole path segments, and methods if they list any
+func TestAPIKeyScope(t *testing.T) {
+	scope := APIKeyScope{Methods: []string{"GET"}, PathPrefix: "/api/cache"}
+	tests := []struct {
+		method, path string
+		allowed bool
+	}{
+		{"GET", "/api/cache", true},
+		{"get", "/api/cache/hikes/rainier", true},
+		{"GET", "/api/cachestats/hikes", false},
+		{"GET", "/api", false},
+		{"POST", "/api/cache/hikes", false},
+	}
+	for _, test := range tests {
+		if scope.allows(test.method, test.path) != test.allowed {
+			t.Fatalf("TestAPIKeyScope %s %s expected %v", test.method, test.path, test.allowed)
+		}
+	}
+	if !(&APIKeyScope{PathPrefix: "/api/"}).allows("DELETE", "/api/x") || !(&APIKeyScope{}).allows("PUT", "/anything") {
+		t.Fatalf("TestAPIKeyScope expected a trailing slash prefix and an empty scope to match")
+	}
+}
+
+// valid keys are let through, unknown and expired keys get a 401, out of scope requests a 403, and
+// a rotated key keeps working for the grace period
+func TestAPIKeyAuth(t *testing.T) {
+	store, err := NewFileAPIKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("TestAPIKeyAuth failed to create the store: %s", err)
+	}
+	oldKey, err := GenerateAPIKey(store, "hikes", []APIKeyScope{{Methods: []string{"GET"}, PathPrefix: "/api/cache"}}, time.Time{})
+	if err != nil {
+		t.Fatalf("TestAPIKeyAuth failed to generate a key: %s", err)
+	}
+	var caller string
+	chain := NewAPIKeyAuth(store).Middleware()(&authzHandler{}, func(w http.ResponseWriter, r *http.Request) {
+		caller = GetAPIKeyName(r)
+	})
+	send := func(method string, path string, key string) int {
+		w := httptest.NewRecorder()
+		r := withRequestContext(w, httptest.NewRequest(method, path, nil))
+		if len(key) > 0 {
+			r.Header.Set(API_KEY_HEADER, key)
+		}
+		chain(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		method, path, key string
+		code int
+	}{
+		{"GET", "/api/cache/hikes", oldKey, http.StatusOK},
+		{"GET", "/api/cache/hikes", "", http.StatusUnauthorized},
+		{"GET", "/api/cache/hikes", oldKey + "x", http.StatusUnauthorized},
+		{"POST", "/api/cache/hikes", oldKey, http.StatusForbidden},
+		{"GET", "/api/cachestats/hikes", oldKey, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if code := send(test.method, test.path, test.key); code != test.code {
+			t.Fatalf("TestAPIKeyAuth %s %s with key %q expected %d, got %d", test.method, test.path, test.key, test.code, code)
+		}
+	}
+
+	if caller != "hikes" {
+		t.Fatalf("TestAPIKeyAuth expected the handler to see the key's name, got %q", caller)
+	}
+
+	newKey, err := RotateAPIKey(store, "hikes", time.Hour)
+	if err != nil || newKey == oldKey {
+		t.Fatalf("TestAPIKeyAuth failed to rotate the key: %v", err)
+	}
+	if send("GET", "/api/cache/hikes", newKey) != http.StatusOK || send("POST", "/api/cache/hikes", newKey) != http.StatusForbidden ||
+			send("GET", "/api/cache/hikes", oldKey) != http.StatusOK {
+		t.Fatalf("TestAPIKeyAuth expected the new key to have the old key's scopes, and the old key to work during the grace period")
+	}
+	rec, _ := store.Lookup(HashAPIKey(oldKey))
+	if rec.Expires.IsZero() {
+		t.Fatalf("TestAPIKeyAuth expected the old key to be set to expire")
+	}
+	rec.Expires = time.Now().Add(-time.Second)
+	store.Save(*rec)
+	if code := send("GET", "/api/cache/hikes", oldKey); code != http.StatusUnauthorized {
+		t.Fatalf("TestAPIKeyAuth expected the expired key to be refused, got %d", code)
+	}
+}
+
+// the store picks up a replacement key file even if it's older, and has no keys once the file is removed
+func TestFileAPIKeyStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.json")
+	store, _ := NewFileAPIKeyStore(path)
+	oldKey, _ := GenerateAPIKey(store, "hikes", nil, time.Time{})
+
+	// stage a new file with another process's store, backdate it and move it into place
+	staged, _ := NewFileAPIKeyStore(filepath.Join(dir, "staged.json"))
+	newKey, _ := GenerateAPIKey(staged, "hikes", nil, time.Time{})
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "staged.json"), old, old)
+	if err := os.Rename(filepath.Join(dir, "staged.json"), path); err != nil {
+		t.Fatalf("TestFileAPIKeyStoreReload failed to replace the file: %s", err)
+	}
+	if _, err := store.Lookup(HashAPIKey(oldKey)); err != ErrAPIKeyNotFound {
+		t.Fatalf("TestFileAPIKeyStoreReload expected the replaced key to be gone, got %v", err)
+	}
+	if _, err := store.Lookup(HashAPIKey(newKey)); err != nil {
+		t.Fatalf("TestFileAPIKeyStoreReload expected the new key, got %v", err)
+	}
+
+	os.Remove(path)
+	if _, err := store.Lookup(HashAPIKey(newKey)); err != ErrAPIKeyNotFound {
+		t.Fatalf("TestFileAPIKeyStoreReload expected no keys once the file was removed, got %v", err)
+	}
+}
@@ -23,8 +23,8 @@
 package webber
 
 import (
-	"fmt"
 	"net/http"
+	"jmh/goweb/logger"
 )
 
 // AppServer is a webserver intended to support web applications by providing both a file server and an
@@ -33,10 +33,55 @@ type AppServer struct {
 	Config *ServerConfig
 	FileServerInst* FileServer
 	Handlers map[string]WebHandler
+	handlerOpts map[string]*handlerOptions	// per-handler options, keyed the same as Handlers
+	middleware []Middleware				// applied to every request, see Use
+	proxies *TrustedProxies				// from Config.TrustedProxies, for resolving client addresses
+}
+
+// Middleware wraps the dispatch of a request to handler h.  It returns a HandlerFunc that should
+// call next to continue dispatching, or write a response itself and return to stop.
+type Middleware func(h WebHandler, next http.HandlerFunc) http.HandlerFunc
+
+// handlerOptions holds the optional settings a handler was registered with
+type handlerOptions struct {
+	policy *AccessPolicy
+	middleware []Middleware
+	noServerMiddleware bool		// skip the AppServer's own middleware, see WithoutServerMiddleware
+	cors *CORSConfig			// overrides the server's CORS config, see WithCORS
+}
+
+// HandlerOption is an optional setting passed to RegisterHandler
+type HandlerOption func(o *handlerOptions)
+
+// WithAccessPolicy requires that requests to the handler are authorized by policy before
+// being dispatched
+func WithAccessPolicy(policy *AccessPolicy) HandlerOption {
+	return func(o *handlerOptions) {
+		o.policy = policy
+	}
+}
+
+// WithMiddleware adds middleware that only applies to requests for the handler.  It runs after
+// the AppServer's own middleware and any access policy.
+func WithMiddleware(m ...Middleware) HandlerOption {
+	return func(o *handlerOptions) {
+		o.middleware = append(o.middleware, m...)
+	}
+}
+
+// WithoutServerMiddleware dispatches requests to the handler without the AppServer's own middleware
+// (such as api key checks and access logging).  Use it for endpoints like health probes that must
+// answer without credentials.
+func WithoutServerMiddleware() HandlerOption {
+	return func(o *handlerOptions) {
+		o.noServerMiddleware = true
+	}
 }
 
 // NewAppServer creates a new appserver with configuration information supplied by a ServerConfig object.  Will
-// also create a FileServer that handles any paths not handled by the api server, if a wwwroot is specified
+// also create a FileServer that handles any paths not handled by the api server, if a wwwroot is specified,
+// and add the access log middleware if config.AccessLogFormat is set, the CORS middleware, and the security
+// headers middleware if config.SecurityHeaders is set
 //
 // Parameters:
 //	config *ServerConfig : struct with configuration information for the server
@@ -55,6 +100,25 @@ func NewAppServer(config *ServerConfig) *AppServer {
 
 	// initialize our map of handlers
 	f.Handlers = make(map[string]WebHandler)
+	f.handlerOpts = make(map[string]*handlerOptions)
+
+	// a bad proxy list is logged and ignored, so no forwarding headers are believed
+	proxies, err := ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		logger.StdLogger.LOG(logger.ERROR, "", "Ignoring TrustedProxies: " + err.Error(), nil)
+	}
+	f.proxies = proxies
+
+	// the access log goes first, so it times and sees the result of everything else
+	if len(config.AccessLogFormat) > 0 {
+		f.Use(AccessLog(&AccessLogConfig{Format: config.AccessLogFormat, Headers: config.AccessLogHeaders}))
+	}
+	// then CORS, so preflights are answered before anything asks for credentials
+	config.CORS.warnWildcardCredentials("the server")
+	f.Use(f.corsMiddleware())
+	if config.SecurityHeaders != nil {
+		f.Use(SecurityHeaders(config.SecurityHeaders))
+	}
 	return f
 }
 
@@ -87,7 +151,9 @@ func (h AppServer) BasePath() string {
 
 // Handler - the base handler for the AppServer.  Our hptt server will call this directly
 //
-func (h AppServer) Handler (w http.ResponseWriter, r *http.Request) {
+func (h *AppServer) Handler (w http.ResponseWriter, r *http.Request) {
+	// attach the correlation id, logger, client address etc. first so middleware can use them
+	r = withRequestContextFrom(w, r, h.proxies)
 	wasHandled := false
 	urlPath := r.URL.Path
 	l := len(urlPath)
@@ -96,20 +162,19 @@ func (h AppServer) Handler (w http.ResponseWriter, r *http.Request) {
 			// tack on a trailing slash
 			urlPath = urlPath + "/"
 		}
-		fmt.Println("appServer handler path=", urlPath)
 		
 		for p := range h.Handlers {
 			if len(urlPath) >= len(p) &&	urlPath[:len(p)] == p {
 				wasHandled = true
 				phf := h.Handlers[p]
-				DispatchMethod(phf, w, r)
+				h.dispatch(phf, h.handlerOpts[p], w, r)
 			} 
 		}
 	}
 	if !wasHandled {
 		// not specific handler, assume it's a file
 		if h.FileServerInst != nil {
-			DispatchMethod(h.FileServerInst, w, r)
+			h.dispatch(h.FileServerInst, nil, w, r)
 		} else {
 			http.Error(w, "File not Found", http.StatusNotFound)
 		}
@@ -117,18 +182,60 @@ func (h AppServer) Handler (w http.ResponseWriter, r *http.Request) {
 
 }
 
+// dispatch runs the request through the AppServer's middleware (unless the handler opted out), then
+// the handler's access policy and middleware (if opts is not nil), and finally DispatchMethod
+func (h *AppServer) dispatch(handler WebHandler, opts *handlerOptions, w http.ResponseWriter, r *http.Request) {
+	chain := func(w http.ResponseWriter, r *http.Request) {
+		DispatchMethod(handler, w, r)
+	}
+	if opts != nil {
+		for i := len(opts.middleware) - 1; i >= 0; i-- {
+			chain = opts.middleware[i](handler, chain)
+		}
+		if opts.policy != nil {
+			chain = opts.policy.Middleware()(handler, chain)
+		}
+	}
+	if opts != nil && opts.noServerMiddleware {
+		chain(w, r)
+		return
+	}
+	for i := len(h.middleware) - 1; i >= 0; i-- {
+		chain = h.middleware[i](handler, chain)
+	}
+	chain(w, r)
+}
+
+// Use adds middleware that is applied to every request the AppServer dispatches, including
+// requests to the FileServer.  Middleware runs in the order it was added.
+//
+// Parameters:
+//	m : the middleware to add
+//
+// Returns:
+//	none
+//
+func (h *AppServer) Use(m ...Middleware) {
+	h.middleware = append(h.middleware, m...)
+}
 
 // RegisterHandler will add a new handler to the appServer
 //
 // Parameters:
 //	handler WebHandler : the handler to add, it should implement the WebHandler interface
+//	opts : (optional) settings for the handler, such as WithAccessPolicy(...)
 //
 // Returns:
 //	none
 //
-func (h AppServer) RegisterHandler(handler WebHandler) {
+func (h AppServer) RegisterHandler(handler WebHandler, opts ...HandlerOption) {
 	basePath := handler.BasePath()
 	h.Handlers[basePath] = handler
+	o := new(handlerOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	h.handlerOpts[basePath] = o
 }
 
 
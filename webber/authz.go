@@ -0,0 +1,231 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"net/http"
+	"jmh/goweb/logger"
+)
+
+// Principal describes the caller of a request, as established by a session or a token, along
+// with the roles and permissions the caller has been granted.
+type Principal struct {
+	Id string				// the user or service name
+	Roles []string			// e.g. "admin", "hiker"
+	Permissions []string	// e.g. "hikes:write"
+}
+
+// HasRole returns true if the principal has been granted the role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission returns true if the principal has been granted the permission
+func (p *Principal) HasPermission(permission string) bool {
+	for _, pp := range p.Permissions {
+		if pp == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// PrincipalLoader returns the Principal making the request, or nil if the caller is not authenticated
+type PrincipalLoader func(r *http.Request) *Principal
+
+// Authorizable should be implemented by session data (or token claims) structs that carry roles
+// and permissions, so they can be turned into a Principal.
+type Authorizable interface {
+	GetPrincipalId() string
+	GetRoles() []string
+	GetPermissions() []string
+}
+
+// SessionPrincipalLoader returns a PrincipalLoader that reads the caller's session (see GetSession)
+// into a new session data struct and builds a Principal from it.  Only sessions whose data is in
+// the session db count; a session cookie alone doesn't authenticate anyone.
+//
+// Parameters:
+//	newData : returns a pointer to an empty session data struct to decode the session into
+//
+// Returns:
+//	PrincipalLoader : returns nil for requests with no session, or one the session db doesn't have
+//
+// Example:
+//	loader := webber.SessionPrincipalLoader(func() webber.Authorizable { return &UserSessionData{} })
+//
+func SessionPrincipalLoader(newData func() Authorizable) PrincipalLoader {
+	return func(r *http.Request) *Principal {
+		data := newData()
+		bHaveSession, _, bFound := readSession(r, data)
+		if !bHaveSession || !bFound {
+			return nil
+		}
+		return &Principal{Id: data.GetPrincipalId(), Roles: data.GetRoles(), Permissions: data.GetPermissions()}
+	}
+}
+
+// AccessRule is the set of requirements a caller must meet to use a method.  An empty rule
+// just requires that the caller is authenticated.
+type AccessRule struct {
+	Roles []string			// if not empty, the caller must have at least one of these roles
+	Permissions []string	// the caller must have all of these permissions
+}
+
+// allows returns true if the principal satisfies the rule
+func (a *AccessRule) allows(p *Principal) bool {
+	if len(a.Roles) > 0 {
+		found := false
+		for _, r := range a.Roles {
+			if p.HasRole(r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, perm := range a.Permissions {
+		if !p.HasPermission(perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessPolicy declares the access rules for each method of a handler.  Methods without a rule
+// (and not covered by the "*" rule) are public.
+type AccessPolicy struct {
+	Loader PrincipalLoader			// used to find out who the caller is
+	Rules map[string]*AccessRule	// keyed by method, e.g. "GET", or "*" for any method without its own rule
+	Challenge string				// the WWW-Authenticate header sent with a 401, default DefaultChallenge
+}
+
+// DefaultChallenge is the WWW-Authenticate header an AccessPolicy sends with a 401 unless it has
+// its own Challenge, e.g. `Bearer realm="hikes"` for a policy whose Loader checks bearer tokens
+const DefaultChallenge = `Session realm="webber"`
+
+// NewAccessPolicy creates an empty AccessPolicy that uses loader to identify callers
+//
+// Parameters:
+//	loader : the PrincipalLoader used to identify the caller, e.g. SessionPrincipalLoader(...)
+//
+// Returns:
+//	*AccessPolicy : the policy created
+//
+// Example:
+//	policy := webber.NewAccessPolicy(loader).Require("POST", webber.AccessRule{Roles: []string{"hiker"}})
+//	as.RegisterHandler(hikes, webber.WithAccessPolicy(policy))
+//
+func NewAccessPolicy(loader PrincipalLoader) *AccessPolicy {
+	p := new(AccessPolicy)
+	p.Loader = loader
+	p.Rules = make(map[string]*AccessRule)
+	p.Challenge = DefaultChallenge
+	return p
+}
+
+// Require sets the rule for a method ("*" for all methods without their own rule).  Returns the
+// policy so calls can be chained.
+func (p *AccessPolicy) Require(method string, rule AccessRule) *AccessPolicy {
+	p.Rules[method] = &rule
+	return p
+}
+
+// Authorize checks the request against the policy.  If the caller is not allowed, it writes a
+// 401 (not authenticated, with a WWW-Authenticate challenge) or 403 (authenticated but not
+// permitted) to w, logs the denial, and returns false.
+//
+// Parameters:
+//	w : the response writer, used for writing the error if the caller is denied
+//	r : the request being authorized
+//
+// Returns:
+//	bool : true if the request may proceed
+//
+func (p *AccessPolicy) Authorize(w http.ResponseWriter, r *http.Request) bool {
+	rule, ok := p.Rules[r.Method]
+	if !ok {
+		rule, ok = p.Rules["*"]
+	}
+	if !ok {
+		// public method
+		return true
+	}
+
+	var principal *Principal
+	if p.Loader != nil {
+		principal = p.Loader(r)
+	}
+	if principal == nil {
+		GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Unauthenticated request denied for %s %s", r.Method, r.URL.Path), nil)
+		challenge := p.Challenge
+		if len(challenge) == 0 {
+			challenge = DefaultChallenge
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		ReturnError(w, r, http.StatusUnauthorized, "Not authenticated")
+		return false
+	}
+	if !rule.allows(principal) {
+		keys := map[string]string{"principal": principal.Id}
+		GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Access denied to %s for %s %s", principal.Id, r.Method, r.URL.Path), keys)
+		ReturnError(w, r, http.StatusForbidden, "Forbidden")
+		return false
+	}
+	if rc := GetRequestContext(r); rc != nil {
+		rc.mu.Lock()
+		rc.principalId = principal.Id
+		rc.mu.Unlock()
+	}
+	return true
+}
+
+// GetPrincipalId returns the id of the principal an AccessPolicy authorized for the request, or ""
+// if no policy has loaded one (yet)
+func GetPrincipalId(r *http.Request) string {
+	if rc := GetRequestContext(r); rc != nil {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return rc.principalId
+	}
+	return ""
+}
+
+// Middleware returns a Middleware that only dispatches requests that pass Authorize
+func (p *AccessPolicy) Middleware() Middleware {
+	return func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if p.Authorize(w, r) {
+				next(w, r)
+			}
+		}
+	}
+}
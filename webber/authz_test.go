@@ -0,0 +1,86 @@
+package webber
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+type authzHandler struct {
+	path string
+}
+
+func (h *authzHandler) HandleGet(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+func (h *authzHandler) HandlePost(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+func (h *authzHandler) BasePath() string { return h.path }
+func (h *authzHandler) Name() string { return "AuthzHandler" }
+
+type testSessionData struct {
+	User string
+}
+
+func (d *testSessionData) GetPrincipalId() string { return d.User }
+func (d *testSessionData) GetRoles() []string { return []string{"admin"} }
+func (d *testSessionData) GetPermissions() []string { return nil }
+
+// callers without a principal get a 401 with a challenge, callers without the roles and permissions
+// a rule needs get a 403, and methods without a rule are public
+func TestAccessPolicy(t *testing.T) {
+	users := map[string]*Principal{
+		"viewer": &Principal{Id: "viewer"},
+		"hiker": &Principal{Id: "hiker", Roles: []string{"hiker"}},
+		"writer": &Principal{Id: "writer", Roles: []string{"hiker"}, Permissions: []string{"hikes:write"}},
+	}
+	headerLoader := func(r *http.Request) *Principal {
+		return users[r.Header.Get("X-Test-User")]
+	}
+	hikes := NewAccessPolicy(headerLoader).
+		Require("*", AccessRule{}).
+		Require("POST", AccessRule{Roles: []string{"admin", "hiker"}, Permissions: []string{"hikes:write"}})
+	// a session cookie alone, without the session's data, isn't enough
+	admin := NewAccessPolicy(SessionPrincipalLoader(func() Authorizable { return &testSessionData{} })).
+		Require("POST", AccessRule{Roles: []string{"admin"}})
+
+	config := DefaultConfig()
+	config.WWWRoot = ""
+	as := NewAppServer(config)
+	as.RegisterHandler(&authzHandler{path: "/hikes"}, WithAccessPolicy(hikes))
+	as.RegisterHandler(&authzHandler{path: "/admin"}, WithAccessPolicy(admin))
+
+	send := func(method string, path string, user string, cookie string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if len(user) > 0 {
+			r.Header.Set("X-Test-User", user)
+		}
+		if len(cookie) > 0 {
+			r.AddCookie(&http.Cookie{Name: sessionHeader, Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		as.Handler(w, r)
+		return w
+	}
+
+	tests := []struct {
+		method, path, user, cookie string
+		code int
+	}{
+		{"GET", "/hikes/x", "", "", http.StatusUnauthorized},
+		{"GET", "/hikes/x", "nobody", "", http.StatusUnauthorized},
+		{"GET", "/hikes/x", "viewer", "", http.StatusOK},
+		{"POST", "/hikes/x", "viewer", "", http.StatusForbidden},
+		{"POST", "/hikes/x", "hiker", "", http.StatusForbidden},
+		{"POST", "/hikes/x", "writer", "", http.StatusOK},
+		{"GET", "/admin/x", "", "", http.StatusOK},
+		{"POST", "/admin/x", "", "", http.StatusUnauthorized},
+		{"POST", "/admin/x", "", "12345", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		w := send(test.method, test.path, test.user, test.cookie)
+		if w.Code != test.code {
+			t.Fatalf("TestAccessPolicy %s %s as %q with cookie %q expected %d, got %d", test.method, test.path, test.user, test.cookie, test.code, w.Code)
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); (w.Code == http.StatusUnauthorized) != (challenge == DefaultChallenge) {
+			t.Fatalf("TestAccessPolicy %s %s got %d with WWW-Authenticate %q", test.method, test.path, w.Code, challenge)
+		}
+	}
+}
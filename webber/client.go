@@ -24,11 +24,16 @@ package webber
 
 import (
 	"fmt"
+	"errors"
 	"net/http"
 	"time"
-	//"strings"
-	//"encoding/json"
+	"context"
+	"io"
+	"io/ioutil"
 	"bytes"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"jmh/goweb/logger"
 )
  
@@ -37,16 +42,113 @@ type HttpClient struct {
 	transport *http.Transport
 	client *http.Client
 	preserveHeaders []string		// array of headers that should be preserved from upstream
+	apiKey string					// api key sent with every request, if set
+	timeout time.Duration			// default timeout for requests, 0 for none
+	retry *RetryPolicy				// nil if retries are disabled
+	breakers *breakerSet			// nil if circuit breakers are disabled
+	metricsMu sync.RWMutex			// guards durations and metricsName, which RegisterMetrics may set while requests are sent
+	durations *HistogramVec			// request times, if RegisterMetrics has been called
+	metricsName string				// the client label for metrics
+	cache ResponseCache				// nil if responses aren't cached
+
+	// counters for Stats, updated atomically
+	requests int64
+	retries int64
+	failures int64
+	shortCircuits int64
+	breakerOpens int64
+	cacheHits int64
+	cacheMisses int64
+	cacheRevalidations int64
+}
+
+// ClientStats are counters of the requests made by an HttpClient, see HttpClient.Stats
+type ClientStats struct {
+	Requests int64						// attempts sent, including retries
+	Retries int64						// attempts that were retries
+	Failures int64						// attempts that failed with a network error or a 5xx status, not counting ones the caller cancelled
+	ShortCircuits int64					// requests failed with ErrCircuitOpen without being sent
+	BreakerOpens int64					// times a circuit breaker has opened
+	Breakers map[string]CircuitState	// the current circuit breaker state for each host
+	CacheHits int64						// GETs answered from the response cache without a request
+	CacheMisses int64					// GETs that were not in the response cache, or couldn't be revalidated
+	CacheRevalidations int64			// GETs answered from the response cache after a 304 Not Modified
+}
+
+// HttpClientConfig holds the connection pooling and timeout settings for an HttpClient
+type HttpClientConfig struct {
+	Timeout time.Duration			// default time limit for a request, including reading the response body.  0 for none
+	MaxIdleConns int				// max idle connections kept across all hosts, 0 for no limit
+	MaxIdleConnsPerHost int			// max idle connections kept per host, 0 for the net/http default (2)
+	MaxConnsPerHost int				// max connections per host, including active ones.  0 for no limit
+	IdleConnTimeout time.Duration	// how long an idle connection is kept
+	DisableCompression bool
+	Retry *RetryPolicy				// how failed requests are retried, nil for no retries
+	Breaker *CircuitBreakerConfig	// settings for the per host circuit breakers, nil for none
+	Cache ResponseCache				// where cacheable GET responses are kept, nil for no caching
+}
+
+// RequestOptions are the optional settings for a single request made by HttpClient.Do
+type RequestOptions struct {
+	Upstream *http.Request		// upstream request to preserve headers from.  Its context also cancels the request
+	ContentType string			// sets the Content-Type header if not empty
+	Headers http.Header			// additional headers to send
+	Timeout time.Duration		// overrides the client's default timeout if > 0
 }
 
+// DefaultHttpClientConfig returns the config used by NewHttpClient.  It retries with the
+// DefaultRetryPolicy, and has no circuit breakers.
+func DefaultHttpClientConfig() *HttpClientConfig {
+	config := new(HttpClientConfig)
+	config.Timeout = 30 * time.Second
+	config.MaxIdleConns = 10
+	config.IdleConnTimeout = 30 * time.Second
+	config.DisableCompression = true
+	config.Retry = DefaultRetryPolicy()
+	return config
+}
 
+// NewHttpClient creates an HttpClient with the default config
+//
+// Parameters:
+//	preserveHeaders : (optional) headers to copy from upstream requests.  The correlation id is always copied
+//
+// Returns:
+//	*HttpClient : the client created
+//
 func NewHttpClient (preserveHeaders []string) (*HttpClient) {
+	return NewHttpClientWithConfig(preserveHeaders, DefaultHttpClientConfig())
+}
+
+// NewHttpClientWithConfig creates an HttpClient with the supplied timeout and connection pool settings
+//
+// Parameters:
+//	preserveHeaders : (optional) headers to copy from upstream requests.  The correlation id is always copied
+//	config : the timeout and pool settings
+//
+// Returns:
+//	*HttpClient : the client created
+//
+func NewHttpClientWithConfig (preserveHeaders []string, config *HttpClientConfig) (*HttpClient) {
 
 	r := new(HttpClient)
 	r.transport = &http.Transport{
-		MaxIdleConns: 10,
-		IdleConnTimeout: 30 * time.Second,
-		DisableCompression: true,
+		Proxy: http.ProxyFromEnvironment,
+		MaxIdleConns: config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		MaxConnsPerHost: config.MaxConnsPerHost,
+		IdleConnTimeout: config.IdleConnTimeout,
+		DisableCompression: config.DisableCompression,
+	}
+	r.timeout = config.Timeout
+	r.retry = config.Retry
+	r.cache = config.Cache
+	if config.Breaker != nil {
+		r.breakers = newBreakerSet(config.Breaker, func(host string, from CircuitState, to CircuitState) {
+			if to == CircuitOpen {
+				atomic.AddInt64(&r.breakerOpens, 1)
+			}
+		})
 	}
 	
 	r.client = &http.Client{Transport: r.transport}
@@ -63,6 +165,264 @@ func NewHttpClient (preserveHeaders []string) (*HttpClient) {
 	return r
 }
 
+// SetAPIKey sets an api key that will be sent in the X-Api-Key header of every request made by
+// the client.  Pass "" to stop sending one.
+//
+// Parameters:
+//	key : the api key issued to this service
+//
+func (c *HttpClient) SetAPIKey(key string) {
+	c.apiKey = key
+}
+
+// Stats returns the request counters and circuit breaker states for the client
+func (c *HttpClient) Stats() ClientStats {
+	stats := ClientStats{
+		Requests: atomic.LoadInt64(&c.requests),
+		Retries: atomic.LoadInt64(&c.retries),
+		Failures: atomic.LoadInt64(&c.failures),
+		ShortCircuits: atomic.LoadInt64(&c.shortCircuits),
+		BreakerOpens: atomic.LoadInt64(&c.breakerOpens),
+		CacheHits: atomic.LoadInt64(&c.cacheHits),
+		CacheMisses: atomic.LoadInt64(&c.cacheMisses),
+		CacheRevalidations: atomic.LoadInt64(&c.cacheRevalidations),
+	}
+	if c.breakers != nil {
+		stats.Breakers = c.breakers.states()
+	} else {
+		stats.Breakers = make(map[string]CircuitState)
+	}
+	return stats
+}
+
+// cancelOnClose releases a request's context once the caller is done with the response body
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// upstreamContext returns the context of the upstream request, or context.Background() if there is none
+func upstreamContext(upstream *http.Request) context.Context {
+	if upstream != nil {
+		return upstream.Context()
+	}
+	return context.Background()
+}
+
+// Do makes a request with any method, preserving appropriate headers from the upstream request if
+// one is provided in opts.  The request is cancelled if ctx is done or the timeout passes, which
+// includes the time spent reading the response body (and any retries), so always close the body.
+//
+// Failed requests are retried according to the client's RetryPolicy, and if the client has circuit
+// breakers, requests to a host whose breaker is open fail with ErrCircuitOpen.  If the client has a
+// ResponseCache, GETs may be answered from it.
+//
+// Parameters:
+//	ctx :	the context for the request.  If nil, the upstream request's context is used (or context.Background())
+//	method : the http method, e.g. "PUT"
+//	url : 	the destination url, including any query parameters
+//	body :	(optional) the body to send
+//	opts :	(optional) the RequestOptions for this request
+//
+// Returns:
+//	*http.Response : the response of the call
+//	error : any error generated by the attempt (note that non-200 errors are handled withing the response, not the error)
+//
+func (c *HttpClient) Do(ctx context.Context, method string, url string, body []byte, opts *RequestOptions) (*http.Response, error) {
+	if opts == nil {
+		opts = &RequestOptions{}
+	}
+	if ctx == nil {
+		ctx = upstreamContext(opts.Upstream)
+	}
+	opts = withCorrelationId(ctx, opts)
+
+	if c.cache != nil {
+		if method == "GET" {
+			return c.doCached(ctx, url, opts)
+		}
+		resp, err := c.send(ctx, method, url, body, opts)
+		if err == nil && !isSafeMethod(method) && resp.StatusCode < 400 {
+			// the resource has changed, so what we have cached is out of date
+			c.cache.Delete(responseCacheKey(url))
+		}
+		return resp, err
+	}
+	return c.send(ctx, method, url, body, opts)
+}
+
+// withCorrelationId returns opts with the correlation id header to send, unless the caller has set
+// one.  The id comes from the upstream request or the RequestContext in ctx, or is new, and is the
+// same for every attempt.
+func withCorrelationId(ctx context.Context, opts *RequestOptions) *RequestOptions {
+	if len(opts.Headers.Get(CORRELATION_ID_HEADER)) > 0 {
+		return opts
+	}
+	id := ""
+	if opts.Upstream != nil {
+		id = GetCorrelationId(opts.Upstream)
+	}
+	if rc := RequestContextFromContext(ctx); len(id) == 0 && rc != nil {
+		id = rc.CorrelationId
+	}
+	if len(id) == 0 {
+		id = logger.GenerateCorrelationId()
+	}
+	copied := *opts
+	copied.Headers = opts.Headers.Clone()
+	if copied.Headers == nil {
+		copied.Headers = make(http.Header)
+	}
+	copied.Headers.Set(CORRELATION_ID_HEADER, id)
+	return &copied
+}
+
+// send makes the request, with the timeout, retries and circuit breaker checks described in Do
+func (c *HttpClient) send(ctx context.Context, method string, url string, body []byte, opts *RequestOptions) (*http.Response, error) {
+	timeout := c.timeout
+	if opts.Timeout > 0 {
+		timeout = opts.Timeout
+	}
+	callerCtx := ctx
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	for attempt := 1; ; attempt++ {
+		// a new request for each attempt, since the body reader is used up by the last one
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+		if (err != nil) {
+			cancel()
+			return nil, err
+		}
+		c.setHeaders(req.Header, opts)
+
+		var breaker *circuitBreaker
+		if c.breakers != nil {
+			breaker = c.breakers.get(req.URL.Host)
+			if err := breaker.allow(); err != nil {
+				atomic.AddInt64(&c.shortCircuits, 1)
+				cancel()
+				return nil, err
+			}
+		}
+
+		// a client span for each attempt, passed to the upstream in the traceparent header
+		span := StartSpan(ctx, method + " " + req.URL.Host, SpanKindClient)
+		span.SetAttribute("http.method", method)
+		span.SetAttribute("http.url", url)
+		span.SetAttribute("http.attempt", strconv.Itoa(attempt))
+		span.inject(req.Header)
+
+		// log outbound request, with its headers, if anyone's debugging
+		if logger.Enabled(logger.StdLogger, logger.DEBUG, "") {
+			logger.StdLogger.LOG(logger.DEBUG, getCorrelationId(req), fmt.Sprintf("outbound request %s", formatReqForLog(req)), nil)
+		}
+		atomic.AddInt64(&c.requests, 1)
+		if attempt > 1 {
+			atomic.AddInt64(&c.retries, 1)
+		}
+		resp, err := c.client.Do(req)
+
+		// the caller giving up (e.g. their client went away) says nothing about the host, but the
+		// client's own timeout running out does
+		abandoned := err != nil && (callerCtx.Err() != nil || errors.Is(err, context.Canceled))
+		failed := (err != nil && !abandoned) || (err == nil && resp.StatusCode >= 500)
+		if err != nil {
+			span.SetError(err.Error())
+		} else {
+			span.SetAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
+			if failed {
+				span.SetError(http.StatusText(resp.StatusCode))
+			}
+		}
+		span.End()
+		c.metricsMu.RLock()
+		durations, metricsName := c.durations, c.metricsName
+		c.metricsMu.RUnlock()
+		if durations != nil {
+			status := "error"
+			if err == nil {
+				status = strconv.Itoa(resp.StatusCode)
+			}
+			durations.Observe(time.Since(span.StartTime).Seconds(), metricsName, req.URL.Host, status)
+		}
+		if failed {
+			atomic.AddInt64(&c.failures, 1)
+		}
+		if breaker != nil {
+			if abandoned {
+				breaker.release()
+			} else {
+				breaker.record(failed)
+			}
+		}
+
+		var wait time.Duration
+		retry := false
+		if c.retry != nil && ctx.Err() == nil {
+			wait, retry = c.retry.nextDelay(attempt, method, resp, err)
+		}
+		if !retry {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		// throw away this attempt's response and wait to try again
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			logger.StdLogger.LOG(logger.WARN, getCorrelationId(req), fmt.Sprintf("Retrying %s %s after status %d (attempt %d)", method, url, resp.StatusCode, attempt), nil)
+		} else {
+			logger.StdLogger.LOG(logger.WARN, getCorrelationId(req), fmt.Sprintf("Retrying %s %s after error %s (attempt %d)", method, url, err, attempt), nil)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			cancel()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// setHeaders adds the headers preserved from upstream, the api key, and any headers from opts
+func (c *HttpClient) setHeaders(header http.Header, opts *RequestOptions) {
+	if opts.Upstream != nil {
+		for _, k := range c.preserveHeaders {
+			h := opts.Upstream.Header.Get(k)
+			if ( len(h) > 0 ) {
+				header.Set(k, h)
+			}
+		}
+	}
+	if len(c.apiKey) > 0 {
+		header.Set(API_KEY_HEADER, c.apiKey)
+	}
+	for k, v := range opts.Headers {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	if len(opts.ContentType) > 0 {
+		header.Set("Content-Type", opts.ContentType)
+	}
+}
+
 // Get will create a GET request to the specified url, preserving appropriate headers
 // from the upstream request, if one is provided
 //
@@ -75,28 +435,7 @@ func NewHttpClient (preserveHeaders []string) (*HttpClient) {
 //	error : any error generated by the attemp (note that non-200 errors are handled withing the response, not the error)
 //
 func (c *HttpClient) Get(url string, upstream *http.Request) (*http.Response, error) {
-
-	req, err := http.NewRequest("GET", url, nil)
-	if (err != nil) {
-		return nil, err
-	} else {
-		// check for headers to preserve
-		if ( upstream != nil ) {
-			if ( c.preserveHeaders != nil ) {
-				for _, k := range c.preserveHeaders {
-					h := upstream.Header.Get(k)
-					if ( len(h) > 0 ) {
-						// TODO = should this be Add or Set?  
-						req.Header.Add(k, h)
-					}
-				}
-			}
-		}
-		// log outbound request
-		logger.StdLogger.LOG(logger.INFO, getCorrelationId(req), fmt.Sprintf("outbound request %s", formatReqForLog(req)), nil)
-		return c.client.Do(req)
-	}
-
+	return c.Do(upstreamContext(upstream), "GET", url, nil, &RequestOptions{Upstream: upstream})
 }
 
 // Post will create a POST request to the specified url, preserving appropriate headers
@@ -113,29 +452,20 @@ func (c *HttpClient) Get(url string, upstream *http.Request) (*http.Response, er
 //	error : any error generated by the attemp (note that non-200 errors are handled withing the response, not the error)
 //
 func (c*HttpClient) Post(url string, data []byte, contentType string, upstream *http.Request) (*http.Response, error) {
+	return c.Do(upstreamContext(upstream), "POST", url, data, &RequestOptions{Upstream: upstream, ContentType: contentType})
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	if (err != nil) {
-		return nil, err
-	} else {
-		// check for headers to preserve
-		if ( upstream != nil ) {
-			if ( c.preserveHeaders != nil ) {
-				for _, k := range c.preserveHeaders {
-					h := upstream.Header.Get(k)
-					if ( len(h) > 0 ) {
-						// TODO = should this be Add or Set?  
-						req.Header.Add(k, h)
-					}
-				}
-			}
-		}
-		if len(contentType) > 0 {
-			req.Header.Set("Content-Type", contentType)
-		}
-		// log outbound request
-		logger.StdLogger.LOG(logger.INFO, getCorrelationId(req), fmt.Sprintf("outbound request %s", formatReqForLog(req)), nil)
-		return c.client.Do(req)
-	}
+// Put will create a PUT request to the specified url.  Parameters and returns are the same as Post
+func (c*HttpClient) Put(url string, data []byte, contentType string, upstream *http.Request) (*http.Response, error) {
+	return c.Do(upstreamContext(upstream), "PUT", url, data, &RequestOptions{Upstream: upstream, ContentType: contentType})
+}
 
-}
\ No newline at end of file
+// Patch will create a PATCH request to the specified url.  Parameters and returns are the same as Post
+func (c*HttpClient) Patch(url string, data []byte, contentType string, upstream *http.Request) (*http.Response, error) {
+	return c.Do(upstreamContext(upstream), "PATCH", url, data, &RequestOptions{Upstream: upstream, ContentType: contentType})
+}
+
+// Delete will create a DELETE request to the specified url.  Parameters and returns are the same as Get
+func (c *HttpClient) Delete(url string, upstream *http.Request) (*http.Response, error) {
+	return c.Do(upstreamContext(upstream), "DELETE", url, nil, &RequestOptions{Upstream: upstream})
+}
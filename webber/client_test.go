@@ -0,0 +1,427 @@
+package webber
+
+import (
+	"testing"
+	"time"
+	"context"
+	"net/http"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"jmh/goweb/logger"
+)
+
+/////////////////////////
+// Test globals and setup
+
+// discard logs, so test output isn't cluttered with them
+func init() {
+	logger.StdLogger = logger.NewNopLogger()
+}
+
+// newFlakyServer returns a server that responds with each of statuses in turn, then 200 after that,
+// and a counter of the calls it received
+func newFlakyServer(statuses []int, retryAfter string) (*httptest.Server, *int64) {
+	var calls int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&calls, 1)
+		if int(n) <= len(statuses) {
+			if len(retryAfter) > 0 {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	return ts, &calls
+}
+
+func newTestClient(retry *RetryPolicy, breaker *CircuitBreakerConfig) *HttpClient {
+	config := DefaultHttpClientConfig()
+	config.Timeout = 5 * time.Second
+	config.Retry = retry
+	config.Breaker = breaker
+	return NewHttpClientWithConfig(nil, config)
+}
+
+func fastRetryPolicy() *RetryPolicy {
+	p := DefaultRetryPolicy()
+	p.BaseDelay = time.Millisecond
+	p.MaxDelay = 10 * time.Millisecond
+	return p
+}
+
+/////////////////////////////////
+// Tests
+
+// GETs are retried until they succeed
+func TestRetryIdempotent(t *testing.T) {
+	ts, calls := newFlakyServer([]int{503, 502}, "")
+	defer ts.Close()
+	c := newTestClient(fastRetryPolicy(), nil)
+
+	resp, err := c.Get(ts.URL, nil)
+	if err != nil {
+		t.Fatalf("TestRetryIdempotent error %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || *calls != 3 {
+		t.Fatalf("TestRetryIdempotent expected 200 after 3 calls, got %d after %d", resp.StatusCode, *calls)
+	}
+	if stats := c.Stats(); stats.Retries != 2 || stats.Requests != 3 {
+		t.Fatalf("TestRetryIdempotent unexpected stats %+v", stats)
+	}
+}
+
+// POSTs are not retried by default
+func TestNoRetryNonIdempotent(t *testing.T) {
+	ts, calls := newFlakyServer([]int{503}, "")
+	defer ts.Close()
+	c := newTestClient(fastRetryPolicy(), nil)
+
+	resp, err := c.Post(ts.URL, []byte("{}"), "application/json", nil)
+	if err != nil {
+		t.Fatalf("TestNoRetryNonIdempotent error %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 || *calls != 1 {
+		t.Fatalf("TestNoRetryNonIdempotent expected 503 after 1 call, got %d after %d", resp.StatusCode, *calls)
+	}
+}
+
+// a Retry-After longer than MaxDelay is returned to the caller rather than waited on
+func TestRetryAfterTooLong(t *testing.T) {
+	ts, calls := newFlakyServer([]int{503}, "120")
+	defer ts.Close()
+	c := newTestClient(fastRetryPolicy(), nil)
+
+	resp, err := c.Get(ts.URL, nil)
+	if err != nil {
+		t.Fatalf("TestRetryAfterTooLong error %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 || *calls != 1 {
+		t.Fatalf("TestRetryAfterTooLong expected 503 after 1 call, got %d after %d", resp.StatusCode, *calls)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d, ok := parseRetryAfter("3"); !ok || d != 3*time.Second {
+		t.Fatalf("TestParseRetryAfter seconds, got %s %t", d, ok)
+	}
+	future := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(future); !ok || d <= 0 || d > time.Minute {
+		t.Fatalf("TestParseRetryAfter date, got %s %t", d, ok)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Fatalf("TestParseRetryAfter accepted an invalid value")
+	}
+}
+
+// the breaker opens after the failure threshold, short circuits, then closes after a good probe
+func TestCircuitBreaker(t *testing.T) {
+	ts, calls := newFlakyServer([]int{500, 500}, "")
+	defer ts.Close()
+	breaker := &CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: 50 * time.Millisecond, HalfOpenProbes: 1}
+	c := newTestClient(nil, breaker)
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(ts.URL, nil)
+		if err != nil {
+			t.Fatalf("TestCircuitBreaker error %s", err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := c.Get(ts.URL, nil); err != ErrCircuitOpen {
+		t.Fatalf("TestCircuitBreaker expected ErrCircuitOpen, got %v", err)
+	}
+	if *calls != 2 {
+		t.Fatalf("TestCircuitBreaker expected the open breaker to stop the call, server got %d calls", *calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	resp, err := c.Get(ts.URL, nil)
+	if err != nil {
+		t.Fatalf("TestCircuitBreaker probe error %s", err)
+	}
+	resp.Body.Close()
+	stats := c.Stats()
+	for host, state := range stats.Breakers {
+		if state != CircuitClosed {
+			t.Fatalf("TestCircuitBreaker expected %s to be closed after the probe, was %s", host, state)
+		}
+	}
+	if stats.ShortCircuits != 1 || stats.BreakerOpens != 1 {
+		t.Fatalf("TestCircuitBreaker unexpected stats %+v", stats)
+	}
+}
+
+// a config with no probes still recovers, using the default of one probe
+func TestCircuitBreakerZeroProbes(t *testing.T) {
+	ts, _ := newFlakyServer([]int{500}, "")
+	defer ts.Close()
+	c := newTestClient(nil, &CircuitBreakerConfig{FailureThreshold: 1, OpenDuration: 20 * time.Millisecond})
+
+	resp, err := c.Get(ts.URL, nil)
+	if err != nil {
+		t.Fatalf("TestCircuitBreakerZeroProbes error %s", err)
+	}
+	resp.Body.Close()
+	if _, err := c.Get(ts.URL, nil); err != ErrCircuitOpen {
+		t.Fatalf("TestCircuitBreakerZeroProbes expected ErrCircuitOpen, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	resp, err = c.Get(ts.URL, nil)
+	if err != nil {
+		t.Fatalf("TestCircuitBreakerZeroProbes probe error %s", err)
+	}
+	resp.Body.Close()
+	for host, state := range c.Stats().Breakers {
+		if state != CircuitClosed {
+			t.Fatalf("TestCircuitBreakerZeroProbes expected %s to be closed after the probe, was %s", host, state)
+		}
+	}
+}
+
+// requests the caller cancels aren't failures of the host, but the client's own timeouts are
+func TestCircuitBreakerCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+	c := newTestClient(nil, &CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: time.Minute, HalfOpenProbes: 1})
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Millisecond)
+		if _, err := c.Do(ctx, "GET", ts.URL, nil, nil); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("TestCircuitBreakerCancel expected the caller's deadline, got %v", err)
+		}
+		cancel()
+	}
+	if stats := c.Stats(); stats.Failures != 0 || stats.BreakerOpens != 0 {
+		t.Fatalf("TestCircuitBreakerCancel expected no failures, got %+v", stats)
+	}
+
+	for i := 0; i < 2; i++ {
+		c.Do(context.Background(), "GET", ts.URL, nil, &RequestOptions{Timeout: 5 * time.Millisecond})
+	}
+	if _, err := c.Get(ts.URL, nil); err != ErrCircuitOpen {
+		t.Fatalf("TestCircuitBreakerCancel expected timeouts to open the breaker, got %v", err)
+	}
+}
+
+// DefaultHttpClientConfig sets a timeout, a small idle pool and retries, and NewHttpClient uses it
+func TestDefaultHttpClientConfig(t *testing.T) {
+	config := DefaultHttpClientConfig()
+	if config.Timeout != 30 * time.Second || config.MaxIdleConns != 10 || config.IdleConnTimeout != 30 * time.Second ||
+			!config.DisableCompression || config.Retry == nil || config.Breaker != nil || config.Cache != nil {
+		t.Fatalf("TestDefaultHttpClientConfig unexpected config %+v", config)
+	}
+	c := NewHttpClient(nil)
+	if c.timeout != config.Timeout || c.transport.MaxIdleConns != config.MaxIdleConns ||
+			c.transport.IdleConnTimeout != config.IdleConnTimeout || !c.transport.DisableCompression || c.retry == nil {
+		t.Fatalf("TestDefaultHttpClientConfig expected NewHttpClient to use the default config")
+	}
+}
+
+// Put, Patch and Delete send their method, body and content type, with headers preserved from upstream
+func TestClientMethods(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r.Method + " " + string(body) + " " + r.Header.Get("Content-Type") + " " + r.Header.Get(CORRELATION_ID_HEADER))
+	}))
+	defer ts.Close()
+	c := newTestClient(nil, nil)
+	upstream := httptest.NewRequest("GET", "/hikes", nil)
+	upstream.Header.Set(CORRELATION_ID_HEADER, "abc123")
+
+	calls := []func() (*http.Response, error){
+		func() (*http.Response, error) { return c.Put(ts.URL, []byte("put"), "text/plain", upstream) },
+		func() (*http.Response, error) { return c.Patch(ts.URL, []byte("patch"), "application/json", upstream) },
+		func() (*http.Response, error) { return c.Delete(ts.URL, upstream) },
+		func() (*http.Response, error) {
+			return c.Do(context.Background(), "OPTIONS", ts.URL, nil, &RequestOptions{Upstream: upstream, ContentType: "text/csv"})
+		},
+	}
+	for _, call := range calls {
+		resp, err := call()
+		if err != nil {
+			t.Fatalf("TestClientMethods error %s", err)
+		}
+		resp.Body.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"PUT put text/plain abc123", "PATCH patch application/json abc123", "DELETE   abc123", "OPTIONS  text/csv abc123"}
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Fatalf("TestClientMethods expected %q, got %q", want, got)
+		}
+	}
+}
+
+// RequestOptions.Timeout overrides the client's timeout, either way
+func TestClientTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	config := DefaultHttpClientConfig()
+	config.Retry = nil
+	config.Timeout = 20 * time.Millisecond
+	short := NewHttpClientWithConfig(nil, config)
+	if _, err := short.Get(ts.URL, nil); err == nil {
+		t.Fatalf("TestClientTimeout expected the client's timeout")
+	}
+	resp, err := short.Do(context.Background(), "GET", ts.URL, nil, &RequestOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("TestClientTimeout expected the request's timeout to override the client's, got %s", err)
+	}
+	resp.Body.Close()
+
+	config.Timeout = time.Second
+	long := NewHttpClientWithConfig(nil, config)
+	if _, err := long.Do(context.Background(), "GET", ts.URL, nil, &RequestOptions{Timeout: 20 * time.Millisecond}); err == nil {
+		t.Fatalf("TestClientTimeout expected the request's shorter timeout")
+	}
+}
+
+// cancelling the upstream request stops the response body being read
+func TestClientUpstreamCancel(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	c := newTestClient(nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	upstream := httptest.NewRequest("GET", "/hikes", nil).WithContext(ctx)
+	resp, err := c.Get(ts.URL, upstream)
+	if err != nil {
+		t.Fatalf("TestClientUpstreamCancel error %s", err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("TestClientUpstreamCancel expected the first chunk, got %q %v", buf, err)
+	}
+
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("TestClientUpstreamCancel expected reading the body to fail once upstream was cancelled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("TestClientUpstreamCancel still reading the body after upstream was cancelled")
+	}
+}
+
+// GetJson decodes success bodies, and turns ReturnError bodies into an HttpError
+func TestGetJson(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			ReturnError(w, r, http.StatusNotFound, "no such hike")
+			return
+		}
+		ReturnJson(w, map[string]int{"length": 12})
+	}))
+	defer ts.Close()
+	c := newTestClient(nil, nil)
+
+	var result struct{ Length int `json:"length"` }
+	if err := c.GetJson(ts.URL+"/found", &result, nil); err != nil || result.Length != 12 {
+		t.Fatalf("TestGetJson expected length 12, got %d, err %v", result.Length, err)
+	}
+
+	err := c.GetJson(ts.URL+"/missing", &result, nil)
+	herr, ok := err.(*HttpError)
+	if !ok {
+		t.Fatalf("TestGetJson expected an HttpError, got %v", err)
+	}
+	if herr.Status != http.StatusNotFound || herr.Message != "no such hike" || len(herr.CorrelationId) == 0 {
+		t.Fatalf("TestGetJson unexpected error %+v", herr)
+	}
+
+	// the caller's options can be reused, DoJson doesn't change them
+	opts := &RequestOptions{Headers: http.Header{"X-Hike": []string{"rainier"}}}
+	if err := c.DoJson(context.Background(), "POST", ts.URL+"/found", result, &result, opts); err != nil {
+		t.Fatalf("TestGetJson DoJson failed: %s", err)
+	}
+	if len(opts.ContentType) > 0 || len(opts.Headers) != 1 {
+		t.Fatalf("TestGetJson expected the options to be unchanged, got %+v", opts)
+	}
+}
+
+// fresh responses are served from the cache, stale ones are revalidated with their ETag
+func TestResponseCache(t *testing.T) {
+	var calls, notModified int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Header().Set("ETag", "\"v1\"")
+		if r.URL.Path == "/fresh" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if r.Header.Get("If-None-Match") == "\"v1\"" {
+			atomic.AddInt64(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hike data"))
+	}))
+	defer ts.Close()
+	config := DefaultHttpClientConfig()
+	config.Cache = NewLRUResponseCache(1024 * 1024)
+	c := NewHttpClientWithConfig(nil, config)
+
+	for _, path := range []string{"/fresh", "/revalidate"} {
+		for i := 0; i < 2; i++ {
+			resp, err := c.Get(ts.URL + path, nil)
+			if err != nil {
+				t.Fatalf("TestResponseCache error %s", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 || string(body) != "hike data" {
+				t.Fatalf("TestResponseCache %s got %d %q", path, resp.StatusCode, body)
+			}
+		}
+	}
+	stats := c.Stats()
+	if calls != 3 || notModified != 1 || stats.CacheHits != 1 || stats.CacheRevalidations != 1 || stats.CacheMisses != 2 {
+		t.Fatalf("TestResponseCache expected 3 calls and 1 304, got %d and %d, stats %+v", calls, notModified, stats)
+	}
+
+	// a POST to the url invalidates it
+	resp, err := c.Post(ts.URL + "/fresh", []byte("{}"), "application/json", nil)
+	if err != nil {
+		t.Fatalf("TestResponseCache post error %s", err)
+	}
+	resp.Body.Close()
+	if _, ok := config.Cache.Get(responseCacheKey(ts.URL + "/fresh")); ok {
+		t.Fatalf("TestResponseCache expected the POST to invalidate the cached GET")
+	}
+}
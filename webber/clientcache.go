@@ -0,0 +1,440 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"io"
+	"io/ioutil"
+	"bytes"
+	"sync"
+	"time"
+	"context"
+	"strings"
+	"strconv"
+	"net/http"
+	"sync/atomic"
+	"container/list"
+	"encoding/json"
+	"jmh/goweb/wtmcache"
+)
+
+// the largest response body HttpClient will cache
+const maxCachedBody = 1024 * 1024
+
+// CachedResponse is a response stored by HttpClient's response cache
+type CachedResponse struct {
+	Status int						`json:"status"`
+	Header http.Header				`json:"header"`
+	Body []byte						`json:"body"`
+	Expires time.Time				`json:"expires"`	// the response is fresh until then
+	Vary map[string]string			`json:"vary"`		// the request headers named by Vary, and the values they had
+}
+
+// ResponseCache is the interface for the stores HttpClient keeps cached responses in
+//
+//	Get : returns the response cached under key, if there is one
+//	Set : caches a response under key, replacing any already there
+//	Delete : removes the response cached under key
+type ResponseCache interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+}
+
+// responseCacheKey is the key a GET of url is cached under
+func responseCacheKey(url string) string {
+	return "GET " + url
+}
+
+// isSafeMethod returns true for methods that don't change the resource
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS" || method == "TRACE"
+}
+
+// parseCacheControl splits a Cache-Control header into its directives, lower cased
+func parseCacheControl(h string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(h, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		k := strings.ToLower(strings.TrimSpace(kv[0]))
+		v := ""
+		if len(kv) == 2 {
+			v = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		}
+		cc[k] = v
+	}
+	return cc
+}
+
+// freshUntil works out how long a response may be served from the cache, following RFC 7234 for a
+// shared cache.  Returns false if the response must not be stored at all.
+func freshUntil(reqHeader http.Header, resp *http.Response, now time.Time) (time.Time, bool) {
+	if resp.StatusCode != http.StatusOK {
+		return now, false
+	}
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return now, false
+	}
+	if _, ok := cc["private"]; ok {
+		// we're a shared cache, since we cache on behalf of every upstream caller
+		return now, false
+	}
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return now, false
+	}
+	_, public := cc["public"]
+	_, sMaxAge := cc["s-maxage"]
+	if len(reqHeader.Get("Authorization")) > 0 && !public && !sMaxAge {
+		return now, false
+	}
+
+	hasValidator := len(resp.Header.Get("ETag")) > 0 || len(resp.Header.Get("Last-Modified")) > 0
+	if _, ok := cc["no-cache"]; ok {
+		// may be stored, but has to be revalidated every time
+		return now, hasValidator
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs < 0 {
+				secs = 0
+			}
+			age, _ := strconv.Atoi(resp.Header.Get("Age"))
+			return now.Add(time.Duration(secs - age) * time.Second), true
+		}
+	}
+	if exp := resp.Header.Get("Expires"); len(exp) > 0 {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			// an invalid Expires means already expired
+			return now, hasValidator
+		}
+		if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			// use the server's clock to work out how long it is fresh for
+			return now.Add(t.Sub(date)), true
+		}
+		return t, true
+	}
+	// no freshness information, but we can still revalidate it
+	return now, hasValidator
+}
+
+// varyValues returns the values of the request headers named by the response's Vary header
+func varyValues(vary string, reqHeader http.Header) map[string]string {
+	values := make(map[string]string)
+	for _, h := range strings.Split(vary, ",") {
+		h = strings.TrimSpace(h)
+		if len(h) > 0 {
+			values[http.CanonicalHeaderKey(h)] = reqHeader.Get(h)
+		}
+	}
+	return values
+}
+
+// matches returns true if the request has the same values for the Vary headers as the one that
+// got the cached response
+func (e *CachedResponse) matches(reqHeader http.Header) bool {
+	for h, v := range e.Vary {
+		if reqHeader.Get(h) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// response builds an http.Response for the cached entry
+func (e *CachedResponse) response(req *http.Request) *http.Response {
+	resp := &http.Response{
+		Status: strconv.Itoa(e.Status) + " " + http.StatusText(e.Status),
+		StatusCode: e.Status,
+		Proto: "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: e.Header.Clone(),
+		Body: ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request: req,
+	}
+	return resp
+}
+
+// size is roughly how much memory the entry uses
+func (e *CachedResponse) size() int64 {
+	n := int64(len(e.Body))
+	for k, vv := range e.Header {
+		n += int64(len(k))
+		for _, v := range vv {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// doCached answers a GET from the cache if it can, revalidating stale entries that have a
+// validator, and stores cacheable responses
+func (c *HttpClient) doCached(ctx context.Context, url string, opts *RequestOptions) (*http.Response, error) {
+	reqHeader := make(http.Header)
+	c.setHeaders(reqHeader, opts)
+	reqCC := parseCacheControl(reqHeader.Get("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok {
+		return c.send(ctx, "GET", url, nil, opts)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = reqHeader
+
+	key := responseCacheKey(url)
+	entry, ok := c.cache.Get(key)
+	if ok && !entry.matches(reqHeader) {
+		ok = false
+	}
+	_, noCache := reqCC["no-cache"]
+	if ok && !noCache && time.Now().Before(entry.Expires) {
+		atomic.AddInt64(&c.cacheHits, 1)
+		return entry.response(req), nil
+	}
+
+	sendOpts := opts
+	if ok {
+		// see if what we have is still good
+		etag := entry.Header.Get("ETag")
+		lastModified := entry.Header.Get("Last-Modified")
+		if len(etag) > 0 || len(lastModified) > 0 {
+			copied := *opts
+			copied.Headers = opts.Headers.Clone()
+			if copied.Headers == nil {
+				copied.Headers = make(http.Header)
+			}
+			if len(etag) > 0 {
+				copied.Headers.Set("If-None-Match", etag)
+			}
+			if len(lastModified) > 0 {
+				copied.Headers.Set("If-Modified-Since", lastModified)
+			}
+			sendOpts = &copied
+		}
+	}
+
+	resp, err := c.send(ctx, "GET", url, nil, sendOpts)
+	if err != nil {
+		return nil, err
+	}
+	if ok && resp.StatusCode == http.StatusNotModified {
+		drainAndClose(resp.Body)
+		// take the updated headers from the 304, and store it again with its new freshness
+		for k, v := range resp.Header {
+			entry.Header[k] = v
+		}
+		if expires, cacheable := freshUntil(reqHeader, &http.Response{StatusCode: entry.Status, Header: entry.Header}, time.Now()); cacheable {
+			entry.Expires = expires
+			c.cache.Set(key, entry)
+		}
+		atomic.AddInt64(&c.cacheRevalidations, 1)
+		return entry.response(req), nil
+	}
+	atomic.AddInt64(&c.cacheMisses, 1)
+
+	expires, cacheable := freshUntil(reqHeader, resp, time.Now())
+	if !cacheable || resp.ContentLength > maxCachedBody {
+		if ok {
+			c.cache.Delete(key)
+		}
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCachedBody + 1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > maxCachedBody {
+		// too big to cache, hand back what we read along with the rest
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), closer: resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.cache.Set(key, &CachedResponse{Status: resp.StatusCode, Header: resp.Header.Clone(), Body: body, Expires: expires,
+		Vary: varyValues(resp.Header.Get("Vary"), reqHeader)})
+	return resp, nil
+}
+
+// multiReadCloser reads from Reader and closes closer
+type multiReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (m *multiReadCloser) Close() error {
+	return m.closer.Close()
+}
+
+///////////////////////////////////////////////////
+// In memory LRU cache
+//
+
+// LRUResponseCache is an in memory ResponseCache that evicts the least recently used responses
+// once the cached bodies and headers pass a size limit
+type LRUResponseCache struct {
+	mu sync.Mutex
+	maxBytes int64
+	curBytes int64
+	order *list.List					// front is the most recently used
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	resp *CachedResponse
+}
+
+// NewLRUResponseCache creates an LRUResponseCache holding up to maxBytes of responses
+//
+// Parameters:
+//	maxBytes : the size limit of the cache
+//
+// Returns:
+//	*LRUResponseCache : the cache created
+//
+func NewLRUResponseCache(maxBytes int64) *LRUResponseCache {
+	c := new(LRUResponseCache)
+	c.maxBytes = maxBytes
+	c.order = list.New()
+	c.entries = make(map[string]*list.Element)
+	return c
+}
+
+func (c *LRUResponseCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	// hand back a copy so the caller can update it without racing other readers
+	e := *el.Value.(*lruEntry).resp
+	e.Header = e.Header.Clone()
+	return &e, true
+}
+
+func (c *LRUResponseCache) Set(key string, resp *CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	size := resp.size()
+	if size > c.maxBytes {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, resp: resp})
+	c.curBytes += size
+	for c.curBytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRUResponseCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Size returns the number of responses and the bytes they use
+func (c *LRUResponseCache) Size() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.curBytes
+}
+
+// remove takes an element out of the cache.  Must hold c.mu
+func (c *LRUResponseCache) remove(el *list.Element) {
+	e := el.Value.(*lruEntry)
+	c.order.Remove(el)
+	delete(c.entries, e.key)
+	c.curBytes -= e.resp.size()
+}
+
+///////////////////////////////////////////////////
+// wtmcache backed cache
+//
+
+// cachedResponseDocument is how a response is stored in the collection
+type cachedResponseDocument struct {
+	Key string		`json:"key"`
+	Data []byte		`json:"data"`		// the json of the CachedResponse
+}
+
+// CollectionResponseCache is a ResponseCache kept in a wtmcache collection, so it is shared by
+// everything using the db, and survives restarts
+type CollectionResponseCache struct {
+	coll *wtmcache.Collection
+}
+
+// NewCollectionResponseCache creates a CollectionResponseCache in the named collection of cDb
+//
+// Parameters:
+//	cDb : the db to create the collection in
+//	collName : the name of the collection used for the cache
+//
+// Returns:
+//	*CollectionResponseCache : the cache created
+//
+func NewCollectionResponseCache(cDb *wtmcache.Db, collName string) *CollectionResponseCache {
+	c := new(CollectionResponseCache)
+	c.coll = cDb.NewCollection(collName, "key", 10*time.Minute, 10*time.Minute)
+	return c
+}
+
+func (c *CollectionResponseCache) Get(key string) (*CachedResponse, bool) {
+	var docTemplate cachedResponseDocument
+	doc, err := c.coll.Read(key, &docTemplate)
+	if err != nil {
+		return nil, false
+	}
+	resp := new(CachedResponse)
+	if json.Unmarshal(doc.(*cachedResponseDocument).Data, resp) != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+func (c *CollectionResponseCache) Set(key string, resp *CachedResponse) {
+	data, err := json.Marshal(resp)
+	if err == nil {
+		c.coll.Write(cachedResponseDocument{Key: key, Data: data})
+	}
+}
+
+func (c *CollectionResponseCache) Delete(key string) {
+	c.coll.Delete(key)
+}
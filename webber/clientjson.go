@@ -0,0 +1,162 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"context"
+	"strings"
+	"net/http"
+	"encoding/json"
+)
+
+// the most we will read of an error body that isn't an ErrorResponse
+const maxErrorBody = 4096
+
+// HttpError is returned by the HttpClient json helpers when the response status is not 2xx
+type HttpError struct {
+	Status int				// the http status of the response
+	Message string			// the message from the ErrorResponse, or the start of the body if it wasn't one
+	CorrelationId string	// the correlation id of the failed call
+}
+
+func (e *HttpError) Error() string {
+	return fmt.Sprintf("http status %d: %s (correlation id %s)", e.Status, e.Message, e.CorrelationId)
+}
+
+// decodeHttpError builds an HttpError from a non-2xx response
+func decodeHttpError(resp *http.Response) *HttpError {
+	e := &HttpError{Status: resp.StatusCode}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var er ErrorResponse
+	if json.Unmarshal(body, &er) == nil && len(er.Message) > 0 {
+		e.Message = er.Message
+		e.CorrelationId = er.CorrelationId
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if len(e.Message) == 0 {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	if len(e.CorrelationId) == 0 {
+		e.CorrelationId = resp.Header.Get(CORRELATION_ID_HEADER)
+	}
+	if len(e.CorrelationId) == 0 && resp.Request != nil {
+		e.CorrelationId = resp.Request.Header.Get(CORRELATION_ID_HEADER)
+	}
+	return e
+}
+
+// drainAndClose reads whatever is left of the body, so the connection can be reused, and closes it
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, 64*1024))
+	body.Close()
+}
+
+// DoJson makes a request with a json body and decodes the json response into result.  The
+// response body is always drained and closed.
+//
+// Parameters:
+//	ctx :	the context for the request, see Do
+//	method : the http method, e.g. "PUT"
+//	url : 	the destination url, including any query parameters
+//	data :	(optional) a struct marshalled to json as the request body
+//	result : (optional) a pointer to a struct the response body is decoded into
+//	opts :	(optional) the RequestOptions for this request
+//
+// Returns:
+//	error : an *HttpError if the status was not 2xx, otherwise any error making the request or
+//			marshalling/unmarshalling json
+//
+func (c *HttpClient) DoJson(ctx context.Context, method string, url string, data interface{}, result interface{}, opts *RequestOptions) error {
+	// a copy, so callers can reuse their options
+	copied := RequestOptions{}
+	if opts != nil {
+		copied = *opts
+	}
+	opts = &copied
+	var body []byte
+	if data != nil {
+		var err error
+		body, err = json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		opts.ContentType = "application/json"
+	}
+	opts.Headers = opts.Headers.Clone()
+	if opts.Headers == nil {
+		opts.Headers = make(http.Header)
+	}
+	opts.Headers.Set("Accept", "application/json")
+
+	resp, err := c.Do(ctx, method, url, body, opts)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeHttpError(resp)
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// GetJson GETs url and decodes the json response into result
+//
+// Parameters:
+//	url : 	the destination url to fetch, including any query parameters
+//	result : a pointer to a struct the response body is decoded into
+//	upstream : (optional) an upstream request that we should preserve information (such as headers, sessions, etc) from
+//
+// Returns:
+//	error : an *HttpError if the status was not 2xx, or any other error making the call
+//
+func (c *HttpClient) GetJson(url string, result interface{}, upstream *http.Request) error {
+	return c.DoJson(upstreamContext(upstream), "GET", url, nil, result, &RequestOptions{Upstream: upstream})
+}
+
+// PostJson POSTs data marshalled as json to url and decodes the json response into result
+//
+// Parameters:
+//	url : 	the destination url, including any query parameters
+//	data :	a struct marshalled to json as the request body
+//	result : (optional) a pointer to a struct the response body is decoded into
+//	upstream : (optional) an upstream request that we should preserve information (such as headers, sessions, etc) from
+//
+// Returns:
+//	error : an *HttpError if the status was not 2xx, or any other error making the call
+//
+func (c *HttpClient) PostJson(url string, data interface{}, result interface{}, upstream *http.Request) error {
+	return c.DoJson(upstreamContext(upstream), "POST", url, data, result, &RequestOptions{Upstream: upstream})
+}
+
+// PutJson PUTs data marshalled as json to url.  Parameters and returns are the same as PostJson
+func (c *HttpClient) PutJson(url string, data interface{}, result interface{}, upstream *http.Request) error {
+	return c.DoJson(upstreamContext(upstream), "PUT", url, data, result, &RequestOptions{Upstream: upstream})
+}
@@ -0,0 +1,210 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"net/http"
+	"jmh/goweb/logger"
+)
+
+// CORSConfig says which other origins browsers may call a handler from
+type CORSConfig struct {
+	AllowedOrigins []string		// e.g. "https://hikes.example.com", "https://*.example.com" for any subdomain, or "*"
+	AllowedMethods []string		// methods allowed in preflights.  Default is GET and POST
+	AllowedHeaders []string		// request headers allowed in preflights, "*" for any.  Default is none beyond the simple ones
+	ExposedHeaders []string		// response headers scripts may read, e.g. "correlation-id"
+	AllowCredentials bool		// allow cookies and auth headers to be sent.  Only from origins listed by name, never "*"
+	MaxAge int					// seconds browsers may cache a preflight result, 0 for the browser default
+}
+
+// AllowsOrigin returns true if origin matches one of the AllowedOrigins
+func (c *CORSConfig) AllowsOrigin(origin string) bool {
+	return c.isWildcard() || c.listsOrigin(origin)
+}
+
+// listsOrigin returns true if origin matches one of the AllowedOrigins other than "*"
+func (c *CORSConfig) listsOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o != "*" && strings.EqualFold(o, origin) {
+			return true
+		}
+		// https://*.example.com matches any subdomain of example.com, but not example.com itself
+		if i := strings.Index(o, "://*."); i >= 0 {
+			scheme := o[:i + 3]
+			suffix := o[i + 4:]
+			lower := strings.ToLower(origin)
+			if strings.HasPrefix(lower, strings.ToLower(scheme)) && strings.HasSuffix(lower, strings.ToLower(suffix)) &&
+					len(lower) > len(scheme) + len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *CORSConfig) allowsMethod(method string) bool {
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{"GET", "POST"}
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORSConfig) allowsHeader(header string) bool {
+	for _, h := range c.AllowedHeaders {
+		if h == "*" || strings.EqualFold(h, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWildcard returns true if any origin is allowed
+func (c *CORSConfig) isWildcard() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// setOriginHeaders sets the headers common to preflight and actual responses.  Credentials are
+// only allowed for origins listed by name: allowing them for "*" would let any site read the
+// responses a user's cookies get them.
+func (c *CORSConfig) setOriginHeaders(w http.ResponseWriter, origin string) {
+	if c.AllowCredentials && c.listsOrigin(origin) {
+		// credentials can't be used with *, so echo the origin back
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else if c.isWildcard() {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+}
+
+// warnWildcardCredentials logs a warning if the config allows credentials and "*", as credentials
+// aren't allowed for origins that only match "*"
+func (c *CORSConfig) warnWildcardCredentials(where string) {
+	if c != nil && c.AllowCredentials && c.isWildcard() {
+		logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("CORS config for %s allows credentials and any origin; credentials will only be allowed for the origins listed by name", where), nil)
+	}
+}
+
+// Handle applies the CORS rules to a request.  Preflight requests are answered (204 if allowed,
+// 403 if not) and Handle returns false; for other requests it sets the response headers for an
+// allowed origin and returns true.
+//
+// Parameters:
+//	w : the response writer
+//	r : the request
+//
+// Returns:
+//	bool : true if the request should continue to the handler
+//
+func (c *CORSConfig) Handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		// not a cross origin request
+		return true
+	}
+	reqMethod := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != "OPTIONS" || len(reqMethod) == 0 {
+		if c.AllowsOrigin(origin) {
+			c.setOriginHeaders(w, origin)
+			if len(c.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+			}
+		}
+		return true
+	}
+
+	// preflight
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	if !c.AllowsOrigin(origin) || !c.allowsMethod(reqMethod) {
+		GetLogger(r).LOG(logger.WARN, fmt.Sprintf("CORS preflight denied for %s %s from %s", reqMethod, r.URL.Path, origin), nil)
+		ReturnError(w, r, http.StatusForbidden, "Cross origin request not allowed")
+		return false
+	}
+	var headers []string
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		h = strings.TrimSpace(h)
+		if len(h) == 0 {
+			continue
+		}
+		if !c.allowsHeader(h) {
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("CORS preflight denied header %s for %s from %s", h, r.URL.Path, origin), nil)
+			ReturnError(w, r, http.StatusForbidden, "Cross origin request header not allowed: " + h)
+			return false
+		}
+		headers = append(headers, h)
+	}
+
+	c.setOriginHeaders(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", reqMethod)
+	if len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
+
+// WithCORS sets the CORS rules for the handler, overriding ServerConfig.CORS.  Pass an empty
+// CORSConfig to turn CORS off for the handler.
+func WithCORS(config *CORSConfig) HandlerOption {
+	config.warnWildcardCredentials("a handler")
+	return func(o *handlerOptions) {
+		o.cors = config
+	}
+}
+
+// corsMiddleware applies the handler's CORS rules, or the server's if it doesn't have its own
+func (h *AppServer) corsMiddleware() Middleware {
+	return func(handler WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			config := h.Config.CORS
+			if opts, ok := h.handlerOpts[handler.BasePath()]; ok && opts.cors != nil {
+				config = opts.cors
+			}
+			if config == nil || config.Handle(w, r) {
+				next(w, r)
+			}
+		}
+	}
+}
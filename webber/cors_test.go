@@ -0,0 +1,78 @@
+package webber
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+// preflights are answered for allowed origins before other middleware runs, and handlers can
+// override the server's rules
+func TestCORS(t *testing.T) {
+	config := DefaultConfig()
+	config.WWWRoot = ""
+	config.CORS = &CORSConfig{AllowedOrigins: []string{"https://*.example.com"}, AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Content-Type"}, AllowCredentials: true, MaxAge: 600}
+	as := NewAppServer(config)
+	as.Use(func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if len(r.Header.Get(API_KEY_HEADER)) == 0 {
+				ReturnError(w, r, http.StatusUnauthorized, "no api key")
+				return
+			}
+			next(w, r)
+		}
+	})
+	as.RegisterHandler(&traceHandler{})
+	// credentials are never allowed for "*", only for origins listed by name
+	public := &CORSConfig{AllowedOrigins: []string{"https://partner.org", "*"}, AllowCredentials: true}
+	as.RegisterHandler(&routeHandler{}, WithCORS(public))
+
+	send := func(method string, path string, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Origin", origin)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		as.Handler(w, r)
+		return w
+	}
+
+	preflight := map[string]string{"Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "content-type"}
+	w := send("OPTIONS", "/trace/x", "https://app.example.com", preflight)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+			w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Max-Age") != "600" ||
+			w.Header().Get("Access-Control-Allow-Headers") != "content-type" {
+		t.Fatalf("TestCORS expected an allowed preflight, got %d %v", w.Code, w.Header())
+	}
+	for _, origin := range []string{"https://example.com", "http://app.example.com", "https://evil.com"} {
+		if w := send("OPTIONS", "/trace/x", origin, preflight); w.Code != http.StatusForbidden {
+			t.Fatalf("TestCORS expected %s to be denied, got %d", origin, w.Code)
+		}
+	}
+	preflight["Access-Control-Request-Method"] = "DELETE"
+	if w := send("OPTIONS", "/trace/x", "https://app.example.com", preflight); w.Code != http.StatusForbidden {
+		t.Fatalf("TestCORS expected DELETE to be denied, got %d", w.Code)
+	}
+
+	// actual requests get the origin headers, and still go through the other middleware
+	w = send("GET", "/trace/x", "https://app.example.com", nil)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatalf("TestCORS expected a 401 with CORS headers, got %d %v", w.Code, w.Header())
+	}
+
+	// the handler's own rules
+	w = send("OPTIONS", "/hike/x", "https://anywhere.org", map[string]string{"Access-Control-Request-Method": "GET"})
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "*" || len(w.Header().Get("Access-Control-Allow-Credentials")) > 0 {
+		t.Fatalf("TestCORS expected the handler's wildcard rule, without credentials, got %d %v", w.Code, w.Header())
+	}
+	w = send("POST", "/hike/x", "null", nil)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || len(w.Header().Get("Access-Control-Allow-Credentials")) > 0 {
+		t.Fatalf("TestCORS expected the null origin not to get credentials, got %v", w.Header())
+	}
+	w = send("OPTIONS", "/hike/x", "https://partner.org", map[string]string{"Access-Control-Request-Method": "GET"})
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://partner.org" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("TestCORS expected the listed origin to get credentials, got %v", w.Header())
+	}
+}
@@ -0,0 +1,305 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"context"
+	"runtime"
+	"net/http"
+	"runtime/debug"
+	"jmh/goweb/logger"
+	"jmh/goweb/wtmcache"
+)
+
+// HealthCheck checks one thing the service depends on, returning an error if it isn't healthy.  It
+// should give up when ctx is done.
+type HealthCheck func(ctx context.Context) error
+
+// CheckResult is the outcome of one HealthCheck
+type CheckResult struct {
+	Status string			`json:"status"`			// "ok" or "fail"
+	LatencyMs float64		`json:"latency_ms"`
+	Error string			`json:"error,omitempty"`
+}
+
+// HealthReport is the json returned by /healthz and /readyz
+type HealthReport struct {
+	Status string						`json:"status"`		// "ok" if every check passed, otherwise "fail"
+	Checks map[string]CheckResult		`json:"checks"`
+}
+
+// BuildInfo is the json returned by /version
+type BuildInfo struct {
+	AppName string			`json:"app_name"`
+	AppVersion string		`json:"app_version"`
+	GoVersion string		`json:"go_version"`
+	Revision string			`json:"vcs_revision,omitempty"`
+	RevisionTime string		`json:"vcs_time,omitempty"`
+	Modified bool			`json:"vcs_modified,omitempty"`
+}
+
+type namedCheck struct {
+	name string
+	check HealthCheck
+}
+
+// Health holds the liveness and readiness checks for a service.  Liveness checks (/healthz) should
+// only fail if the process needs restarting; readiness checks (/readyz) fail while a dependency is
+// unavailable, so the service is taken out of rotation until it recovers.
+type Health struct {
+	Timeout time.Duration		// how long each check may take, default 5 seconds
+
+	mu sync.Mutex
+	liveness []namedCheck
+	readiness []namedCheck
+}
+
+// NewHealth creates a Health with no checks
+func NewHealth() *Health {
+	h := new(Health)
+	h.Timeout = 5 * time.Second
+	return h
+}
+
+// AddLivenessCheck adds a check to /healthz.  Returns h so calls can be chained.
+func (h *Health) AddLivenessCheck(name string, check HealthCheck) *Health {
+	h.mu.Lock()
+	h.liveness = append(h.liveness, namedCheck{name, check})
+	h.mu.Unlock()
+	return h
+}
+
+// AddReadinessCheck adds a check to /readyz.  Returns h so calls can be chained.
+func (h *Health) AddReadinessCheck(name string, check HealthCheck) *Health {
+	h.mu.Lock()
+	h.readiness = append(h.readiness, namedCheck{name, check})
+	h.mu.Unlock()
+	return h
+}
+
+// run runs the checks concurrently, each with the timeout, and reports the results
+func (h *Health) run(ctx context.Context, checks []namedCheck) HealthReport {
+	report := HealthReport{Status: "ok", Checks: make(map[string]CheckResult)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c namedCheck) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, h.Timeout)
+			defer cancel()
+			start := time.Now()
+			err := runCheck(cctx, c.check)
+			result := CheckResult{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			report.Checks[c.name] = result
+			if err != nil {
+				report.Status = "fail"
+			}
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+// runCheck runs check, returning ctx's error if the check doesn't return in time (for checks
+// that can't be cancelled, like a mongo ping)
+func runCheck(ctx context.Context, check HealthCheck) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check runs the liveness or readiness checks
+//
+// Parameters:
+//	ctx : the context of the request asking
+//	ready : true for the readiness checks, false for liveness
+//
+// Returns:
+//	HealthReport : the results
+//
+func (h *Health) Check(ctx context.Context, ready bool) HealthReport {
+	h.mu.Lock()
+	checks := h.liveness
+	if ready {
+		checks = h.readiness
+	}
+	h.mu.Unlock()
+	return h.run(ctx, checks)
+}
+
+// ReadBuildInfo returns the app name and version from config, and the go version and version
+// control info (if the binary was built from a repository) from the binary's build info
+func ReadBuildInfo(config *ServerConfig) BuildInfo {
+	info := BuildInfo{AppName: config.AppName, AppVersion: config.AppVersion, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Revision = s.Value
+			case "vcs.time":
+				info.RevisionTime = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+///////////////////////////////////////////////////
+// Handlers
+//
+
+// healthHandler serves /healthz, /readyz or /version
+type healthHandler struct {
+	basePath string
+	name string
+	get func(r *http.Request) (interface{}, bool)
+}
+
+func (h healthHandler) Name() string {
+	return h.name
+}
+
+func (h healthHandler) BasePath() string {
+	return h.basePath
+}
+
+func (h healthHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.get(r)
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	ReturnJson(w, body)
+}
+
+func (h healthHandler) HandlePost(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+}
+
+// EnableHealth registers /healthz and /readyz, which run health's liveness and readiness checks and
+// return 200 if they all pass or 503 if any fail, and /version, which returns the BuildInfo.  They
+// skip the AppServer's middleware so probes don't need credentials.
+//
+// Parameters:
+//	health : the checks to run
+//
+// Returns:
+//	none
+//
+// Example:
+//	health := webber.NewHealth().AddReadinessCheck("mongo", webber.MongoCheck(cDb))
+//	as.EnableHealth(health)
+//
+func (h *AppServer) EnableHealth(health *Health) {
+	probe := func(name string, path string, ready bool) {
+		h.RegisterHandler(healthHandler{basePath: path, name: name, get: func(r *http.Request) (interface{}, bool) {
+			report := health.Check(r.Context(), ready)
+			if report.Status != "ok" {
+				GetLogger(r).LOG(logger.WARN, fmt.Sprintf("%s check failed: %+v", name, report.Checks), nil)
+			}
+			return report, report.Status == "ok"
+		}}, WithoutServerMiddleware())
+	}
+	probe("Healthz", "/healthz/", false)
+	probe("Readyz", "/readyz/", true)
+
+	info := ReadBuildInfo(h.Config)
+	h.RegisterHandler(healthHandler{basePath: "/version/", name: "Version", get: func(r *http.Request) (interface{}, bool) {
+		return info, true
+	}}, WithoutServerMiddleware())
+}
+
+///////////////////////////////////////////////////
+// Checks
+//
+
+// MongoCheck pings the mongo server behind db, giving up when ctx is done
+func MongoCheck(db *wtmcache.Db) HealthCheck {
+	return func(ctx context.Context) error {
+		// the ping is limited to the time ctx has left too, so it doesn't outlive the check for long
+		timeout := 5 * time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		if timeout <= 0 {
+			return ctx.Err()
+		}
+		result := make(chan error, 1)
+		go func() {
+			result <- db.PingTimeout(timeout)
+		}()
+		select {
+		case err := <-result:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// HttpCheck checks that url can be reached with client and doesn't return a 5xx status.  Use it
+// to check services this one depends on, e.g. the cacheserver's /healthz.
+func HttpCheck(client *HttpClient, url string) HealthCheck {
+	return func(ctx context.Context) error {
+		resp, err := client.Do(ctx, "GET", url, nil, nil)
+		if err != nil {
+			return err
+		}
+		drainAndClose(resp.Body)
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// LoggerCheck fails if the logger reports that it can't deliver logs.  Loggers that don't report a
+// status (don't have a Status() error method) always pass.
+func LoggerCheck(l logger.Logger) HealthCheck {
+	return func(ctx context.Context) error {
+		if s, ok := l.(interface{ Status() error }); ok {
+			return s.Status()
+		}
+		return nil
+	}
+}
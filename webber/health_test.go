@@ -0,0 +1,49 @@
+package webber
+
+import (
+	"errors"
+	"context"
+	"testing"
+	"net/http"
+	"encoding/json"
+	"net/http/httptest"
+)
+
+// probes answer without the server's middleware, and readiness fails if any check does
+func TestHealth(t *testing.T) {
+	config := DefaultConfig()
+	config.AppName = "healthtest"
+	as := NewAppServer(config)
+	as.Use(func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ReturnError(w, r, http.StatusUnauthorized, "no credentials")
+		}
+	})
+	health := NewHealth()
+	health.AddLivenessCheck("alive", func(ctx context.Context) error { return nil })
+	health.AddReadinessCheck("alive", func(ctx context.Context) error { return nil })
+	health.AddReadinessCheck("db", func(ctx context.Context) error { return errors.New("db down") })
+	as.EnableHealth(health)
+
+	get := func(path string, result interface{}) int {
+		w := httptest.NewRecorder()
+		as.Handler(w, httptest.NewRequest("GET", path, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+			t.Fatalf("TestHealth bad json from %s: %q", path, w.Body.String())
+		}
+		return w.Code
+	}
+
+	var report HealthReport
+	if code := get("/healthz", &report); code != 200 || report.Status != "ok" || report.Checks["alive"].Status != "ok" {
+		t.Fatalf("TestHealth /healthz got %d %+v", code, report)
+	}
+	report = HealthReport{}
+	if code := get("/readyz", &report); code != 503 || report.Status != "fail" || report.Checks["db"].Error != "db down" {
+		t.Fatalf("TestHealth /readyz got %d %+v", code, report)
+	}
+	var info BuildInfo
+	if code := get("/version", &info); code != 200 || info.AppName != "healthtest" || len(info.GoVersion) == 0 {
+		t.Fatalf("TestHealth /version got %d %+v", code, info)
+	}
+}
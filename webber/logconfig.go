@@ -0,0 +1,214 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"regexp"
+	"errors"
+	"strings"
+	"jmh/goweb/logger"
+)
+
+// LoggerOutput is one destination for logs, see ServerConfig.LoggerOutputs
+type LoggerOutput struct {
+	Type string				// "console", "json" (json lines to stdout), "file", "syslog", "firehose", "cloudwatch", "kinesis" or "elasticsearch"
+	MinLevel string			// the least severe level sent to this output, default everything ServerConfig.LogLevel allows
+	Path string				// for "file", the log file.  For "syslog", the daemon's address (e.g. "udp://logs:514"), or "" for local
+	MaxSizeMB int			// for "file", size before rotating, default 100
+	MaxAgeDays int			// for "file", days to keep rotated files, 0 to keep them
+	MaxBackups int			// for "file", rotated files to keep, 0 to keep them all
+	BatchSize int			// for the AWS outputs and "elasticsearch", entries per batch, default 500
+	BatchIntervalMs int		// for the AWS outputs and "elasticsearch", the longest an entry waits to be sent, default 1000
+	SpillDir string			// for the AWS outputs and "elasticsearch", where entries are kept while it's unavailable, "" to drop them
+	LogGroup string			// for "cloudwatch", the log group
+	LogStream string		// for "cloudwatch", the log stream, default the app's name and instance
+	CreateLogGroup bool		// for "cloudwatch", create the log group if it doesn't exist
+	CreateLogStream bool	// for "cloudwatch", create the log stream if it doesn't exist
+	Stream string			// for "kinesis", the data stream
+	Endpoint string			// for "cloudwatch" and "kinesis", the service endpoint if it isn't AWS's, e.g. a local stand in.  For "elasticsearch", the cluster's url
+	Index string			// for "elasticsearch", the prefix of the daily indexes, default "logs"
+	Username string			// for "elasticsearch", the user for basic auth
+	Password string			// for "elasticsearch", the password for basic auth
+	APIKey string			// for "elasticsearch", the api key, instead of a username and password
+	CreateTemplate bool		// for "elasticsearch", install an index template for the indexes
+}
+
+// batchConfig returns the output's batch settings, with defaults for any not set
+func (o LoggerOutput) batchConfig() logger.BatchConfig {
+	c := logger.DefaultBatchConfig()
+	if o.BatchSize > 0 {
+		c.MaxRecords = o.BatchSize
+	}
+	if o.BatchIntervalMs > 0 {
+		c.Interval = time.Duration(o.BatchIntervalMs) * time.Millisecond
+	}
+	c.SpillDir = o.SpillDir
+	return c
+}
+
+// NewLoggerFromConfig creates the logger described by config.LoggerOutputs, sending each entry to
+// every output at or above the output's MinLevel.  If there are no outputs, it logs to firehose (and
+// stdout) if config.LoggerFirehoseDeliveryStream is set, as older configs expect, or to the console.
+// Entries below config.LogLevel (or the component's level in config.LogComponentLevels) are dropped
+// first, by a logger.LevelFilter that EnableLogLevels can change.  The rest are redacted, with
+// config.LogRedactKeys and LogRedactPatterns added to the logger.DefaultRedactor, before any output
+// gets them.  If config.LogSampleRates, LogSampleTemplates or LogDedupWindowMs are set, a
+// logger.Sampler drops entries before they're redacted.
+//
+// Parameters:
+//	app : describes the service doing the logging
+//	config : the server config
+//
+// Returns:
+//	logger.Logger : the logger, to set as logger.StdLogger
+//	error : if an output or level is invalid, or an output can't be opened
+//
+// Example:
+//	l, err := webber.NewLoggerFromConfig(app, config)
+//	if err != nil { ... }
+//	logger.StdLogger = l
+//
+func NewLoggerFromConfig(app logger.AppInfo, config *ServerConfig) (logger.Logger, error) {
+	filter := logger.NewLevelFilter(nil, logger.INFO)
+	if len(config.LogLevel) > 0 {
+		level, err := logger.ParseLevel(config.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		filter.SetLevel(level)
+	}
+	for c, s := range config.LogComponentLevels {
+		level, err := logger.ParseLevel(s)
+		if err != nil {
+			return nil, fmt.Errorf("log level for %s: %s", c, err)
+		}
+		filter.SetComponentLevel(c, level)
+	}
+	redactor := logger.DefaultRedactor().RedactKeys(config.LogRedactKeys...)
+	names := make([]string, 0, len(config.LogRedactPatterns))
+	for name := range config.LogRedactPatterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(config.LogRedactPatterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("log redact pattern %s: %s", name, err)
+		}
+		redactor.AddPattern(name, re, "[REDACTED:" + name + "]")
+	}
+
+	sampling := logger.SamplingConfig{Templates: config.LogSampleTemplates, DedupWindow: time.Duration(config.LogDedupWindowMs) * time.Millisecond}
+	if len(config.LogSampleRates) > 0 {
+		sampling.Rates = make(map[logger.LogLevel]int)
+		for s, n := range config.LogSampleRates {
+			level, err := logger.ParseLevel(s)
+			if err != nil {
+				return nil, fmt.Errorf("log sample rate: %s", err)
+			}
+			sampling.Rates[level] = n
+		}
+	}
+	// filter, then sample, then redact what's left
+	chain := func(l logger.Logger) logger.Logger {
+		l = logger.NewRedactingLogger(l, redactor)
+		if len(sampling.Rates) > 0 || len(sampling.Templates) > 0 || sampling.DedupWindow > 0 {
+			l = logger.NewSampler(l, sampling)
+		}
+		filter.Logger = l
+		return filter
+	}
+
+	outputs := config.LoggerOutputs
+	if len(outputs) == 0 {
+		if len(config.LoggerFirehoseDeliveryStream) > 0 {
+			l := logger.NewFirehoseLogger(app, config.AWSRegion, config.AWSProfile, config.LoggerFirehoseDeliveryStream)
+			l.StdOutOn(true)
+			return chain(l), nil
+		}
+		return chain(logger.NewConsoleLogger(app, os.Stdout, false)), nil
+	}
+
+	multi := logger.NewMultiLogger()
+	for _, o := range outputs {
+		minLevel := logger.LogLevel(logger.TRACE)
+		if len(o.MinLevel) > 0 {
+			level, err := logger.ParseLevel(o.MinLevel)
+			if err != nil {
+				return nil, err
+			}
+			minLevel = level
+		}
+		l, err := newLoggerOutput(app, config, o)
+		if err != nil {
+			return nil, err
+		}
+		multi.Add(l, minLevel)
+	}
+	return chain(multi), nil
+}
+
+func newLoggerOutput(app logger.AppInfo, config *ServerConfig, o LoggerOutput) (logger.Logger, error) {
+	switch o.Type {
+	case "console":
+		return logger.NewConsoleLogger(app, os.Stdout, false), nil
+	case "json":
+		return logger.NewConsoleLogger(app, os.Stdout, true), nil
+	case "file":
+		if len(o.Path) == 0 {
+			return nil, errors.New("file logger output needs a Path")
+		}
+		return logger.NewRotatingFileLogger(app, o.Path, int64(o.MaxSizeMB) * 1024 * 1024,
+			time.Duration(o.MaxAgeDays) * 24 * time.Hour, o.MaxBackups)
+	case "syslog":
+		network, addr := "", o.Path
+		if i := strings.Index(addr, "://"); i >= 0 {
+			network, addr = addr[:i], addr[i + 3:]
+		}
+		return logger.NewSyslogLogger(app, network, addr)
+	case "firehose":
+		return logger.NewFirehoseLoggerWithConfig(app, config.AWSRegion, config.AWSProfile, config.LoggerFirehoseDeliveryStream, o.batchConfig()), nil
+	case "cloudwatch":
+		if len(o.LogGroup) == 0 {
+			return nil, errors.New("cloudwatch logger output needs a LogGroup")
+		}
+		return logger.NewCloudWatchLogger(app, config.AWSRegion, config.AWSProfile, logger.CloudWatchConfig{LogGroup: o.LogGroup, LogStream: o.LogStream,
+			CreateLogGroup: o.CreateLogGroup, CreateLogStream: o.CreateLogStream, Endpoint: o.Endpoint, Batch: o.batchConfig()}), nil
+	case "kinesis":
+		if len(o.Stream) == 0 {
+			return nil, errors.New("kinesis logger output needs a Stream")
+		}
+		return logger.NewKinesisLogger(app, config.AWSRegion, config.AWSProfile, logger.KinesisConfig{Stream: o.Stream, Endpoint: o.Endpoint, Batch: o.batchConfig()}), nil
+	case "elasticsearch":
+		if len(o.Endpoint) == 0 {
+			return nil, errors.New("elasticsearch logger output needs an Endpoint")
+		}
+		return logger.NewElasticsearchLogger(app, logger.ElasticsearchConfig{URL: o.Endpoint, Index: o.Index, Username: o.Username,
+			Password: o.Password, APIKey: o.APIKey, CreateTemplate: o.CreateTemplate, Batch: o.batchConfig()}), nil
+	}
+	return nil, errors.New("unknown logger output type " + o.Type)
+}
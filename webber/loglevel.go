@@ -0,0 +1,163 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+
+package webber
+
+import (
+	"fmt"
+	"strings"
+	"net/http"
+	"encoding/json"
+	"jmh/goweb/logger"
+)
+
+// LogLevels is the body of the log level endpoint: the default minimum level and each
+// component's own.  In a POST, a component set to "" goes back to the default.
+type LogLevels struct {
+	Level string					`json:"level,omitempty"`
+	Components map[string]string	`json:"components,omitempty"`
+}
+
+// LogLevelHandler reads (GET) and changes (POST) a logger.LevelFilter's levels, so logging can be
+// turned up while a problem is investigated, without a restart
+type LogLevelHandler struct {
+	basePath string
+	filter *logger.LevelFilter
+}
+
+// NewLogLevelHandler creates a LogLevelHandler
+//
+// Parameters:
+//	basePath : the path to serve on, e.g. "admin/loglevel"
+//	filter : the levels to read and change, or nil for logger.StdLogger's (if it is a LevelFilter)
+//
+// Returns:
+//	*LogLevelHandler : the handler created
+//
+func NewLogLevelHandler(basePath string, filter *logger.LevelFilter) *LogLevelHandler {
+	h := new(LogLevelHandler)
+	h.basePath = "/" + strings.Trim(basePath, "/") + "/"
+	h.filter = filter
+	return h
+}
+
+func (h LogLevelHandler) Name() string {
+	return "LogLevelHandler"
+}
+
+func (h LogLevelHandler) BasePath() string {
+	return h.basePath
+}
+
+func (h LogLevelHandler) levelFilter() *logger.LevelFilter {
+	if h.filter != nil {
+		return h.filter
+	}
+	f, _ := logger.StdLogger.(*logger.LevelFilter)
+	return f
+}
+
+func (h LogLevelHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	f := h.levelFilter()
+	if f == nil {
+		ReturnError(w, r, http.StatusNotFound, "Log levels can't be changed")
+		return
+	}
+	ReturnJson(w, currentLogLevels(f))
+}
+
+func (h LogLevelHandler) HandlePost(w http.ResponseWriter, r *http.Request) {
+	f := h.levelFilter()
+	if f == nil {
+		ReturnError(w, r, http.StatusNotFound, "Log levels can't be changed")
+		return
+	}
+	var req LogLevels
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ReturnError(w, r, http.StatusBadRequest, "Invalid log levels: " + err.Error())
+		return
+	}
+	// check everything before changing anything
+	var level logger.LogLevel
+	if len(req.Level) > 0 {
+		l, err := logger.ParseLevel(req.Level)
+		if err != nil {
+			ReturnError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		level = l
+	}
+	components := make(map[string]logger.LogLevel)
+	for c, s := range req.Components {
+		if len(s) == 0 {
+			components[c] = ""
+			continue
+		}
+		l, err := logger.ParseLevel(s)
+		if err != nil {
+			ReturnError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		components[c] = l
+	}
+
+	if len(level) > 0 {
+		f.SetLevel(level)
+	}
+	for c, l := range components {
+		if len(l) == 0 {
+			f.ClearComponentLevel(c)
+		} else {
+			f.SetComponentLevel(c, l)
+		}
+	}
+	levels := currentLogLevels(f)
+	GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Log levels changed to %s %v", levels.Level, levels.Components), nil)
+	ReturnJson(w, levels)
+}
+
+func currentLogLevels(f *logger.LevelFilter) LogLevels {
+	levels := LogLevels{Level: string(f.Level()), Components: make(map[string]string)}
+	for c, l := range f.ComponentLevels() {
+		levels.Components[c] = string(l)
+	}
+	return levels
+}
+
+// EnableLogLevels serves the levels of logger.StdLogger (made by NewLoggerFromConfig) on path.
+// GET returns the LogLevels, and POST changes them, e.g. {"components": {"HikeServer": "DEBUG"}}.
+//
+// Parameters:
+//	path : the path to serve on, e.g. "admin/loglevel"
+//	policy : who may read and change the levels.  nil leaves it to the server's middleware, e.g. api keys
+//
+// Returns:
+//	none
+//
+// Example:
+//	admins := webber.NewAccessPolicy(loader).Require("*", webber.AccessRule{Roles: []string{"admin"}})
+//	as.EnableLogLevels("admin/loglevel", admins)
+//
+func (h *AppServer) EnableLogLevels(path string, policy *AccessPolicy) {
+	h.RegisterHandler(NewLogLevelHandler(path, nil), WithAccessPolicy(policy))
+}
@@ -0,0 +1,55 @@
+package webber
+
+import (
+	"strings"
+	"testing"
+	"encoding/json"
+	"net/http/httptest"
+	"jmh/goweb/logger"
+)
+
+// the config's levels are applied, and the endpoint changes them only if the whole request is valid
+func TestLogLevels(t *testing.T) {
+	config := DefaultConfig()
+	config.LogLevel = "warn"
+	config.LogComponentLevels = map[string]string{"HikeServer": "DEBUG"}
+	l, err := NewLoggerFromConfig(logger.AppInfo{}, config)
+	if err != nil {
+		t.Fatalf("TestLogLevels NewLoggerFromConfig failed: %s", err)
+	}
+	filter := l.(*logger.LevelFilter)
+	if filter.Enabled(logger.INFO, "") || !filter.Enabled(logger.DEBUG, "HikeServer") {
+		t.Fatalf("TestLogLevels expected WARN with HikeServer at DEBUG, got %s %v", filter.Level(), filter.ComponentLevels())
+	}
+	if logger.FindSampler(l) != nil {
+		t.Fatalf("TestLogLevels expected no sampler without sampling settings")
+	}
+	config.LogSampleRates = map[string]int{"info": 10}
+	if l, _ := NewLoggerFromConfig(logger.AppInfo{}, config); logger.FindSampler(l) == nil {
+		t.Fatalf("TestLogLevels expected a sampler for LogSampleRates")
+	}
+	config.LogLevel = "loud"
+	if _, err := NewLoggerFromConfig(logger.AppInfo{}, config); err == nil {
+		t.Fatalf("TestLogLevels expected an unknown level to fail")
+	}
+
+	as := NewAppServer(DefaultConfig())
+	as.RegisterHandler(NewLogLevelHandler("admin/loglevel", filter))
+	call := func(method string, body string) (int, LogLevels) {
+		w := httptest.NewRecorder()
+		as.Handler(w, httptest.NewRequest(method, "/admin/loglevel/", strings.NewReader(body)))
+		var levels LogLevels
+		json.Unmarshal(w.Body.Bytes(), &levels)
+		return w.Code, levels
+	}
+
+	if code, levels := call("POST", `{"level": "ERROR", "components": {"cache": "trace", "HikeServer": "nope"}}`); code != 400 || filter.Level() != logger.WARN {
+		t.Fatalf("TestLogLevels expected an invalid request to change nothing, got %d %+v", code, levels)
+	}
+	if code, levels := call("POST", `{"level": "ERROR", "components": {"cache": "trace", "HikeServer": ""}}`); code != 200 || levels.Level != "ERROR" || len(levels.Components) != 1 {
+		t.Fatalf("TestLogLevels POST got %d %+v", code, levels)
+	}
+	if code, levels := call("GET", ""); code != 200 || levels.Components["cache"] != "TRACE" || filter.Enabled(logger.DEBUG, "HikeServer") {
+		t.Fatalf("TestLogLevels GET got %d %+v", code, levels)
+	}
+}
@@ -0,0 +1,567 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"strconv"
+	"strings"
+	"net/http"
+	"jmh/goweb/logger"
+	"jmh/goweb/wtmcache"
+)
+
+const (
+	MetricCounter = "counter"
+	MetricGauge = "gauge"
+	MetricHistogram = "histogram"
+)
+
+// DefaultBuckets are the histogram buckets used for request durations, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DefaultMetrics is the registry the AppServer and HttpClient metrics are published to
+var DefaultMetrics = NewMetricsRegistry()
+
+// MetricsRegistry holds a service's metrics and writes them in the Prometheus text format.  Counters
+// and histograms are updated as things happen, while collectors are called to read values (such as
+// cache sizes) kept elsewhere each time the metrics are scraped.
+type MetricsRegistry struct {
+	mu sync.Mutex
+	metrics map[string]metric
+	names []string					// in registration order
+	collections []*wtmcache.Collection	// published by RegisterCollectionMetrics
+	clients []registeredClient			// published by HttpClient.RegisterMetrics
+}
+
+// registeredClient is an HttpClient and the name its metrics are labelled with
+type registeredClient struct {
+	client *HttpClient
+	name string
+}
+
+// metric is a counter, histogram or collector in a registry
+type metric interface {
+	write(w io.Writer)
+}
+
+// MetricSample is a single value reported by a collector
+type MetricSample struct {
+	Labels map[string]string
+	Value float64
+}
+
+// NewMetricsRegistry creates an empty registry
+func NewMetricsRegistry() *MetricsRegistry {
+	m := new(MetricsRegistry)
+	m.metrics = make(map[string]metric)
+	return m
+}
+
+// register adds metric under name, or returns the one already registered with that name
+func (m *MetricsRegistry) register(name string, create func() metric) metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.metrics[name]; ok {
+		return existing
+	}
+	n := create()
+	m.metrics[name] = n
+	m.names = append(m.names, name)
+	return n
+}
+
+// Counter returns the counter with the given name and label names, creating it if needed
+//
+// Parameters:
+//	name : the metric name, e.g. "webber_http_requests_total"
+//	help : a description of the metric
+//	labels : the names of the labels the counter is broken down by
+//
+// Returns:
+//	*CounterVec : the counter
+//
+// Example:
+//	logins := webber.DefaultMetrics.Counter("webbertut_logins_total", "Login attempts", "result")
+//	logins.Inc("success")
+//
+func (m *MetricsRegistry) Counter(name string, help string, labels ...string) *CounterVec {
+	return m.register(name, func() metric {
+		return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+	}).(*CounterVec)
+}
+
+// Histogram returns the histogram with the given name, buckets and label names, creating it if needed
+//
+// Parameters:
+//	name : the metric name, e.g. "webber_http_request_duration_seconds"
+//	help : a description of the metric
+//	buckets : the upper bounds of the buckets, in increasing order.  nil for DefaultBuckets
+//	labels : the names of the labels the histogram is broken down by
+//
+// Returns:
+//	*HistogramVec : the histogram
+//
+func (m *MetricsRegistry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return m.register(name, func() metric {
+		return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	}).(*HistogramVec)
+}
+
+// RegisterCollector adds a metric whose samples are read by calling collect each time the metrics
+// are written.  Use it to publish values that are already counted somewhere else, such as cache
+// sizes or HttpClient.Stats.  Registering a name that is already registered does nothing.
+//
+// Parameters:
+//	name : the metric name
+//	help : a description of the metric
+//	metricType : MetricCounter or MetricGauge
+//	collect : returns the current samples
+//
+// Returns:
+//	none
+//
+func (m *MetricsRegistry) RegisterCollector(name string, help string, metricType string, collect func() []MetricSample) {
+	m.register(name, func() metric {
+		return &collector{name: name, help: help, metricType: metricType, collect: collect}
+	})
+}
+
+// WriteText writes all the metrics in the Prometheus text exposition format
+func (m *MetricsRegistry) WriteText(w io.Writer) {
+	m.mu.Lock()
+	metrics := make([]metric, len(m.names))
+	for i, name := range m.names {
+		metrics[i] = m.metrics[name]
+	}
+	m.mu.Unlock()
+	for _, mt := range metrics {
+		mt.write(w)
+	}
+}
+
+///////////////////////////////////////////////////
+// Counters, histograms and collectors
+//
+
+// CounterVec is a counter broken down by labels
+type CounterVec struct {
+	name, help string
+	labels []string
+	mu sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value float64
+}
+
+// Inc adds one to the counter for the label values, which are in the order the labels were named
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: labelValues}
+		c.values[key] = cv
+	}
+	cv.value += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, MetricCounter)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cv := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, cv.labels, "", ""), formatValue(cv.value))
+	}
+}
+
+// HistogramVec is a histogram broken down by labels
+type HistogramVec struct {
+	name, help string
+	labels []string
+	buckets []float64
+	mu sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64				// per bucket, not cumulative
+	count uint64
+	sum float64
+}
+
+// Observe records v in the histogram for the label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+			break
+		}
+	}
+	hv.count++
+	hv.sum += v
+	h.mu.Unlock()
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, MetricHistogram)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, hv.labels, "le", formatValue(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, hv.labels, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, hv.labels, "", ""), formatValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, hv.labels, "", ""), hv.count)
+	}
+}
+
+type collector struct {
+	name, help, metricType string
+	collect func() []MetricSample
+}
+
+func (c *collector) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, c.metricType)
+	for _, s := range c.collect() {
+		names := make([]string, 0, len(s.Labels))
+		for k := range s.Labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		values := make([]string, len(names))
+		for i, k := range names {
+			values[i] = s.Labels[k]
+		}
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(names, values, "", ""), formatValue(s.Value))
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, metricType)
+}
+
+// formatLabels formats {name="value",...}, adding extraName if it isn't empty
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && len(extraName) == 0 {
+		return ""
+	}
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, n := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		b.WriteString(n + "=" + strconv.Quote(v))
+	}
+	if len(extraName) > 0 {
+		if len(names) > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(extraName + "=" + strconv.Quote(extraValue))
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+///////////////////////////////////////////////////
+// webber metrics
+//
+
+// RequestMetrics returns middleware that counts requests and times them, by handler Name(), method
+// and status.  AppServer.EnableMetrics adds it for you.
+//
+// Parameters:
+//	registry : the registry to publish to
+//
+// Returns:
+//	Middleware : the metrics middleware
+//
+func RequestMetrics(registry *MetricsRegistry) Middleware {
+	requests := registry.Counter("webber_http_requests_total", "Requests handled, by handler, method and status", "handler", "method", "status")
+	durations := registry.Histogram("webber_http_request_duration_seconds", "Time taken to handle requests, by handler, method and status",
+		nil, "handler", "method", "status")
+	return func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rr := newResponseRecorder(w)
+			next(rr, r)
+			status := strconv.Itoa(rr.Status())
+			requests.Inc(h.Name(), r.Method, status)
+			durations.Observe(time.Since(start).Seconds(), h.Name(), r.Method, status)
+		}
+	}
+}
+
+// MetricsHandler serves a registry's metrics in the Prometheus text format
+type MetricsHandler struct {
+	basePath string
+	registry *MetricsRegistry
+}
+
+// NewMetricsHandler creates a MetricsHandler
+//
+// Parameters:
+//	basePath : the path to serve the metrics on, e.g. "metrics"
+//	registry : the registry to serve
+//
+// Returns:
+//	*MetricsHandler : the handler created
+//
+func NewMetricsHandler(basePath string, registry *MetricsRegistry) *MetricsHandler {
+	h := new(MetricsHandler)
+	h.basePath = "/" + strings.Trim(basePath, "/") + "/"
+	h.registry = registry
+	return h
+}
+
+func (h MetricsHandler) Name() string {
+	return "MetricsHandler"
+}
+
+func (h MetricsHandler) BasePath() string {
+	return h.basePath
+}
+
+func (h MetricsHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.registry.WriteText(w)
+}
+
+func (h MetricsHandler) HandlePost(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+}
+
+// EnableMetrics adds the request metrics middleware to the AppServer and serves DefaultMetrics, with
+// the logger's metrics, on path
+//
+// Parameters:
+//	path : the path to serve metrics on, usually "metrics"
+//
+// Returns:
+//	none
+//
+func (h *AppServer) EnableMetrics(path string) {
+	h.Use(RequestMetrics(DefaultMetrics))
+	RegisterLoggerMetrics(DefaultMetrics)
+	h.RegisterHandler(NewMetricsHandler(path, DefaultMetrics))
+}
+
+// RegisterMetrics publishes the client's Stats to registry, and times its requests by host and
+// status, all labelled with name.  Each client registered with a registry gets its own samples, and
+// registering one again does nothing.  It may be called while the client is in use.
+//
+// Parameters:
+//	registry : the registry to publish to
+//	name : the name of the client, e.g. "cacheserver"
+//
+// Returns:
+//	none
+//
+func (c *HttpClient) RegisterMetrics(registry *MetricsRegistry, name string) {
+	durations := registry.Histogram("webber_client_request_duration_seconds", "Time taken by outbound requests, by client, host and status",
+		nil, "client", "host", "status")
+	c.metricsMu.Lock()
+	c.durations = durations
+	c.metricsName = name
+	c.metricsMu.Unlock()
+
+	registry.mu.Lock()
+	for _, rc := range registry.clients {
+		if rc.client == c {
+			registry.mu.Unlock()
+			return
+		}
+	}
+	registry.clients = append(registry.clients, registeredClient{client: c, name: name})
+	registry.mu.Unlock()
+
+	clients := func() []registeredClient {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		return registry.clients
+	}
+	stat := func(read func(s ClientStats) int64) func() []MetricSample {
+		return func() []MetricSample {
+			rcs := clients()
+			samples := make([]MetricSample, len(rcs))
+			for i, rc := range rcs {
+				samples[i] = MetricSample{Labels: map[string]string{"client": rc.name}, Value: float64(read(rc.client.Stats()))}
+			}
+			return samples
+		}
+	}
+	registry.RegisterCollector("webber_client_requests_total", "Outbound requests sent, including retries", MetricCounter,
+		stat(func(s ClientStats) int64 { return s.Requests }))
+	registry.RegisterCollector("webber_client_retries_total", "Outbound requests that were retries", MetricCounter,
+		stat(func(s ClientStats) int64 { return s.Retries }))
+	registry.RegisterCollector("webber_client_failures_total", "Outbound requests that failed or returned 5xx", MetricCounter,
+		stat(func(s ClientStats) int64 { return s.Failures }))
+	registry.RegisterCollector("webber_client_short_circuits_total", "Outbound requests stopped by an open circuit breaker", MetricCounter,
+		stat(func(s ClientStats) int64 { return s.ShortCircuits }))
+	registry.RegisterCollector("webber_client_cache_hits_total", "Outbound GETs answered from the response cache", MetricCounter,
+		stat(func(s ClientStats) int64 { return s.CacheHits }))
+	registry.RegisterCollector("webber_client_cache_misses_total", "Outbound GETs not in the response cache", MetricCounter,
+		stat(func(s ClientStats) int64 { return s.CacheMisses }))
+	registry.RegisterCollector("webber_client_breaker_state", "Circuit breaker state by host: 0 closed, 1 open, 2 half open", MetricGauge,
+		func() []MetricSample {
+			var samples []MetricSample
+			for _, rc := range clients() {
+				breakers := rc.client.Stats().Breakers
+				hosts := make([]string, 0, len(breakers))
+				for host := range breakers {
+					hosts = append(hosts, host)
+				}
+				sort.Strings(hosts)
+				for _, host := range hosts {
+					samples = append(samples, MetricSample{Labels: map[string]string{"client": rc.name, "host": host}, Value: float64(breakers[host])})
+				}
+			}
+			return samples
+		})
+}
+
+// RegisterCollectionMetrics publishes a wtmcache Collection's cache hits, misses and size to registry,
+// labelled with the collection name.  Registering a collection again does nothing.
+//
+// Parameters:
+//	registry : the registry to publish to
+//	coll : the collection
+//
+// Returns:
+//	none
+//
+func RegisterCollectionMetrics(registry *MetricsRegistry, coll *wtmcache.Collection) {
+	if coll == nil {
+		return
+	}
+	registry.mu.Lock()
+	for _, c := range registry.collections {
+		if c == coll {
+			registry.mu.Unlock()
+			return
+		}
+	}
+	registry.collections = append(registry.collections, coll)
+	registry.mu.Unlock()
+
+	stat := func(read func(s wtmcache.CollectionStats) int64) func() []MetricSample {
+		return func() []MetricSample {
+			registry.mu.Lock()
+			colls := registry.collections
+			registry.mu.Unlock()
+			samples := make([]MetricSample, len(colls))
+			for i, c := range colls {
+				samples[i] = MetricSample{Labels: map[string]string{"collection": c.Name}, Value: float64(read(c.Stats()))}
+			}
+			return samples
+		}
+	}
+	registry.RegisterCollector("wtmcache_hits_total", "Collection reads answered from the cache", MetricCounter,
+		stat(func(s wtmcache.CollectionStats) int64 { return s.Hits }))
+	registry.RegisterCollector("wtmcache_misses_total", "Collection reads that went to the db", MetricCounter,
+		stat(func(s wtmcache.CollectionStats) int64 { return s.Misses }))
+	registry.RegisterCollector("wtmcache_items", "Documents in the collection cache", MetricGauge,
+		stat(func(s wtmcache.CollectionStats) int64 { return int64(s.Items) }))
+}
+
+// RegisterLoggerMetrics publishes the entries logger.StdLogger's Sampler (if it has one) has dropped,
+// by reason ("sampled" or "duplicate") and level
+//
+// Parameters:
+//	registry : the registry to publish to
+//
+// Returns:
+//	none
+//
+func RegisterLoggerMetrics(registry *MetricsRegistry) {
+	registry.RegisterCollector("logger_entries_dropped_total", "Log entries dropped by sampling or deduplication", MetricCounter, func() []MetricSample {
+		s := logger.FindSampler(logger.StdLogger)
+		if s == nil {
+			return nil
+		}
+		stats := s.Stats()
+		samples := []MetricSample{}
+		add := func(reason string, counts map[logger.LogLevel]int64) {
+			levels := make([]string, 0, len(counts))
+			for level := range counts {
+				levels = append(levels, string(level))
+			}
+			sort.Strings(levels)
+			for _, level := range levels {
+				samples = append(samples, MetricSample{Labels: map[string]string{"reason": reason, "level": level}, Value: float64(counts[logger.LogLevel(level)])})
+			}
+		}
+		add("sampled", stats.Sampled)
+		add("duplicate", stats.Suppressed)
+		return samples
+	})
+}
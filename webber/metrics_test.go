@@ -0,0 +1,81 @@
+package webber
+
+import (
+	"sync"
+	"bytes"
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+// requests are counted and timed by handler and status, and written in the Prometheus text format
+func TestRequestMetrics(t *testing.T) {
+	registry := NewMetricsRegistry()
+	h := &traceHandler{}
+	chain := RequestMetrics(registry)(h, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/trace/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	for _, path := range []string{"/trace/a", "/trace/b", "/trace/missing"} {
+		chain(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	// each client gets its own samples
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	for _, name := range []string{"cacheserver", "hikeservice"} {
+		client := newTestClient(nil, nil)
+		client.RegisterMetrics(registry, name)
+		client.Get(upstream.URL, nil)
+	}
+	registry.RegisterCollector("test_items", "Items", MetricGauge, func() []MetricSample {
+		return []MetricSample{{Labels: map[string]string{"cache": "hikes"}, Value: 3}}
+	})
+
+	var out bytes.Buffer
+	registry.WriteText(&out)
+	text := out.String()
+	for _, want := range []string{
+		"# TYPE webber_http_requests_total counter\n",
+		`webber_http_requests_total{handler="TraceHandler",method="GET",status="200"} 2` + "\n",
+		`webber_http_requests_total{handler="TraceHandler",method="GET",status="404"} 1` + "\n",
+		`webber_http_request_duration_seconds_bucket{handler="TraceHandler",method="GET",status="200",le="+Inf"} 2` + "\n",
+		`webber_http_request_duration_seconds_count{handler="TraceHandler",method="GET",status="404"} 1` + "\n",
+		`test_items{cache="hikes"} 3` + "\n",
+		`webber_client_requests_total{client="cacheserver"} 1` + "\n",
+		`webber_client_requests_total{client="hikeservice"} 1` + "\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("TestRequestMetrics missing %q in\n%s", want, text)
+		}
+	}
+}
+
+// a client can be registered while it's in use, and registering it again doesn't repeat its samples
+func TestRegisterClientInUse(t *testing.T) {
+	registry := NewMetricsRegistry()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	client := newTestClient(nil, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := client.Get(upstream.URL, nil); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	client.RegisterMetrics(registry, "cacheserver")
+	client.RegisterMetrics(registry, "cacheserver")
+	wg.Wait()
+
+	var out bytes.Buffer
+	registry.WriteText(&out)
+	if n := strings.Count(out.String(), `webber_client_requests_total{client="cacheserver"}`); n != 1 {
+		t.Fatalf("TestRegisterClientInUse expected one sample for the client, got %d in\n%s", n, out.String())
+	}
+}
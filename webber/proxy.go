@@ -0,0 +1,250 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"net"
+	"errors"
+	"strings"
+	"net/http"
+)
+
+// TrustedProxies is the set of networks whose X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host
+// and Forwarded headers are believed.  Requests from anywhere else are taken at face value.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// ParseTrustedProxies parses a list of CIDRs (e.g. "10.0.0.0/8") or single addresses
+//
+// Parameters:
+//	cidrs : the proxies' networks
+//
+// Returns:
+//	*TrustedProxies : the proxies, or nil if cidrs is empty
+//	error : if a CIDR or address can't be parsed
+//
+func ParseTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	p := new(TrustedProxies)
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, errors.New("invalid trusted proxy address " + c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy CIDR " + c)
+		}
+		p.nets = append(p.nets, n)
+	}
+	return p, nil
+}
+
+// Contains returns true if ip is in one of the trusted networks
+func (p *TrustedProxies) Contains(ip string) bool {
+	if p == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range p.nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHop is one proxy's record of the request it received
+type forwardedHop struct {
+	forIP string
+	proto string
+	host string
+}
+
+// Resolve returns the client's ip address, and the scheme and host it used, for a request.  If
+// the request came from a trusted proxy, the forwarding headers are walked from the nearest proxy
+// back, stopping at the first address that isn't a trusted proxy, which is the client.  The
+// Forwarded header is used if there is one, otherwise X-Forwarded-For/Proto/Host.
+//
+// Parameters:
+//	r : the request
+//
+// Returns:
+//	ip : the client's ip address
+//	scheme : "http" or "https"
+//	host : the host the client asked for
+//
+func (p *TrustedProxies) Resolve(r *http.Request) (ip string, scheme string, host string) {
+	ip = remoteIP(r)
+	scheme = "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host = r.Host
+	if !p.Contains(ip) {
+		return
+	}
+
+	var hops []forwardedHop
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		hops = parseForwarded(fwd)
+	} else {
+		for _, f := range splitHeader(r.Header.Values("X-Forwarded-For")) {
+			hops = append(hops, forwardedHop{forIP: f})
+		}
+		// the nearest proxy sets these for the request it received
+		if len(hops) > 0 {
+			if protos := splitHeader(r.Header.Values("X-Forwarded-Proto")); len(protos) > 0 {
+				hops[len(hops) - 1].proto = protos[len(protos) - 1]
+			}
+			if hosts := splitHeader(r.Header.Values("X-Forwarded-Host")); len(hosts) > 0 {
+				hops[len(hops) - 1].host = hosts[len(hosts) - 1]
+			}
+		}
+	}
+
+	// each hop was added by a trusted proxy, so believe it and move on to the next if its client
+	// is also a trusted proxy
+	for i := len(hops) - 1; i >= 0; i-- {
+		hopIP := net.ParseIP(hops[i].forIP)
+		if hopIP == nil {
+			// "unknown", an obfuscated id, or garbage
+			break
+		}
+		ip = hopIP.String()
+		if proto := strings.ToLower(hops[i].proto); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if len(hops[i].host) > 0 {
+			host = hops[i].host
+		}
+		if !p.Contains(ip) {
+			break
+		}
+	}
+	return
+}
+
+// splitHeader splits comma separated header values into a trimmed list
+func splitHeader(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// parseForwarded parses RFC 7239 Forwarded headers, e.g. for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, element := range splitHeader(values) {
+		var hop forwardedHop
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v := strings.Trim(kv[1], "\"")
+			switch strings.ToLower(kv[0]) {
+			case "for":
+				hop.forIP = stripPort(v)
+			case "proto":
+				hop.proto = v
+			case "host":
+				hop.host = v
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// stripPort removes the port from "1.2.3.4:80" or "[2001:db8::1]:80", and the brackets from "[2001:db8::1]"
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// remoteIP returns the address of the immediate peer
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// GetClientIP returns the ip address of the client that made the request, resolved through any
+// trusted proxies (see ServerConfig.TrustedProxies)
+func GetClientIP(r *http.Request) string {
+	if rc := GetRequestContext(r); rc != nil {
+		return rc.ClientIP
+	}
+	return remoteIP(r)
+}
+
+// GetScheme returns "https" if the client made the request over https, either directly or to a
+// trusted proxy, otherwise "http"
+func GetScheme(r *http.Request) string {
+	if rc := GetRequestContext(r); rc != nil {
+		return rc.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// GetHost returns the host the client asked for, resolved through any trusted proxies
+func GetHost(r *http.Request) string {
+	if rc := GetRequestContext(r); rc != nil {
+		return rc.Host
+	}
+	return r.Host
+}
+
+// isHTTPS returns true if the client made the request over https
+func isHTTPS(r *http.Request) bool {
+	return GetScheme(r) == "https"
+}
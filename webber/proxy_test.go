@@ -0,0 +1,68 @@
+package webber
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+// forwarding headers are only believed from trusted proxies, and are walked back to the first
+// address that isn't one
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("TestTrustedProxies failed to parse: %s", err)
+	}
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatalf("TestTrustedProxies expected an invalid CIDR to fail")
+	}
+
+	tests := []struct {
+		remote string
+		headers map[string]string
+		ip, scheme, host string
+	}{
+		// untrusted peers are taken at face value
+		{"203.0.113.9:5000", map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Forwarded-Proto": "https"}, "203.0.113.9", "http", "example.com"},
+		// a spoofed entry before the real client is ignored
+		{"10.0.0.5:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 192.168.1.1", "X-Forwarded-Proto": "https",
+			"X-Forwarded-Host": "hikes.example.com"}, "198.51.100.7", "https", "hikes.example.com"},
+		// everything is a trusted proxy, so the leftmost address is the client
+		{"10.0.0.5:5000", map[string]string{"X-Forwarded-For": "10.1.1.1"}, "10.1.1.1", "http", "example.com"},
+		{"10.0.0.5:5000", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https;host=hikes.example.com, for=10.2.2.2`},
+			"2001:db8::1", "https", "hikes.example.com"},
+		{"10.0.0.5:5000", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.5", "http", "example.com"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		ip, scheme, host := proxies.Resolve(r)
+		if ip != test.ip || scheme != test.scheme || host != test.host {
+			t.Fatalf("TestTrustedProxies %v expected %s %s %s, got %s %s %s", test.headers, test.ip, test.scheme, test.host, ip, scheme, host)
+		}
+	}
+
+	// the AppServer resolves the client for handlers and middleware
+	config := DefaultConfig()
+	config.WWWRoot = ""
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	as := NewAppServer(config)
+	var got string
+	as.Use(func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			got = GetClientIP(r) + " " + GetScheme(r)
+		}
+	})
+	as.RegisterHandler(&traceHandler{})
+	r := httptest.NewRequest("GET", "/trace/", nil)
+	r.RemoteAddr = "10.0.0.5:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	as.Handler(httptest.NewRecorder(), r)
+	if got != "198.51.100.7 https" {
+		t.Fatalf("TestTrustedProxies expected the forwarded client, got %q", got)
+	}
+}
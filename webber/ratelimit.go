@@ -0,0 +1,333 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"strconv"
+	"net/http"
+	"net/url"
+	"jmh/goweb/logger"
+)
+
+// RateLimit is a token bucket: a client may make Burst requests at once, and the bucket refills at
+// Rate requests per second
+type RateLimit struct {
+	Rate float64			// requests per second
+	Burst int				// the most requests allowed at once
+	Methods []string		// (optional) the methods the limit applies to, e.g. ["POST"].  Default is all
+}
+
+// appliesTo returns true if the limit covers method
+func (l *RateLimit) appliesTo(method string) bool {
+	if len(l.Methods) == 0 {
+		return true
+	}
+	for _, m := range l.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitResult is the outcome of taking a token from a bucket
+type RateLimitResult struct {
+	Allowed bool					`json:"allowed"`
+	Limit int						`json:"limit"`
+	Remaining int					`json:"remaining"`
+	RetryAfter time.Duration		`json:"retry_after"`		// how long until a request would be allowed, if it wasn't
+	Reset time.Duration				`json:"reset"`			// how long until the bucket is full again
+}
+
+// RateLimitStore keeps the token buckets.  Take removes a token from the bucket for key, creating
+// a full bucket if there isn't one.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// RateLimitKeyFunc returns the client a request is counted against
+type RateLimitKeyFunc func(r *http.Request) string
+
+// KeyByIP counts requests against the client's ip address
+func KeyByIP(r *http.Request) string {
+	return "ip:" + GetClientIP(r)
+}
+
+// KeyByAPIKey counts requests against the name of the api key APIKeyAuth accepted (see GetAPIKeyName),
+// or the client's ip address if the request hasn't been authenticated by api key.  Keys the caller
+// sends aren't trusted until they are checked, so the limiter must run after APIKeyAuth, e.g. added
+// with as.Use after it.
+func KeyByAPIKey(r *http.Request) string {
+	if name := GetAPIKeyName(r); len(name) > 0 {
+		return "key:" + name
+	}
+	return KeyByIP(r)
+}
+
+// KeyBySession counts requests against the principal an AccessPolicy loaded (see GetPrincipalId), or
+// the client's ip address if there isn't one.  The limiter must run after the policy, e.g. added to
+// the handler with WithMiddleware.
+func KeyBySession(r *http.Request) string {
+	if id := GetPrincipalId(r); len(id) > 0 {
+		return "principal:" + id
+	}
+	return KeyByIP(r)
+}
+
+// RateLimiter limits the rate of requests each client can make to each handler
+type RateLimiter struct {
+	Store RateLimitStore
+	Key RateLimitKeyFunc
+	Limits map[string]RateLimit		// keyed by handler base path, "*" for every other handler
+}
+
+// NewRateLimiter creates a RateLimiter with a default limit for every handler
+//
+// Parameters:
+//	store : where the buckets are kept, e.g. NewMemoryRateLimitStore()
+//	key : what requests are counted against, e.g. KeyByIP
+//	limit : the limit for handlers that don't have their own (see Route), or nil for no limit
+//
+// Returns:
+//	*RateLimiter : the limiter created
+//
+// Example:
+//	limiter := webber.NewRateLimiter(webber.NewMemoryRateLimitStore(), webber.KeyByIP, &webber.RateLimit{Rate: 10, Burst: 20})
+//	limiter.Route("/api/hike/", webber.RateLimit{Rate: 1, Burst: 5, Methods: []string{"POST"}})
+//	as.Use(limiter.Middleware())
+//
+func NewRateLimiter(store RateLimitStore, key RateLimitKeyFunc, limit *RateLimit) *RateLimiter {
+	l := new(RateLimiter)
+	l.Store = store
+	l.Key = key
+	l.Limits = make(map[string]RateLimit)
+	if limit != nil {
+		l.Limits["*"] = *limit
+	}
+	return l
+}
+
+// NewRateLimiterFromConfig creates a RateLimiter from config.RateLimits and config.RateLimitKey, or
+// returns nil if there are no limits configured
+//
+// Parameters:
+//	config : the server config
+//	store : where the buckets are kept
+//
+// Returns:
+//	*RateLimiter : the limiter created, or nil
+//	error : if RateLimitKey isn't "ip", "apikey" or "session"
+//
+func NewRateLimiterFromConfig(config *ServerConfig, store RateLimitStore) (*RateLimiter, error) {
+	if len(config.RateLimits) == 0 {
+		return nil, nil
+	}
+	var key RateLimitKeyFunc
+	switch config.RateLimitKey {
+	case "", "ip":
+		key = KeyByIP
+	case "apikey":
+		key = KeyByAPIKey
+	case "session":
+		key = KeyBySession
+	default:
+		return nil, errors.New("unknown RateLimitKey " + config.RateLimitKey)
+	}
+	l := NewRateLimiter(store, key, nil)
+	for path, limit := range config.RateLimits {
+		l.Route(path, limit)
+	}
+	return l, nil
+}
+
+// Route sets the limit for the handler with basePath.  Returns l so calls can be chained.
+func (l *RateLimiter) Route(basePath string, limit RateLimit) *RateLimiter {
+	l.Limits[basePath] = limit
+	return l
+}
+
+// Allow takes a token for the request, setting the RateLimit-* headers on the response.  If the
+// client is over its limit, it returns a 429 with a Retry-After header and returns false.  If the
+// store fails, the request is allowed.
+//
+// Parameters:
+//	h : the handler the request is for
+//	w : the response writer
+//	r : the request
+//
+// Returns:
+//	bool : true if the request should go ahead
+//
+func (l *RateLimiter) Allow(h WebHandler, w http.ResponseWriter, r *http.Request) bool {
+	path := h.BasePath()
+	limit, ok := l.Limits[path]
+	if !ok {
+		limit, ok = l.Limits["*"]
+	}
+	if !ok || !limit.appliesTo(r.Method) {
+		return true
+	}
+
+	res, err := l.Store.Take(r.Context(), path + "|" + l.Key(r), limit)
+	if err != nil {
+		GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Rate limit store failed, allowing request: %s", err), nil)
+		return true
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Rate limit exceeded for %s %s", r.Method, r.URL.Path), map[string]string{"client_ip": GetClientIP(r)})
+		ReturnError(w, r, http.StatusTooManyRequests, "Rate limit exceeded")
+		return false
+	}
+	return true
+}
+
+// Middleware returns the limiter as Middleware, for AppServer.Use or WithMiddleware
+func (l *RateLimiter) Middleware() Middleware {
+	return func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if l.Allow(h, w, r) {
+				next(w, r)
+			}
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+///////////////////////////////////////////////////
+// Stores
+//
+
+type tokenBucket struct {
+	tokens float64
+	updated time.Time
+	limit RateLimit			// the limit the bucket was last used with, for sweep
+}
+
+// MemoryRateLimitStore keeps token buckets in memory, so limits apply per instance.  Buckets that
+// have refilled are removed periodically.
+type MemoryRateLimitStore struct {
+	mu sync.Mutex
+	buckets map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	s := new(MemoryRateLimitStore)
+	s.buckets = make(map[string]*tokenBucket)
+	s.lastSweep = time.Now()
+	return s
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	return s.take(key, limit, time.Now()), nil
+}
+
+// take removes a token from key's bucket as of now
+func (s *MemoryRateLimitStore) take(key string, limit RateLimit, now time.Time) RateLimitResult {
+	burst := float64(limit.Burst)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, updated: now}
+		s.buckets[key] = b
+	}
+	if limit.Rate > 0 {
+		b.tokens = math.Min(burst, b.tokens + now.Sub(b.updated).Seconds() * limit.Rate)
+	}
+	b.updated = now
+	b.limit = limit
+
+	res := RateLimitResult{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else if limit.Rate > 0 {
+		res.RetryAfter = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	} else {
+		res.RetryAfter = time.Hour
+	}
+	res.Remaining = int(b.tokens)
+	if limit.Rate > 0 {
+		res.Reset = time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	return res
+}
+
+// sweep removes buckets that would be full by now, about once a minute
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for k, b := range s.buckets {
+		if b.limit.Rate > 0 && b.tokens + now.Sub(b.updated).Seconds() * b.limit.Rate >= float64(b.limit.Burst) {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+// CacheServerRateLimitStore keeps the token buckets in a cacheserver, so limits are shared by all
+// the instances of a service
+type CacheServerRateLimitStore struct {
+	client *HttpClient
+	baseUrl string
+}
+
+// NewCacheServerRateLimitStore creates a store using the cacheserver's ratelimit api
+//
+// Parameters:
+//	client : the client to call the cacheserver with
+//	baseUrl : the url of the ratelimit api, e.g. "http://localhost:8090/api/ratelimit"
+//
+// Returns:
+//	*CacheServerRateLimitStore : the store created
+//
+func NewCacheServerRateLimitStore(client *HttpClient, baseUrl string) *CacheServerRateLimitStore {
+	s := new(CacheServerRateLimitStore)
+	s.client = client
+	s.baseUrl = baseUrl
+	return s
+}
+
+func (s *CacheServerRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	var res RateLimitResult
+	err := s.client.DoJson(ctx, "POST", s.baseUrl + "/" + url.PathEscape(key), limit, &res, nil)
+	return res, err
+}
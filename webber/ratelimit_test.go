@@ -0,0 +1,82 @@
+package webber
+
+import (
+	"time"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+// a bucket allows Burst requests at once, then refills at Rate
+func TestTokenBucket(t *testing.T) {
+	s := NewMemoryRateLimitStore()
+	limit := RateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if res := s.take("k", limit, now); !res.Allowed || res.Remaining != 2 - i {
+			t.Fatalf("TestTokenBucket request %d unexpected %+v", i, res)
+		}
+	}
+	res := s.take("k", limit, now)
+	if res.Allowed || res.RetryAfter != 500 * time.Millisecond || res.Reset != 1500 * time.Millisecond {
+		t.Fatalf("TestTokenBucket expected a denial for 500ms, got %+v", res)
+	}
+	if res := s.take("k", limit, now.Add(500 * time.Millisecond)); !res.Allowed {
+		t.Fatalf("TestTokenBucket expected a token after 500ms, got %+v", res)
+	}
+	if res := s.take("other", limit, now); !res.Allowed {
+		t.Fatalf("TestTokenBucket expected other keys to have their own bucket, got %+v", res)
+	}
+}
+
+// over the limit, the middleware returns 429 with Retry-After and RateLimit headers, and only
+// limits the methods it was asked to
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryRateLimitStore(), KeyByIP, nil)
+	limiter.Route("/trace", RateLimit{Rate: 0.5, Burst: 1, Methods: []string{"POST"}})
+	chain := limiter.Middleware()(&traceHandler{}, func(w http.ResponseWriter, r *http.Request) {})
+
+	send := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		chain(w, httptest.NewRequest(method, "/trace/x", nil))
+		return w
+	}
+	if w := send("POST"); w.Code != 200 || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("TestRateLimiter first POST got %d %v", w.Code, w.Header())
+	}
+	w := send("POST")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" || w.Header().Get("RateLimit-Limit") != "1" {
+		t.Fatalf("TestRateLimiter second POST got %d %v", w.Code, w.Header())
+	}
+	if w := send("GET"); w.Code != 200 || len(w.Header().Get("RateLimit-Limit")) > 0 {
+		t.Fatalf("TestRateLimiter GET should not be limited, got %d %v", w.Code, w.Header())
+	}
+}
+
+// keys the caller sends are only trusted once APIKeyAuth has accepted them, so made up keys share
+// the ip's bucket
+func TestRateLimitByAPIKey(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryRateLimitStore(), KeyByAPIKey, &RateLimit{Rate: 0.5, Burst: 1})
+	chain := limiter.Middleware()(&traceHandler{}, func(w http.ResponseWriter, r *http.Request) {})
+
+	send := func(key string, name string) int {
+		w := httptest.NewRecorder()
+		r := withRequestContext(w, httptest.NewRequest("GET", "/trace/x", nil))
+		r.Header.Set(API_KEY_HEADER, key)
+		GetRequestContext(r).apiKeyName = name
+		chain(w, r)
+		return w.Code
+	}
+	if code := send("made-up-1", ""); code != 200 {
+		t.Fatalf("TestRateLimitByAPIKey first request got %d", code)
+	}
+	if code := send("made-up-2", ""); code != http.StatusTooManyRequests {
+		t.Fatalf("TestRateLimitByAPIKey expected a new unchecked key to share the ip bucket, got %d", code)
+	}
+	if code := send("valid", "hikes"); code != 200 {
+		t.Fatalf("TestRateLimitByAPIKey expected an accepted key to have its own bucket, got %d", code)
+	}
+	if code := send("rotated", "hikes"); code != http.StatusTooManyRequests {
+		t.Fatalf("TestRateLimitByAPIKey expected a rotated key to keep its bucket, got %d", code)
+	}
+}
@@ -0,0 +1,221 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"sync"
+	"context"
+	"net/http"
+	"jmh/goweb/logger"
+)
+
+// RequestContext holds the information webber keeps for a request while it is handled: the
+// correlation id, a logger that logs with it, the session (once read) and the route params
+// pulled out of the path by ParsePathAndQuery.  AppServer and DispatchMethod attach one to
+// every request's context, and handlers get it with GetRequestContext.
+type RequestContext struct {
+	CorrelationId string
+	Logger *RequestLogger
+	ClientIP string				// the client's ip address, resolved through trusted proxies
+	Scheme string				// "http" or "https", as the client sent it
+	Host string					// the host the client asked for
+
+	mu sync.Mutex
+	params map[string]string
+	sessionRead bool			// true once GetSession has looked for the session
+	haveSession bool
+	sessionKey string
+	sessionData []byte			// the session data json, if there was any
+	nonce string				// the Content-Security-Policy nonce, see GetCSPNonce
+	apiKeyName string			// the name of the api key the request was authenticated with, see GetAPIKeyName
+	principalId string			// the id of the principal an AccessPolicy authorized, see GetPrincipalId
+}
+
+type requestContextKey struct{}
+
+// RequestLogger logs through logger.StdLogger with the request's correlation id, and any keys it
+// was created with added to every entry
+type RequestLogger struct {
+	CorrelationId string
+	Keys map[string]string
+}
+
+// LOG writes a log entry with the request's correlation id
+//
+// Parameters:
+//	level : the logger.LogLevel of the entry
+//	msg : the message to log
+//	keys : (optional) additional keys for the entry, which override the logger's own
+//
+// Returns:
+//	none
+//
+func (l *RequestLogger) LOG(level logger.LogLevel, msg string, keys map[string]string) {
+	if len(l.Keys) > 0 {
+		merged := make(map[string]string, len(l.Keys) + len(keys))
+		for k, v := range l.Keys {
+			merged[k] = v
+		}
+		for k, v := range keys {
+			merged[k] = v
+		}
+		keys = merged
+	}
+	logger.StdLogger.LOG(level, l.CorrelationId, msg, keys)
+}
+
+// With returns a logger with the request's correlation id and keys, plus fields
+//
+// Example:
+//	log := webber.GetLogger(r).With(map[string]interface{}{"hike": name})
+//	log.Infof("found %d reviews in %s", len(reviews), time.Since(start))
+//
+func (l *RequestLogger) With(fields map[string]interface{}) *logger.FieldLogger {
+	all := make(map[string]interface{}, len(l.Keys) + len(fields))
+	for k, v := range l.Keys {
+		all[k] = v
+	}
+	for k, v := range fields {
+		all[k] = v
+	}
+	return logger.With(nil, all).WithCorrelationId(l.CorrelationId)
+}
+
+// these format the message with fmt.Sprintf and log it with the request's correlation id and keys
+func (l *RequestLogger) Debugf(format string, args ...interface{}) { l.With(nil).Debugf(format, args...) }
+func (l *RequestLogger) Infof(format string, args ...interface{}) { l.With(nil).Infof(format, args...) }
+func (l *RequestLogger) Warnf(format string, args ...interface{}) { l.With(nil).Warnf(format, args...) }
+func (l *RequestLogger) Errorf(format string, args ...interface{}) { l.With(nil).Errorf(format, args...) }
+
+// withRequestContext attaches a RequestContext to r if it doesn't already have one, using the
+// inbound correlation-id header or, if there isn't one or it isn't a ValidCorrelationId, a new id,
+// and echoes the id back on the response
+func withRequestContext(w http.ResponseWriter, r *http.Request) *http.Request {
+	return withRequestContextFrom(w, r, nil)
+}
+
+// withRequestContextFrom is withRequestContext, resolving the client's address, scheme and host
+// through proxies (nil to trust none)
+func withRequestContextFrom(w http.ResponseWriter, r *http.Request, proxies *TrustedProxies) *http.Request {
+	if rc := RequestContextFromContext(r.Context()); rc != nil {
+		return r
+	}
+	rc := new(RequestContext)
+	rc.CorrelationId = r.Header.Get(CORRELATION_ID_HEADER)
+	if !ValidCorrelationId(rc.CorrelationId) {
+		rc.CorrelationId = logger.GenerateCorrelationId()
+	}
+	rc.Logger = &RequestLogger{CorrelationId: rc.CorrelationId}
+	rc.params = make(map[string]string)
+	rc.ClientIP, rc.Scheme, rc.Host = proxies.Resolve(r)
+	w.Header().Set(CORRELATION_ID_HEADER, rc.CorrelationId)
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc))
+}
+
+// RequestContextFromContext returns the RequestContext carried by ctx, or nil.  Use this with the
+// context passed to HttpClient.Do and other calls made on behalf of a request.
+func RequestContextFromContext(ctx context.Context) *RequestContext {
+	rc, _ := ctx.Value(requestContextKey{}).(*RequestContext)
+	return rc
+}
+
+// GetRequestContext returns the request's RequestContext, or nil if it wasn't dispatched by webber
+func GetRequestContext(r *http.Request) *RequestContext {
+	return RequestContextFromContext(r.Context())
+}
+
+// GetLogger returns the logger for the request, which logs with its correlation id.  It works
+// (using the correlation-id header, if any) even if the request wasn't dispatched by webber.
+//
+// Parameters:
+//	r : the request being handled
+//
+// Returns:
+//	*RequestLogger : the logger to use
+//
+// Example:
+//	webber.GetLogger(r).LOG(logger.INFO, "HikeServer GET called", nil)
+//
+func GetLogger(r *http.Request) *RequestLogger {
+	if rc := GetRequestContext(r); rc != nil {
+		return rc.Logger
+	}
+	return &RequestLogger{CorrelationId: GetCorrelationId(r)}
+}
+
+// GetRouteParams returns a copy of the path vars ParsePathAndQuery and ParsePathAndQueryFlat have
+// pulled out of the request's path
+func GetRouteParams(r *http.Request) map[string]string {
+	params := make(map[string]string)
+	if rc := GetRequestContext(r); rc != nil {
+		rc.mu.Lock()
+		for k, v := range rc.params {
+			params[k] = v
+		}
+		rc.mu.Unlock()
+	}
+	return params
+}
+
+// GetRouteParam returns the named path var, or "" if there isn't one
+func GetRouteParam(r *http.Request, name string) string {
+	if rc := GetRequestContext(r); rc != nil {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return rc.params[name]
+	}
+	return ""
+}
+
+// setRouteParam records a path var in the request's context
+func setRouteParam(r *http.Request, name string, value string) {
+	if rc := GetRequestContext(r); rc != nil {
+		rc.mu.Lock()
+		rc.params[name] = value
+		rc.mu.Unlock()
+	}
+}
+
+// cachedSession returns the session GetSession read earlier for this request, if it has
+func (rc *RequestContext) cachedSession() (read bool, have bool, key string, data []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.sessionRead, rc.haveSession, rc.sessionKey, rc.sessionData
+}
+
+// setSession records the session GetSession read, so later calls don't go back to the db
+func (rc *RequestContext) setSession(have bool, key string, data []byte) {
+	rc.mu.Lock()
+	rc.sessionRead = true
+	rc.haveSession = have
+	rc.sessionKey = key
+	rc.sessionData = data
+	rc.mu.Unlock()
+}
+
+// setNonce records the request's Content-Security-Policy nonce
+func (rc *RequestContext) setNonce(nonce string) {
+	rc.mu.Lock()
+	rc.nonce = nonce
+	rc.mu.Unlock()
+}
@@ -0,0 +1,68 @@
+package webber
+
+import (
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+// routeHandler parses a path var and calls upstream with the request
+type routeHandler struct {
+	traceHandler
+	hike string
+}
+
+func (h *routeHandler) BasePath() string { return "/hike/" }
+func (h *routeHandler) Name() string { return "RouteHandler" }
+
+func (h *routeHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	ParsePathAndQueryFlat(r, r.URL.Path[len("/hike/"):], map[int]string{0: "hike_name"})
+	h.hike = GetRouteParam(r, "hike_name")
+	h.traceHandler.HandleGet(w, r)
+}
+
+// the inbound correlation id is echoed back and sent upstream, without changing the request headers
+func TestRequestContext(t *testing.T) {
+	var outbound string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outbound = r.Header.Get(CORRELATION_ID_HEADER)
+	}))
+	defer upstream.Close()
+	h := &routeHandler{traceHandler: traceHandler{client: newTestClient(nil, nil), upstream: upstream.URL}}
+
+	r := httptest.NewRequest("GET", "/hike/rainier", nil)
+	r.Header.Set(CORRELATION_ID_HEADER, "abc123")
+	w := httptest.NewRecorder()
+	DispatchMethod(h, w, r)
+	if w.Header().Get(CORRELATION_ID_HEADER) != "abc123" || outbound != "abc123" {
+		t.Fatalf("TestRequestContext expected abc123 echoed and sent upstream, got %q and %q", w.Header().Get(CORRELATION_ID_HEADER), outbound)
+	}
+	if h.hike != "rainier" {
+		t.Fatalf("TestRequestContext expected route param rainier, got %q", h.hike)
+	}
+
+	// without an inbound id, one is generated, echoed, and used upstream
+	r = httptest.NewRequest("GET", "/hike/baker", nil)
+	w = httptest.NewRecorder()
+	DispatchMethod(h, w, r)
+	id := w.Header().Get(CORRELATION_ID_HEADER)
+	if len(id) == 0 || outbound != id || len(r.Header.Get(CORRELATION_ID_HEADER)) > 0 {
+		t.Fatalf("TestRequestContext expected a generated id sent upstream, got %q and %q", id, outbound)
+	}
+
+	// ids that are too long or have other characters are replaced
+	for _, bad := range []string{strings.Repeat("a", 65), "abc 123", "abc\"><script>", "ünïcode"} {
+		r = httptest.NewRequest("GET", "/hike/adams", nil)
+		r.Header.Set(CORRELATION_ID_HEADER, bad)
+		w = httptest.NewRecorder()
+		DispatchMethod(h, w, r)
+		id = w.Header().Get(CORRELATION_ID_HEADER)
+		if id == bad || !ValidCorrelationId(id) || outbound != id {
+			t.Fatalf("TestRequestContext expected %q to be replaced, got %q and %q", bad, id, outbound)
+		}
+	}
+	if !ValidCorrelationId("req-1.2_" + strings.Repeat("x", 56)) {
+		t.Fatalf("TestRequestContext expected a 64 character id to be valid")
+	}
+}
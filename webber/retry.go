@@ -0,0 +1,334 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"errors"
+	"sync"
+	"time"
+	"strconv"
+	"net/http"
+	"math/rand"
+	"jmh/goweb/logger"
+)
+
+// RetryPolicy controls how HttpClient retries failed requests.  A request is retried if it failed
+// with a network error or one of the RetryStatuses, and only if the method is idempotent unless
+// RetryNonIdempotent is set.  Delays between attempts are jittered exponential backoff, unless the
+// response has a Retry-After header, which is honored as long as it is no more than MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts int				// total attempts, including the first.  1 or less disables retries
+	BaseDelay time.Duration		// the backoff before the first retry, doubled for each one after
+	MaxDelay time.Duration		// the longest we will wait between attempts
+	RetryStatuses []int			// response statuses that are retried
+	RetryNonIdempotent bool		// if true, POST and PATCH are retried as well
+}
+
+// DefaultRetryPolicy returns a policy of 3 attempts, backing off from 100ms up to 5s, retrying
+// 429, 502, 503 and 504 responses for idempotent methods
+func DefaultRetryPolicy() *RetryPolicy {
+	p := new(RetryPolicy)
+	p.MaxAttempts = 3
+	p.BaseDelay = 100 * time.Millisecond
+	p.MaxDelay = 5 * time.Second
+	p.RetryStatuses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	return p
+}
+
+// isIdempotent returns true for methods that are safe to repeat
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryable returns true if the response status is one the policy retries
+func (p *RetryPolicy) retryable(status int) bool {
+	for _, s := range p.RetryStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the jittered delay before the retry following attempt (1 based)
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	// full jitter, so clients that failed together don't all retry together
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// nextDelay decides if a request should be retried after attempt (1 based), and how long to wait
+// before doing so.
+func (p *RetryPolicy) nextDelay(attempt int, method string, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	if !p.RetryNonIdempotent && !isIdempotent(method) {
+		return 0, false
+	}
+	if err != nil {
+		return p.backoff(attempt), true
+	}
+	if !p.retryable(resp.StatusCode) {
+		return 0, false
+	}
+	if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+		if wait > p.MaxDelay {
+			// longer than we're willing to wait, let the caller have the response
+			return 0, false
+		}
+		return wait, true
+	}
+	return p.backoff(attempt), true
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or an http date
+func parseRetryAfter(h string) (time.Duration, bool) {
+	if len(h) == 0 {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		wait := time.Until(t)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+///////////////////////////////////////////////////
+// Circuit breaker
+//
+
+// ErrCircuitOpen is returned by HttpClient when the circuit breaker for a host is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitState is the state of a host's circuit breaker
+type CircuitState int
+const (
+	CircuitClosed CircuitState = iota	// requests flow normally
+	CircuitOpen							// requests fail immediately with ErrCircuitOpen
+	CircuitHalfOpen						// a limited number of probe requests are let through
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerConfig controls the circuit breakers HttpClient keeps for each host.  After
+// FailureThreshold consecutive failures (network errors or 5xx responses) the breaker opens and
+// requests fail immediately.  After OpenDuration it goes half-open and lets HalfOpenProbes requests
+// through: if they succeed it closes, and if one fails it opens again.  Fields left at zero (or
+// less) take their value from DefaultCircuitBreakerConfig.
+type CircuitBreakerConfig struct {
+	FailureThreshold int
+	OpenDuration time.Duration
+	HalfOpenProbes int
+}
+
+// DefaultCircuitBreakerConfig returns a config that opens after 5 failures, for 30 seconds, and
+// probes with a single request
+func DefaultCircuitBreakerConfig() *CircuitBreakerConfig {
+	config := new(CircuitBreakerConfig)
+	config.FailureThreshold = 5
+	config.OpenDuration = 30 * time.Second
+	config.HalfOpenProbes = 1
+	return config
+}
+
+// circuitBreaker tracks the health of a single host
+type circuitBreaker struct {
+	mu sync.Mutex
+	host string
+	config *CircuitBreakerConfig
+	state CircuitState
+	failures int		// consecutive failures while closed
+	openedAt time.Time
+	probes int			// probes let through while half-open
+	successes int		// successful probes while half-open
+	onChange func(host string, from CircuitState, to CircuitState)
+}
+
+// setState changes the state and reports it.  Must hold b.mu
+func (b *circuitBreaker) setState(state CircuitState) {
+	from := b.state
+	b.state = state
+	b.failures = 0
+	b.probes = 0
+	b.successes = 0
+	if state == CircuitOpen {
+		b.openedAt = time.Now()
+	}
+	logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Circuit breaker for %s changed from %s to %s", b.host, from, state),
+		map[string]string{"host": b.host, "circuit_state": state.String()})
+	if b.onChange != nil {
+		b.onChange(b.host, from, state)
+	}
+}
+
+// allow returns ErrCircuitOpen if a request to the host should not be made right now
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen {
+		if time.Since(b.openedAt) < b.config.OpenDuration {
+			return ErrCircuitOpen
+		}
+		b.setState(CircuitHalfOpen)
+	}
+	if b.state == CircuitHalfOpen {
+		if b.probes >= b.config.HalfOpenProbes {
+			return ErrCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a request that allow let through
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.setState(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		if failed {
+			b.setState(CircuitOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenProbes {
+			b.setState(CircuitClosed)
+		}
+	}
+}
+
+// release gives back the half open probe taken by allow, for a request that ended without saying
+// anything about the host, e.g. because the caller cancelled it
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen && b.probes > b.successes {
+		b.probes--
+	}
+}
+
+// State returns the current state of the breaker
+func (b *circuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakerSet holds a circuit breaker for each host an HttpClient talks to
+type breakerSet struct {
+	mu sync.Mutex
+	config *CircuitBreakerConfig
+	breakers map[string]*circuitBreaker
+	onChange func(host string, from CircuitState, to CircuitState)
+}
+
+// newBreakerSet copies config, filling in defaults for any field that is zero or less, since a
+// breaker with no half open probes could never close again
+func newBreakerSet(config *CircuitBreakerConfig, onChange func(string, CircuitState, CircuitState)) *breakerSet {
+	s := new(breakerSet)
+	defaults := DefaultCircuitBreakerConfig()
+	s.config = new(CircuitBreakerConfig)
+	*s.config = *config
+	if s.config.FailureThreshold <= 0 {
+		s.config.FailureThreshold = defaults.FailureThreshold
+	}
+	if s.config.OpenDuration <= 0 {
+		s.config.OpenDuration = defaults.OpenDuration
+	}
+	if s.config.HalfOpenProbes <= 0 {
+		s.config.HalfOpenProbes = defaults.HalfOpenProbes
+	}
+	s.breakers = make(map[string]*circuitBreaker)
+	s.onChange = onChange
+	return s
+}
+
+// get returns the breaker for host, creating it if needed
+func (s *breakerSet) get(host string) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[host]
+	if !ok {
+		b = &circuitBreaker{host: host, config: s.config, state: CircuitClosed, onChange: s.onChange}
+		s.breakers[host] = b
+	}
+	return b
+}
+
+// states returns the current state of each host's breaker
+func (s *breakerSet) states() map[string]CircuitState {
+	s.mu.Lock()
+	hosts := make([]*circuitBreaker, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		hosts = append(hosts, b)
+	}
+	s.mu.Unlock()
+	states := make(map[string]CircuitState)
+	for _, b := range hosts {
+		states[b.host] = b.State()
+	}
+	return states
+}
@@ -0,0 +1,287 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"strconv"
+	"strings"
+	"net/http"
+	"crypto/rand"
+	"html/template"
+	"encoding/base64"
+)
+
+// CSP sources
+const (
+	CSPSelf = "'self'"
+	CSPNone = "'none'"
+	CSPUnsafeInline = "'unsafe-inline'"
+	CSPUnsafeEval = "'unsafe-eval'"
+	CSPStrictDynamic = "'strict-dynamic'"
+	CSPNonce = "'nonce'"			// replaced with 'nonce-<the request's nonce>' for each request
+)
+
+// CSPBuilder builds a Content-Security-Policy from typed directives.  Directives are written in
+// the order they were first set.
+//
+// Example:
+//	csp := webber.NewCSP().DefaultSrc(webber.CSPSelf).ScriptSrc(webber.CSPSelf, webber.CSPNonce).ObjectSrc(webber.CSPNone)
+//
+type CSPBuilder struct {
+	names []string
+	directives map[string][]string
+}
+
+// NewCSP creates an empty CSPBuilder
+func NewCSP() *CSPBuilder {
+	c := new(CSPBuilder)
+	c.directives = make(map[string][]string)
+	return c
+}
+
+// CSPFromMap creates a CSPBuilder from directive names and their sources, as in ServerConfig
+func CSPFromMap(directives map[string][]string) *CSPBuilder {
+	c := NewCSP()
+	names := make([]string, 0, len(directives))
+	for name := range directives {
+		names = append(names, name)
+	}
+	// default-src first, the rest alphabetically, so the header is the same every time
+	sortDirectives(names)
+	for _, name := range names {
+		c.Directive(name, directives[name]...)
+	}
+	return c
+}
+
+func sortDirectives(names []string) {
+	for i := 1; i < len(names); i++ {
+		for j := i; j > 0 && directiveLess(names[j], names[j-1]); j-- {
+			names[j], names[j-1] = names[j-1], names[j]
+		}
+	}
+}
+
+func directiveLess(a string, b string) bool {
+	if a == "default-src" || b == "default-src" {
+		return a == "default-src"
+	}
+	return a < b
+}
+
+// Directive adds sources to any directive, e.g. Directive("worker-src", CSPSelf).  Returns c so
+// calls can be chained.
+func (c *CSPBuilder) Directive(name string, sources ...string) *CSPBuilder {
+	if _, ok := c.directives[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.directives[name] = append(c.directives[name], sources...)
+	return c
+}
+
+func (c *CSPBuilder) DefaultSrc(sources ...string) *CSPBuilder { return c.Directive("default-src", sources...) }
+func (c *CSPBuilder) ScriptSrc(sources ...string) *CSPBuilder { return c.Directive("script-src", sources...) }
+func (c *CSPBuilder) StyleSrc(sources ...string) *CSPBuilder { return c.Directive("style-src", sources...) }
+func (c *CSPBuilder) ImgSrc(sources ...string) *CSPBuilder { return c.Directive("img-src", sources...) }
+func (c *CSPBuilder) ConnectSrc(sources ...string) *CSPBuilder { return c.Directive("connect-src", sources...) }
+func (c *CSPBuilder) FontSrc(sources ...string) *CSPBuilder { return c.Directive("font-src", sources...) }
+func (c *CSPBuilder) ObjectSrc(sources ...string) *CSPBuilder { return c.Directive("object-src", sources...) }
+func (c *CSPBuilder) FrameSrc(sources ...string) *CSPBuilder { return c.Directive("frame-src", sources...) }
+func (c *CSPBuilder) FrameAncestors(sources ...string) *CSPBuilder { return c.Directive("frame-ancestors", sources...) }
+func (c *CSPBuilder) BaseURI(sources ...string) *CSPBuilder { return c.Directive("base-uri", sources...) }
+func (c *CSPBuilder) FormAction(sources ...string) *CSPBuilder { return c.Directive("form-action", sources...) }
+func (c *CSPBuilder) ReportURI(uri string) *CSPBuilder { return c.Directive("report-uri", uri) }
+func (c *CSPBuilder) UpgradeInsecureRequests() *CSPBuilder { return c.Directive("upgrade-insecure-requests") }
+
+// UsesNonce returns true if any directive has the CSPNonce source
+func (c *CSPBuilder) UsesNonce() bool {
+	for _, sources := range c.directives {
+		for _, s := range sources {
+			if s == CSPNonce {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Build returns the policy, with CSPNonce sources replaced by nonce
+//
+// Parameters:
+//	nonce : the request's nonce, see GetCSPNonce
+//
+// Returns:
+//	string : the Content-Security-Policy header value
+//
+func (c *CSPBuilder) Build(nonce string) string {
+	parts := make([]string, 0, len(c.names))
+	for _, name := range c.names {
+		d := name
+		for _, s := range c.directives[name] {
+			if s == CSPNonce {
+				s = "'nonce-" + nonce + "'"
+			}
+			d += " " + s
+		}
+		parts = append(parts, d)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// SecurityHeadersConfig says which security headers are sent.  Empty fields are not sent.
+type SecurityHeadersConfig struct {
+	HSTSMaxAge int					// seconds for Strict-Transport-Security, only sent over https
+	HSTSIncludeSubdomains bool
+	HSTSPreload bool
+	NoSniff bool					// X-Content-Type-Options: nosniff
+	FrameOptions string				// X-Frame-Options, e.g. "DENY" or "SAMEORIGIN"
+	ReferrerPolicy string			// e.g. "strict-origin-when-cross-origin"
+	PermissionsPolicy string		// e.g. "camera=(), microphone=(), geolocation=()"
+	CSP map[string][]string			// Content-Security-Policy directives, e.g. {"default-src": ["'self'"]}.  Use "'nonce'" for the request's nonce
+	CSPReportOnly bool				// send the CSP as Content-Security-Policy-Report-Only, to try it out
+
+	csp *CSPBuilder					// set by SetCSP, overrides CSP
+}
+
+// DefaultSecurityHeaders returns a config with strict settings: a year of HSTS, nosniff, no framing,
+// no referrer to other origins, no camera/microphone/geolocation, and a CSP that only allows the
+// server's own content and scripts with the request's nonce
+func DefaultSecurityHeaders() *SecurityHeadersConfig {
+	c := new(SecurityHeadersConfig)
+	c.HSTSMaxAge = 365 * 24 * 60 * 60
+	c.HSTSIncludeSubdomains = true
+	c.NoSniff = true
+	c.FrameOptions = "DENY"
+	c.ReferrerPolicy = "strict-origin-when-cross-origin"
+	c.PermissionsPolicy = "camera=(), microphone=(), geolocation=()"
+	c.SetCSP(NewCSP().DefaultSrc(CSPSelf).ScriptSrc(CSPSelf, CSPNonce).ObjectSrc(CSPNone).BaseURI(CSPSelf).FrameAncestors(CSPNone))
+	return c
+}
+
+// SetCSP sets the Content-Security-Policy from a builder, replacing the CSP map
+func (c *SecurityHeadersConfig) SetCSP(csp *CSPBuilder) {
+	c.csp = csp
+}
+
+func (c *SecurityHeadersConfig) policy() *CSPBuilder {
+	if c.csp == nil && len(c.CSP) > 0 {
+		c.csp = CSPFromMap(c.CSP)
+	}
+	return c.csp
+}
+
+// SecurityHeaders returns middleware that sets the configured security headers on every response.
+// If the CSP uses a nonce, a new one is made for each request; get it with GetCSPNonce.
+//
+// Parameters:
+//	config : the headers to send
+//
+// Returns:
+//	Middleware : the security headers middleware
+//
+func SecurityHeaders(config *SecurityHeadersConfig) Middleware {
+	csp := config.policy()
+	useNonce := csp != nil && csp.UsesNonce()
+	return func(h WebHandler, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			hdr := w.Header()
+			if config.HSTSMaxAge > 0 && isHTTPS(r) {
+				v := "max-age=" + strconv.Itoa(config.HSTSMaxAge)
+				if config.HSTSIncludeSubdomains {
+					v += "; includeSubDomains"
+				}
+				if config.HSTSPreload {
+					v += "; preload"
+				}
+				hdr.Set("Strict-Transport-Security", v)
+			}
+			if config.NoSniff {
+				hdr.Set("X-Content-Type-Options", "nosniff")
+			}
+			if len(config.FrameOptions) > 0 {
+				hdr.Set("X-Frame-Options", config.FrameOptions)
+			}
+			if len(config.ReferrerPolicy) > 0 {
+				hdr.Set("Referrer-Policy", config.ReferrerPolicy)
+			}
+			if len(config.PermissionsPolicy) > 0 {
+				hdr.Set("Permissions-Policy", config.PermissionsPolicy)
+			}
+			if csp != nil {
+				nonce := ""
+				if useNonce {
+					r = withRequestContext(w, r)
+					nonce = newNonce()
+					GetRequestContext(r).setNonce(nonce)
+				}
+				name := "Content-Security-Policy"
+				if config.CSPReportOnly {
+					name = "Content-Security-Policy-Report-Only"
+				}
+				hdr.Set(name, csp.Build(nonce))
+			}
+			next(w, r)
+		}
+	}
+}
+
+// newNonce returns 128 random bits, url-safe base64 encoded so templates don't escape it
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// GetCSPNonce returns the nonce for the request's Content-Security-Policy, to put in the nonce
+// attribute of inline <script> and <style> tags.  Returns "" if the CSP doesn't use one.
+func GetCSPNonce(r *http.Request) string {
+	if rc := GetRequestContext(r); rc != nil {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return rc.nonce
+	}
+	return ""
+}
+
+// CSPTemplateFuncs returns template functions for the request, for html/template pages:
+// {{cspNonce}} is the request's nonce.  Funcs changes the template it's called on, so call it on
+// a Clone for each request, never on a template other requests are using.  Or leave the template
+// alone and pass GetCSPNonce(r) in the data.
+//
+// Example:
+//	t := template.Must(template.New("page").Funcs(webber.CSPTemplateFuncs(nil)).Parse(page))
+//	... then for each request
+//	page, err := t.Clone()
+//	page.Funcs(webber.CSPTemplateFuncs(r)).Execute(w, data)
+//	... where the page has <script nonce="{{cspNonce}}">
+//
+func CSPTemplateFuncs(r *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"cspNonce": func() string {
+			if r == nil {
+				return ""
+			}
+			return GetCSPNonce(r)
+		},
+	}
+}
@@ -0,0 +1,72 @@
+package webber
+
+import (
+	"strings"
+	"testing"
+	"net/http"
+	"crypto/tls"
+	"html/template"
+	"net/http/httptest"
+)
+
+// pageHandler renders a page with an inline script using the request's CSP nonce
+type pageHandler struct {
+	page *template.Template
+}
+
+func (h *pageHandler) BasePath() string { return "/page/" }
+func (h *pageHandler) Name() string { return "PageHandler" }
+func (h *pageHandler) HandlePost(w http.ResponseWriter, r *http.Request) {}
+
+func (h *pageHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	t, _ := h.page.Clone()
+	t.Funcs(CSPTemplateFuncs(r)).Execute(w, nil)
+}
+
+// each request gets a new nonce in the CSP header, which templates can use; HSTS is only sent over https
+func TestSecurityHeaders(t *testing.T) {
+	config := DefaultConfig()
+	config.WWWRoot = ""
+	config.SecurityHeaders = DefaultSecurityHeaders()
+	as := NewAppServer(config)
+	page := template.Must(template.New("page").Funcs(CSPTemplateFuncs(nil)).Parse(`<script nonce="{{cspNonce}}">go()</script>`))
+	as.RegisterHandler(&pageHandler{page: page})
+
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/page/", nil)
+		w := httptest.NewRecorder()
+		as.Handler(w, r)
+		csp := w.Header().Get("Content-Security-Policy")
+		body := w.Body.String()
+		nonce := body[strings.Index(body, `nonce="`) + 7 : strings.Index(body, `">`)]
+		if len(nonce) == 0 || !strings.Contains(csp, "script-src 'self' 'nonce-" + nonce + "'") {
+			t.Fatalf("TestSecurityHeaders expected nonce %q in the CSP, got %q", nonce, csp)
+		}
+		nonces = append(nonces, nonce)
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("X-Frame-Options") != "DENY" ||
+				len(w.Header().Get("Referrer-Policy")) == 0 || len(w.Header().Get("Permissions-Policy")) == 0 {
+			t.Fatalf("TestSecurityHeaders expected the security headers, got %v", w.Header())
+		}
+		if len(w.Header().Get("Strict-Transport-Security")) > 0 {
+			t.Fatalf("TestSecurityHeaders expected no HSTS over http")
+		}
+	}
+	if nonces[0] == nonces[1] {
+		t.Fatalf("TestSecurityHeaders expected a new nonce for each request")
+	}
+
+	r := httptest.NewRequest("GET", "/page/", nil)
+	r.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+	as.Handler(w, r)
+	if w.Header().Get("Strict-Transport-Security") != "max-age=31536000; includeSubDomains" {
+		t.Fatalf("TestSecurityHeaders expected HSTS over https, got %q", w.Header().Get("Strict-Transport-Security"))
+	}
+
+	// config CSPs are written in a stable order, default-src first
+	csp := CSPFromMap(map[string][]string{"script-src": {CSPSelf}, "object-src": {CSPNone}, "default-src": {CSPSelf}})
+	if csp.Build("") != "default-src 'self'; object-src 'none'; script-src 'self'" {
+		t.Fatalf("TestSecurityHeaders got CSP %q", csp.Build(""))
+	}
+}
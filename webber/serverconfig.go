@@ -25,6 +25,78 @@ ApiBase : This is the base path for api calls handled by the server.  Any call o
 FileBase : This is the base url path for file calls.  This will be removed from the url path before looking for 
 		files in the WWWRoot.  For example, if FileBase = "files" and WWWRoot = "wwwwroot", then a request for 
 		"www.foo.com/files/img/treasuremap.png"  would look for the file "wwwroot/img/treasuremap.png"
+
+APIKeyFile : Path to a json file of hashed api keys (see FileAPIKeyStore).  If set, servers that support it will
+		require a valid api key on every request.  Default is "", no api keys required.
+
+APIKey : The api key to send on outbound HttpClient calls to other services.  Default is "", none sent.
+
+LoggerOutputs : Where logs are written, each {"Type": <"console", "json", "file", "syslog", "firehose", "cloudwatch",
+		"kinesis" or "elasticsearch">, "MinLevel": <least severe level, default everything LogLevel allows>, ...}.  
+		"file" outputs also have "Path", "MaxSizeMB", "MaxAgeDays" and "MaxBackups"; "syslog" outputs have "Path" for
+		the daemon address, e.g. "udp://logs:514"; "firehose" uses the AWS settings and LoggerFirehoseDeliveryStream;
+		"cloudwatch" has "LogGroup", "LogStream", and "CreateLogGroup" and "CreateLogStream" to create them if they're
+		missing; "kinesis" has "Stream"; "elasticsearch" has "Endpoint" for the cluster's url, "Index" for the daily
+		index prefix, "Username" and "Password" or "APIKey", and "CreateTemplate" to install an index template.  The
+		AWS and elasticsearch outputs send in the background in batches of "BatchSize" at least every 
+		"BatchIntervalMs", and keep entries in "SpillDir" while the service is unavailable.  "cloudwatch" and 
+		"kinesis" can have an "Endpoint" for a local stand in.  Default is firehose (echoed to stdout) if 
+		LoggerFirehoseDeliveryStream is set, otherwise the console, so local development doesn't need AWS.
+
+LogLevel : The least severe level logged: "TRACE", "DEBUG", "INFO", "WARN", "ERROR" or "CRITICAL".  Default is "INFO".
+
+LogComponentLevels : Levels for components that differ from LogLevel, e.g. {"HikeServer": "DEBUG"}.  Entries get
+		their component from the logger.ComponentKey key.  Both can be changed while running, see EnableLogLevels.
+
+LogRedactKeys : Keys whose values are never logged, in addition to logger.DefaultRedactedKeys (passwords, tokens,
+		cookies, etc.), e.g. ["ssn"].
+
+LogRedactPatterns : Regular expressions for sensitive data in messages and values, by name, in addition to the
+		logger.DefaultRedactor patterns (credentials, JWTs, email addresses, card numbers etc.), e.g. 
+		{"account": "\\bACCT-[0-9]{8}\\b"}.  Matches are replaced with "[REDACTED:<name>]".
+
+LogSampleRates : Keep 1 in N entries of each message (with numbers ignored) at a level, e.g. {"INFO": 10}.  The first
+		is always kept.  Default is to keep everything.
+
+LogSampleTemplates : Keep 1 in N entries whose message starts with a prefix, e.g. {"Cannot read cache": 100}, whatever
+		their level.
+
+LogDedupWindowMs : Identical entries within this many milliseconds are collapsed into one, written at the end of the
+		window with a "repeated" count.  Default is 0, no deduplication.  Dropped entries are counted in the
+		logger_entries_dropped_total metric.
+
+AccessLogFormat : The format of the access log entry written for each request, "json" or "clf" (Common Log 
+		Format).  Default is "json".  Set to "" to turn the access log off.
+
+AccessLogHeaders : Request headers to add to each access log entry, e.g. ["Referer"].  Authorization, cookies and
+		api keys are always redacted.
+
+CORS : Which other origins browsers may call the server from, e.g. {"AllowedOrigins": ["https://*.example.com"],
+		"AllowedMethods": ["GET", "POST"], "AllowedHeaders": ["Content-Type"], "AllowCredentials": true, "MaxAge": 600}.
+		Credentials are only allowed for origins listed by name, not ones that only match "*".  Handlers can override
+		it with WithCORS.  Default is nil, cross origin requests are not allowed.
+
+SecurityHeaders : The security headers sent with every response, e.g. {"HSTSMaxAge": 31536000, "NoSniff": true,
+		"FrameOptions": "DENY", "ReferrerPolicy": "strict-origin-when-cross-origin", "PermissionsPolicy": 
+		"camera=()", "CSP": {"default-src": ["'self'"], "script-src": ["'self'", "'nonce'"]}}.  "'nonce'" is 
+		replaced with a new nonce for each request, see GetCSPNonce.  HSTS is only sent over https.  Default 
+		is nil, no security headers are sent.
+
+TrustedProxies : The networks (e.g. "10.0.0.0/8") or addresses of the load balancers and proxies in front of the
+		server.  When a request comes from one of them, the client's ip address, scheme and host are taken from
+		its Forwarded or X-Forwarded-For/Proto/Host headers, for handlers (GetClientIP, GetScheme, GetHost), 
+		logging and rate limiting.  Default is none, the headers are ignored.
+
+RateLimits : Token bucket limits on how fast each client can call each handler, keyed by the handler's base path
+		(e.g. "/api/cache/") or "*" for every other handler.  Each is {"Rate": <requests per second>, "Burst": 
+		<most requests at once>, "Methods": [<optional, methods limited>]}.  Default is no limits.
+
+RateLimitKey : What rate limits are counted against: "ip" (the default), "apikey" or "session".  "apikey" and
+		"session" count requests that haven't been authenticated yet against their ip.
+
+TraceExporter : Where finished trace spans are sent.  "otlp" posts them to the OpenTelemetry collector at 
+		TraceEndpoint, "file" appends them as json lines to the file TraceEndpoint.  Default is "", spans are
+		not exported (traceparent headers are still propagated).
 	
 */
 type ServerConfig struct {
@@ -38,6 +110,9 @@ type ServerConfig struct {
 
 	SessionCollName string	// name of the collection used for session info in the DB
 
+	APIKeyFile string		// path to the file of hashed api keys accepted by the server
+	APIKey string			// api key to send with outbound calls
+
 	// optional, used for app ID
 	AppName string			// the name of the server app, for logging and id purposes
 	AppVersion string		// the version of the server app
@@ -46,6 +121,37 @@ type ServerConfig struct {
     AWSRegion string		// AWS region it is launched in
     AWSProfile string		// profile in  ~/.aws/credentials to use for auth to aWS
     LoggerFirehoseDeliveryStream string 	// name of the firehose delivery stream to use
+
+	// optional, used for logging
+	LoggerOutputs []LoggerOutput	// where logs go, see NewLoggerFromConfig.  Default is firehose if LoggerFirehoseDeliveryStream is set, otherwise the console
+	LogLevel string					// least severe level logged, default "INFO"
+	LogComponentLevels map[string]string	// levels for components that differ from LogLevel
+	LogRedactKeys []string			// more keys whose values are never logged
+	LogRedactPatterns map[string]string	// more regular expressions for sensitive data, by name
+	LogSampleRates map[string]int	// keep 1 in N entries of each message at the level
+	LogSampleTemplates map[string]int	// keep 1 in N entries whose message starts with the prefix
+	LogDedupWindowMs int			// collapse identical entries within the window
+
+	// optional, used for access logging
+	AccessLogFormat string		// "json", "clf", or "" for no access log
+	AccessLogHeaders []string	// request headers to include in the access log (sensitive ones are redacted)
+
+	// optional, used for cross origin requests
+	CORS *CORSConfig			// which other origins may call the server's handlers, nil for none
+
+	// optional, used for security headers
+	SecurityHeaders *SecurityHeadersConfig	// HSTS, CSP etc. sent with every response, nil for none
+
+	// optional, used when running behind a load balancer or other proxies
+	TrustedProxies []string		// CIDRs or addresses of proxies whose X-Forwarded-* and Forwarded headers are believed
+
+	// optional, used for rate limiting
+	RateLimits map[string]RateLimit	// limits keyed by handler base path, "*" for all other handlers
+	RateLimitKey string				// what requests are counted against: "ip" (default), "apikey" or "session"
+
+	// optional, used for tracing
+	TraceExporter string	// where spans are exported: "otlp", "file", or "" for no export
+	TraceEndpoint string	// the OTLP collector url (e.g. http://localhost:4318/v1/traces) or the file path
 }
 
 
@@ -59,6 +165,7 @@ func DefaultConfig () *ServerConfig {
 	config.DefaultFile = "index.html"
 	config.ApiBase = "api"
 	config.FileBase = "/"
+	config.AccessLogFormat = AccessLogJSON
 
 	return config
 }
@@ -47,6 +47,11 @@ func CreateSessionDbCollection ( cDb *wtmcache.Db, sessionCollName string)  {
 	sessionColl = cDb.NewCollection(sessionCollName, "sessionkey", 14*60*24*time.Minute, 14*60*24*time.Minute)
 }
 
+// SessionCollection returns the collection sessions are stored in, or nil if there isn't one
+func SessionCollection() *wtmcache.Collection {
+	return sessionColl
+}
+
 // MakeSession creates a session key, adds it as a cookie, writes any provided sessionData to
 // the session collection (if one exists) and returns the sessionKey
 // 
@@ -63,17 +68,22 @@ func MakeSession (w http.ResponseWriter, sessionData interface{}) (string, error
 	http.SetCookie(w, &cookie)
 	var err error
 	if ( sessionData != nil && sessionColl != nil ) {
-		dataJson, err := json.Marshal(sessionData)
+		var dataJson []byte
+		dataJson, err = json.Marshal(sessionData)
 		if ( err == nil) {
 			doc := sessionDocument{SessionKey:sessionKey, Data:dataJson}
-			logger.StdLogger.LOG(logger.INFO, "", fmt.Sprintln("writing session to db ", doc), nil)
+			// not the key or data, they're as good as the user's credentials
+			logger.Debugf("writing new session to db, %d bytes of data", len(dataJson))
 			sessionColl.Write(doc)
 		}
 	}
 	return sessionKey, err
 }
 
-// GetSession returns a session if one exists 
+// GetSession returns a session if one exists.  The session is only read from the db once per
+// request; later calls (e.g. from a handler after an AccessPolicy has checked the session) decode
+// the data kept in the request's context.  If there is a session db, a cookie for a session it
+// doesn't have (or can't read) is not a session.
 //
 // Params:
 //	r :	the request to get header info from
@@ -84,9 +94,28 @@ func MakeSession (w http.ResponseWriter, sessionData interface{}) (string, error
 //	an interface{} object for any session data stored by MakeSessionKey
 //
 func GetSession ( r *http.Request, data interface{}) (bool, string) {
+	bHaveSession, sessionKey, _ := readSession(r, data)
+	return bHaveSession, sessionKey
+}
+
+// readSession does the work of GetSession, also returning whether the session's data was found
+// in the db and decoded into data.  Only a session with data can be trusted to say who the caller
+// is, as anyone can send a cookie.
+func readSession ( r *http.Request, data interface{}) (bool, string, bool) {
+	rc := GetRequestContext(r)
+	if rc != nil {
+		if read, have, key, dataJson := rc.cachedSession(); read {
+			if dataJson != nil {
+				json.Unmarshal(dataJson, data)
+			}
+			return have, key, dataJson != nil
+		}
+	}
+
 	session, err := r.Cookie(sessionHeader)	
 	bHaveSession := false
 	sessionKey := ""
+	var dataJson []byte
 	if err == nil  {
 		// check if expired
 		if session.Expires.IsZero() || session.Expires.After(time.Now()) {
@@ -96,15 +125,27 @@ func GetSession ( r *http.Request, data interface{}) (bool, string) {
 				var docTemplate sessionDocument
 				doc, dbErr := sessionColl.Read(session.Value, &docTemplate) 
 				if ( dbErr == nil ) {
-					err := json.Unmarshal(doc.(*sessionDocument).Data, data)
+					dataJson = doc.(*sessionDocument).Data
+					err := json.Unmarshal(dataJson, data)
 					if ( err != nil) {
-						logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintln("Error decoding session data ", err, " for session ", session.Value), nil)
+						// not the key itself, it's as good as the user's credentials
+						keys := map[string]string{"session_hash": HashAPIKey(session.Value)}
+						GetLogger(r).LOG(logger.ERROR, fmt.Sprintln("Error decoding session data ", err), keys)
+						dataJson = nil
 					}
 				}
+				if dataJson == nil {
+					// unknown, expired from the db, or unreadable
+					bHaveSession = false
+					sessionKey = ""
+				}
 			}
 		}
 	}
-	return bHaveSession, sessionKey
+	if rc != nil {
+		rc.setSession(bHaveSession, sessionKey, dataJson)
+	}
+	return bHaveSession, sessionKey, dataJson != nil
 }
 
 // Clears any session
@@ -0,0 +1,366 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"net/http"
+	"encoding/json"
+	"jmh/goweb/logger"
+)
+
+// SSEEvent is one Server-Sent Event.  Only Data is required.
+type SSEEvent struct {
+	Id string				// lets the client resume after it with Last-Event-ID
+	Event string			// the event type, "message" if empty
+	Data string				// the payload, which may have several lines
+	Retry time.Duration		// how long the client should wait before reconnecting
+}
+
+// encode writes the event in the text/event-stream format
+func (e SSEEvent) encode() string {
+	var b strings.Builder
+	if len(e.Id) > 0 {
+		b.WriteString("id: " + stripNewlines(e.Id) + "\n")
+	}
+	if len(e.Event) > 0 {
+		b.WriteString("event: " + stripNewlines(e.Event) + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(e.Data, "\r\n", "\n"), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func stripNewlines(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// SSEStream writes Server-Sent Events to one client.  Its methods are safe to call from any
+// goroutine, and return an error once the client has gone.
+type SSEStream struct {
+	w http.ResponseWriter
+	ctx context.Context
+	mu sync.Mutex
+	closed bool
+	stop chan struct{}
+	stopped chan struct{}
+}
+
+// StartSSE starts an event stream on w, sending the headers and a comment every heartbeat so
+// proxies don't time out an idle stream.  Close the stream before the handler returns.
+//
+// Parameters:
+//	w : the response writer, which must support flushing
+//	r : the request.  The stream ends when its context is done, i.e. the client disconnects
+//	heartbeat : how often to send a heartbeat comment, or 0 for none
+//
+// Returns:
+//	*SSEStream : the stream
+//	error : if w can't stream
+//
+// Example:
+//	stream, err := webber.StartSSE(w, r, 15 * time.Second)
+//	if err != nil { ... }
+//	defer stream.Close()
+//	for p := range progress {
+//		if stream.SendJSON("progress", p) != nil { return }
+//	}
+//
+func StartSSE(w http.ResponseWriter, r *http.Request, heartbeat time.Duration) (*SSEStream, error) {
+	if !canFlush(w) {
+		return nil, errors.New("response writer does not support flushing")
+	}
+	// streams outlive the server's WriteTimeout, if it has one
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")		// stop nginx buffering the stream
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	s := new(SSEStream)
+	s.w = w
+	s.ctx = r.Context()
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.heartbeat(heartbeat)
+	return s, nil
+}
+
+// canFlush returns true if w, or the writer a responseRecorder wraps, is an http.Flusher
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		if rr, ok := w.(*responseRecorder); ok {
+			w = rr.ResponseWriter
+			continue
+		}
+		_, ok := w.(http.Flusher)
+		return ok
+	}
+}
+
+func (s *SSEStream) heartbeat(interval time.Duration) {
+	defer close(s.stopped)
+	if interval <= 0 {
+		<-s.stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Comment("")
+		case <-s.ctx.Done():
+			<-s.stop
+			return
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// write writes and flushes text, unless the stream is closed or the client has gone
+func (s *SSEStream) write(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("event stream is closed")
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := s.w.Write([]byte(text)); err != nil {
+		return err
+	}
+	s.w.(http.Flusher).Flush()
+	return nil
+}
+
+// Send writes an event to the client
+func (s *SSEStream) Send(e SSEEvent) error {
+	return s.write(e.encode())
+}
+
+// SendJSON writes an event with v, marshalled to json, as its data
+func (s *SSEStream) SendJSON(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Send(SSEEvent{Event: event, Data: string(data)})
+}
+
+// Comment writes a comment, which clients ignore
+func (s *SSEStream) Comment(text string) error {
+	return s.write(": " + stripNewlines(text) + "\n\n")
+}
+
+// Done returns a channel that is closed when the client disconnects
+func (s *SSEStream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Close stops the heartbeat and any further writes.  It must be called before the handler returns.
+func (s *SSEStream) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	<-s.stopped
+}
+
+// SSEChannel publishes events to any number of clients, keeping the last few so clients that
+// reconnect with a Last-Event-ID header get the events they missed.  Clients that can't keep up
+// are disconnected, and catch up from the buffer when they reconnect.
+type SSEChannel struct {
+	Heartbeat time.Duration		// how often to send a heartbeat comment, default 15 seconds
+	Retry time.Duration			// (optional) how long clients should wait before reconnecting
+	QueueSize int				// events queued per client before it's disconnected, default 64
+
+	mu sync.Mutex
+	lastId int64
+	replay []SSEEvent			// the last replaySize events, oldest first
+	replaySize int
+	subscribers map[chan SSEEvent]bool
+}
+
+// NewSSEChannel creates an SSEChannel
+//
+// Parameters:
+//	replaySize : how many events to keep for clients that reconnect
+//
+// Returns:
+//	*SSEChannel : the channel created
+//
+// Example:
+//	progress := webber.NewSSEChannel(100)
+//	...
+//	func (h ProgressHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+//		progress.Serve(w, r)
+//	}
+//	...
+//	progress.PublishJSON("progress", status)
+//
+func NewSSEChannel(replaySize int) *SSEChannel {
+	c := new(SSEChannel)
+	c.Heartbeat = 15 * time.Second
+	c.QueueSize = 64
+	c.replaySize = replaySize
+	c.subscribers = make(map[chan SSEEvent]bool)
+	return c
+}
+
+// Publish sends an event to every client, giving it the next id
+//
+// Parameters:
+//	event : the event type, or "" for "message"
+//	data : the payload
+//
+// Returns:
+//	SSEEvent : the event sent
+//
+func (c *SSEChannel) Publish(event string, data string) SSEEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastId++
+	e := SSEEvent{Id: strconv.FormatInt(c.lastId, 10), Event: event, Data: data}
+	if c.replaySize > 0 {
+		if len(c.replay) >= c.replaySize {
+			c.replay = c.replay[1:]
+		}
+		c.replay = append(c.replay, e)
+	}
+	for sub := range c.subscribers {
+		select {
+		case sub <- e:
+		default:
+			// too slow, it can catch up from the replay buffer when it reconnects
+			delete(c.subscribers, sub)
+			close(sub)
+		}
+	}
+	return e
+}
+
+// PublishJSON sends an event with v, marshalled to json, as its data
+func (c *SSEChannel) PublishJSON(event string, v interface{}) (SSEEvent, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return SSEEvent{}, err
+	}
+	return c.Publish(event, string(data)), nil
+}
+
+// Subscribers returns the number of clients connected
+func (c *SSEChannel) Subscribers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.subscribers)
+}
+
+// subscribe registers a new client, returning the buffered events after lastEventId.  If
+// lastEventId isn't known (it's too old, or from before a restart) the whole buffer is returned.
+func (c *SSEChannel) subscribe(lastEventId string) (chan SSEEvent, []SSEEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var missed []SSEEvent
+	if len(lastEventId) > 0 {
+		missed = c.replay
+		for i, e := range c.replay {
+			if e.Id == lastEventId {
+				missed = c.replay[i + 1:]
+				break
+			}
+		}
+		missed = append([]SSEEvent(nil), missed...)
+	}
+	sub := make(chan SSEEvent, c.QueueSize)
+	c.subscribers[sub] = true
+	return sub, missed
+}
+
+func (c *SSEChannel) unsubscribe(sub chan SSEEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscribers[sub] {
+		delete(c.subscribers, sub)
+		close(sub)
+	}
+}
+
+// Serve streams the channel's events to a client until it disconnects, first replaying any it
+// missed since its Last-Event-ID.  Call it from a handler's HandleGet.
+func (c *SSEChannel) Serve(w http.ResponseWriter, r *http.Request) {
+	stream, err := StartSSE(w, r, c.Heartbeat)
+	if err != nil {
+		GetLogger(r).LOG(logger.ERROR, fmt.Sprintf("Unable to stream events: %s", err), nil)
+		ReturnError(w, r, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	defer stream.Close()
+
+	sub, missed := c.subscribe(r.Header.Get("Last-Event-ID"))
+	defer c.unsubscribe(sub)
+	if c.Retry > 0 {
+		if stream.write("retry: " + strconv.FormatInt(c.Retry.Milliseconds(), 10) + "\n\n") != nil {
+			return
+		}
+	}
+	for _, e := range missed {
+		if stream.Send(e) != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case e, ok := <-sub:
+			if !ok {
+				GetLogger(r).LOG(logger.WARN, "Event stream client can't keep up, closing it", nil)
+				return
+			}
+			if stream.Send(e) != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package webber
+
+import (
+	"time"
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+// sseHandler serves an SSEChannel
+type sseHandler struct {
+	channel *SSEChannel
+}
+
+func (h *sseHandler) BasePath() string { return "/events/" }
+func (h *sseHandler) Name() string { return "EventHandler" }
+func (h *sseHandler) HandleGet(w http.ResponseWriter, r *http.Request) { h.channel.Serve(w, r) }
+func (h *sseHandler) HandlePost(w http.ResponseWriter, r *http.Request) {}
+
+// clients get the events they missed since their Last-Event-ID, then live events and heartbeats,
+// and are unsubscribed when they disconnect
+func TestSSE(t *testing.T) {
+	channel := NewSSEChannel(2)
+	channel.Heartbeat = 20 * time.Millisecond
+	channel.Publish("hike", "one")
+	channel.Publish("hike", "two")
+	channel.Publish("hike", "three\nlines")
+
+	config := DefaultConfig()
+	config.WWWRoot = ""
+	as := NewAppServer(config)
+	as.RegisterHandler(&sseHandler{channel: channel})
+	server := httptest.NewServer(http.HandlerFunc(as.Handler))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL + "/events/", nil)
+	req.Header.Set("Last-Event-ID", "2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("TestSSE failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	next := func() string {
+		var lines []string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("TestSSE read failed: %s", err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "|")
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+
+	if e := next(); e != "id: 3|event: hike|data: three|data: lines" {
+		t.Fatalf("TestSSE expected the missed event, got %q", e)
+	}
+	if !waitFor(func() bool { return channel.Subscribers() == 1 }) {
+		t.Fatalf("TestSSE expected a subscriber")
+	}
+	channel.PublishJSON("hike", map[string]string{"name": "four"})
+	for e := next(); e != `id: 4|event: hike|data: {"name":"four"}`; e = next() {
+		if e != ": " {
+			t.Fatalf("TestSSE expected the live event or a heartbeat, got %q", e)
+		}
+	}
+	if e := next(); e != ": " {
+		t.Fatalf("TestSSE expected a heartbeat, got %q", e)
+	}
+
+	cancel()
+	if !waitFor(func() bool { return channel.Subscribers() == 0 }) {
+		t.Fatalf("TestSSE expected the client to be unsubscribed")
+	}
+}
@@ -0,0 +1,559 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"net/http"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"jmh/goweb/logger"
+)
+
+const TRACEPARENT_HEADER = "traceparent"
+const TRACESTATE_HEADER = "tracestate"
+
+// SpanKind says which side of a call a span is for
+type SpanKind int
+const (
+	SpanKindServer SpanKind = 2		// handling an inbound request.  Values match OTLP
+	SpanKindClient SpanKind = 3		// making an outbound request
+)
+
+// SpanContext is the part of a span that is propagated between services in the W3C traceparent
+// and tracestate headers
+type SpanContext struct {
+	TraceId string		// 32 hex digits
+	SpanId string		// 16 hex digits
+	Sampled bool
+	TraceState string	// passed along unchanged
+}
+
+// Span is a timed operation within a trace, such as handling a request or making a call
+type Span struct {
+	SpanContext
+	ParentSpanId string					// empty for the root span of a trace
+	Name string
+	Kind SpanKind
+	StartTime time.Time
+	EndTime time.Time
+	Attributes map[string]string
+	Error bool							// true if the operation failed
+
+	mu sync.Mutex
+	ended bool
+}
+
+// the exporter spans are sent to when they end, and the name of our service.  Set while requests
+// are running, so always read through tracingState.
+var tracingMu sync.RWMutex
+var spanExporter SpanExporter
+var traceServiceName string
+
+// tracingState returns the exporter (nil if tracing is off) and the service name
+func tracingState() (SpanExporter, string) {
+	tracingMu.RLock()
+	defer tracingMu.RUnlock()
+	return spanExporter, traceServiceName
+}
+
+// SpanExporter is the interface for destinations of finished spans
+//
+//	ExportSpans : sends or queues the spans
+//	Shutdown : flushes any queued spans and releases resources
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+	Shutdown() error
+}
+
+// EnableTracing turns on exporting of spans.  Traceparent headers are propagated whether
+// or not tracing is enabled.
+//
+// Parameters:
+//	serviceName : the name of the service, reported with the spans (usually the AppName)
+//	exporter : where finished spans are sent, e.g. NewOTLPExporter(...) or NewFileSpanExporter(...)
+//
+// Returns:
+//	none
+//
+func EnableTracing(serviceName string, exporter SpanExporter) {
+	tracingMu.Lock()
+	traceServiceName = serviceName
+	spanExporter = exporter
+	tracingMu.Unlock()
+}
+
+// EnableTracingFromConfig turns on tracing with the exporter named by config.TraceExporter, which
+// is "otlp" (sending to the collector url in config.TraceEndpoint) or "file" (writing to the file
+// path in config.TraceEndpoint).  Does nothing if TraceExporter is empty.
+//
+// Parameters:
+//	config : the server config
+//
+// Returns:
+//	error : if the exporter is unknown or can't be created
+//
+func EnableTracingFromConfig(config *ServerConfig) error {
+	switch config.TraceExporter {
+	case "":
+		return nil
+	case "otlp":
+		EnableTracing(config.AppName, NewOTLPExporter(config.TraceEndpoint, 512, 5*time.Second))
+	case "file":
+		e, err := NewFileSpanExporter(config.TraceEndpoint)
+		if err != nil {
+			return err
+		}
+		EnableTracing(config.AppName, e)
+	default:
+		return errors.New("unknown trace exporter " + config.TraceExporter)
+	}
+	return nil
+}
+
+// ShutdownTracing flushes any spans waiting to be exported and turns tracing off
+func ShutdownTracing() error {
+	tracingMu.Lock()
+	e := spanExporter
+	spanExporter = nil
+	tracingMu.Unlock()
+	if e != nil {
+		return e.Shutdown()
+	}
+	return nil
+}
+
+// randomHex returns n random bytes as hex, making sure they aren't all zero (which is invalid)
+func randomHex(n int) string {
+	b := make([]byte, n)
+	for {
+		rand.Read(b)
+		for _, c := range b {
+			if c != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
+
+// isHex returns true if s is n lower case hex digits and not all zeros
+func isHex(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTraceparent parses a W3C traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+//
+// Parameters:
+//	h : the header value
+//
+// Returns:
+//	SpanContext : the trace id, parent span id and sampled flag
+//	bool : false if the header is missing or invalid
+//
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if !isHex(parts[1], 32) || !isHex(parts[2], 16) || len(parts[3]) != 2 {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.TraceId = parts[1]
+	sc.SpanId = parts[2]
+	sc.Sampled = flags & 1 == 1
+	return sc, true
+}
+
+// Traceparent formats the span context as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceId + "-" + sc.SpanId + "-" + flags
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span, so spans started from it are its children
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span that is a child of the span in ctx, or the root of a new trace if
+// there isn't one.  Call End on it when the operation finishes.
+//
+// Parameters:
+//	ctx : the context of the operation
+//	name : the name of the operation, e.g. "HikeServer GET"
+//	kind : SpanKindServer or SpanKindClient
+//
+// Returns:
+//	*Span : the span started
+//
+func StartSpan(ctx context.Context, name string, kind SpanKind) *Span {
+	var parent *SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = &p.SpanContext
+	}
+	return startSpan(parent, name, kind)
+}
+
+// startSpan starts a span with the given parent, which may be nil for a new trace
+func startSpan(parent *SpanContext, name string, kind SpanKind) *Span {
+	span := &Span{Name: name, Kind: kind, StartTime: time.Now(), Attributes: make(map[string]string)}
+	span.SpanId = randomHex(8)
+	if parent != nil {
+		span.TraceId = parent.TraceId
+		span.ParentSpanId = parent.SpanId
+		span.Sampled = parent.Sampled
+		span.TraceState = parent.TraceState
+	} else {
+		span.TraceId = randomHex(16)
+		span.Sampled = true
+	}
+	return span
+}
+
+// startServerSpan starts the span for an inbound request, continuing the caller's trace if the
+// request has a valid traceparent header
+func startServerSpan(r *http.Request, name string) *Span {
+	var parent *SpanContext
+	if sc, ok := ParseTraceparent(r.Header.Get(TRACEPARENT_HEADER)); ok {
+		sc.TraceState = r.Header.Get(TRACESTATE_HEADER)
+		parent = &sc
+	}
+	span := startSpan(parent, name, SpanKindServer)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.Path)
+	return span
+}
+
+// inject sets the traceparent and tracestate headers for a call made within span
+func (span *Span) inject(h http.Header) {
+	h.Set(TRACEPARENT_HEADER, span.Traceparent())
+	if len(span.TraceState) > 0 {
+		h.Set(TRACESTATE_HEADER, span.TraceState)
+	}
+}
+
+// SetAttribute adds a key/value to the span
+func (span *Span) SetAttribute(key string, value string) {
+	span.mu.Lock()
+	span.Attributes[key] = value
+	span.mu.Unlock()
+}
+
+// SetError marks the span as failed, with a description of the error
+func (span *Span) SetError(msg string) {
+	span.mu.Lock()
+	span.Error = true
+	span.Attributes["error.message"] = msg
+	span.mu.Unlock()
+}
+
+// End finishes the span and exports it, if tracing is enabled and the trace is sampled.  Calls
+// after the first do nothing.
+func (span *Span) End() {
+	span.mu.Lock()
+	if span.ended {
+		span.mu.Unlock()
+		return
+	}
+	span.ended = true
+	span.EndTime = time.Now()
+	span.mu.Unlock()
+
+	e, _ := tracingState()
+	if e != nil && span.Sampled {
+		err := e.ExportSpans([]*Span{span})
+		if err != nil {
+			logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintf("Error exporting span %s: %s", span.Name, err), nil)
+		}
+	}
+}
+
+///////////////////////////////////////////////////
+// OTLP json encoding
+//
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key string			`json:"key"`
+	Value otlpValue		`json:"value"`
+}
+
+type otlpStatus struct {
+	Code int			`json:"code"`
+}
+
+type otlpSpan struct {
+	TraceId string					`json:"traceId"`
+	SpanId string					`json:"spanId"`
+	ParentSpanId string				`json:"parentSpanId,omitempty"`
+	TraceState string				`json:"traceState,omitempty"`
+	Name string						`json:"name"`
+	Kind int						`json:"kind"`
+	StartTimeUnixNano string		`json:"startTimeUnixNano"`
+	EndTimeUnixNano string			`json:"endTimeUnixNano"`
+	Attributes []otlpAttribute		`json:"attributes"`
+	Status otlpStatus				`json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	}								`json:"scope"`
+	Spans []otlpSpan				`json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}								`json:"resource"`
+	ScopeSpans []otlpScopeSpans		`json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// toOTLP converts a span to its OTLP json form
+func (span *Span) toOTLP() otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	o := otlpSpan{TraceId: span.TraceId, SpanId: span.SpanId, ParentSpanId: span.ParentSpanId, TraceState: span.TraceState,
+		Name: span.Name, Kind: int(span.Kind),
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10), EndTimeUnixNano: strconv.FormatInt(span.EndTime.UnixNano(), 10)}
+	o.Attributes = make([]otlpAttribute, 0, len(span.Attributes))
+	for k, v := range span.Attributes {
+		o.Attributes = append(o.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	if span.Error {
+		o.Status.Code = 2
+	} else {
+		o.Status.Code = 1
+	}
+	return o
+}
+
+// encodeOTLP builds an OTLP/HTTP json export request for spans
+func encodeOTLP(spans []*Span) ([]byte, error) {
+	var rs otlpResourceSpans
+	_, serviceName := tracingState()
+	rs.Resource.Attributes = []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: serviceName}}}
+	var ss otlpScopeSpans
+	ss.Scope.Name = "jmh/goweb/webber"
+	for _, span := range spans {
+		ss.Spans = append(ss.Spans, span.toOTLP())
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+///////////////////////////////////////////////////
+// Exporters
+//
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP/HTTP with json encoding.
+// Spans are queued and sent in batches by a background goroutine.
+type OTLPExporter struct {
+	endpoint string
+	client *http.Client
+	maxQueue int
+	mu sync.Mutex
+	queue []*Span
+	flush chan chan error
+	done chan struct{}
+	dropped int64
+	shutdown sync.Once
+	shutdownErr error
+}
+
+// NewOTLPExporter creates an OTLPExporter and starts its background sender
+//
+// Parameters:
+//	endpoint : the collector's traces url, e.g. "http://localhost:4318/v1/traces"
+//	maxQueue : the most spans queued before new ones are dropped
+//	interval : how often queued spans are sent
+//
+// Returns:
+//	*OTLPExporter : the exporter created
+//
+func NewOTLPExporter(endpoint string, maxQueue int, interval time.Duration) *OTLPExporter {
+	e := new(OTLPExporter)
+	e.endpoint = endpoint
+	e.client = &http.Client{Timeout: 10 * time.Second}
+	e.maxQueue = maxQueue
+	e.flush = make(chan chan error)
+	e.done = make(chan struct{})
+	go e.run(interval)
+	return e
+}
+
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, span := range spans {
+		if len(e.queue) >= e.maxQueue {
+			e.dropped++
+			continue
+		}
+		e.queue = append(e.queue, span)
+	}
+	return nil
+}
+
+// run sends the queue every interval, or when asked to flush
+func (e *OTLPExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.send(); err != nil {
+				fmt.Println("OTLPExporter failed to send spans: ", err)
+			}
+		case reply := <-e.flush:
+			reply <- e.send()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// send posts everything in the queue to the collector
+func (e *OTLPExporter) send() error {
+	e.mu.Lock()
+	spans := e.queue
+	e.queue = nil
+	dropped := e.dropped
+	e.dropped = 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		fmt.Println("OTLPExporter queue full, dropped ", dropped, " spans")
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := encodeOTLP(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	drainAndClose(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Shutdown sends any queued spans and stops the background sender.  Calls after the first return
+// the first's result.
+func (e *OTLPExporter) Shutdown() error {
+	e.shutdown.Do(func() {
+		reply := make(chan error)
+		e.flush <- reply
+		e.shutdownErr = <-reply
+		close(e.done)
+	})
+	return e.shutdownErr
+}
+
+// FileSpanExporter writes each span as a line of OTLP json to a file, which is handy for tests
+// and local development
+type FileSpanExporter struct {
+	mu sync.Mutex
+	f *os.File
+}
+
+// NewFileSpanExporter creates a FileSpanExporter appending to the file at path
+func NewFileSpanExporter(path string) (*FileSpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := new(FileSpanExporter)
+	e.f = f
+	return e, nil
+}
+
+func (e *FileSpanExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, span := range spans {
+		line, err := json.Marshal(span.toOTLP())
+		if err != nil {
+			return err
+		}
+		_, err = e.f.Write(append(line, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *FileSpanExporter) Shutdown() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
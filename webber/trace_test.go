@@ -0,0 +1,150 @@
+package webber
+
+import (
+	"sync"
+	"time"
+	"context"
+	"strings"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"net/http/httptest"
+)
+
+// memoryExporter keeps exported spans for tests to check
+type memoryExporter struct {
+	mu sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *memoryExporter) Shutdown() error { return nil }
+
+// traceHandler calls the upstream url from its GET, passing the inbound request along
+type traceHandler struct {
+	client *HttpClient
+	upstream string
+}
+
+func (h *traceHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.client.Get(h.upstream, r)
+	if err != nil {
+		ReturnError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	resp.Body.Close()
+	w.Write([]byte("ok"))
+}
+func (h *traceHandler) HandlePost(w http.ResponseWriter, r *http.Request) {}
+func (h *traceHandler) BasePath() string { return "/trace" }
+func (h *traceHandler) Name() string { return "TraceHandler" }
+
+func TestParseTraceparent(t *testing.T) {
+	h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(h)
+	if !ok || sc.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanId != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Fatalf("TestParseTraceparent failed to parse %s, got %+v", h, sc)
+	}
+	if sc.Traceparent() != h {
+		t.Fatalf("TestParseTraceparent expected %s, got %s", h, sc.Traceparent())
+	}
+	for _, bad := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Fatalf("TestParseTraceparent accepted %q", bad)
+		}
+	}
+}
+
+// an inbound traceparent is continued by the server span, and the outbound call is its child
+func TestTracePropagation(t *testing.T) {
+	exporter := new(memoryExporter)
+	EnableTracing("tracetest", exporter)
+	defer ShutdownTracing()
+
+	var outbound string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outbound = r.Header.Get(TRACEPARENT_HEADER)
+	}))
+	defer upstream.Close()
+
+	h := &traceHandler{client: newTestClient(nil, nil), upstream: upstream.URL}
+	r := httptest.NewRequest("GET", "/trace", nil)
+	r.Header.Set(TRACEPARENT_HEADER, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	DispatchMethod(h, w, r)
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("TestTracePropagation expected 2 spans, got %d", len(exporter.spans))
+	}
+	client, server := exporter.spans[0], exporter.spans[1]
+	if server.Kind != SpanKindServer || server.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanId != "00f067aa0ba902b7" {
+		t.Fatalf("TestTracePropagation unexpected server span %+v", server)
+	}
+	if client.Kind != SpanKindClient || client.TraceId != server.TraceId || client.ParentSpanId != server.SpanId {
+		t.Fatalf("TestTracePropagation unexpected client span %+v", client)
+	}
+	if outbound != client.Traceparent() {
+		t.Fatalf("TestTracePropagation expected upstream to get %s, got %s", client.Traceparent(), outbound)
+	}
+	if server.Attributes["http.status_code"] != "200" {
+		t.Fatalf("TestTracePropagation expected status 200 on the server span, got %s", server.Attributes["http.status_code"])
+	}
+}
+
+// spans can be ended while tracing is turned on and off, and Shutdown can be called twice
+func TestOTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				StartSpan(context.Background(), "op", SpanKindClient).End()
+			}
+		}()
+	}
+	exporter := NewOTLPExporter(collector.URL, 1000, time.Hour)
+	EnableTracing("otlptest", exporter)
+	wg.Wait()
+	if err := ShutdownTracing(); err != nil {
+		t.Fatalf("TestOTLPExporter Shutdown failed: %s", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- exporter.Shutdown()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("TestOTLPExporter second Shutdown failed: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestOTLPExporter second Shutdown blocked")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, body := range bodies {
+		if !strings.Contains(body, `"otlptest"`) {
+			t.Fatalf("TestOTLPExporter expected the service name in %s", body)
+		}
+	}
+}
@@ -26,8 +26,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"strconv"
 	"encoding/json"
-	"math/rand"
 	"jmh/goweb/logger"
 )
 
@@ -43,18 +43,45 @@ type WebHandler interface {
 	Name() string
 }
 
+// getCorrelationId returns the request's correlation id from its RequestContext or header, or a new
+// one if it has neither.  The request is not modified.
 func getCorrelationId ( r *http.Request) (string) {
-	h := r.Header.Get(CORRELATION_ID_HEADER)
+	h := GetCorrelationId(r)
 	if (len(h) == 0 ) {
-		// create and add one
-		h = fmt.Sprintf("%d", rand.Uint64())
-		r.Header.Add(CORRELATION_ID_HEADER, h)
+		h = logger.GenerateCorrelationId()
 	}
 	return h
 }
 
+// the longest inbound correlation id accepted
+const maxCorrelationIdLength = 64
+
+// ValidCorrelationId returns true if id is safe to accept from a caller, echo back and log: 1 to
+// 64 letters, digits, '.', '_' or '-'
+func ValidCorrelationId(id string) bool {
+	if len(id) == 0 || len(id) > maxCorrelationIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// GetCorrelationId returns the correlation id of the request, which is the inbound correlation-id
+// header (if ValidCorrelationId) or the id generated for the request when it was dispatched.  It
+// returns "" for a request that has neither.
 func GetCorrelationId ( r *http.Request) (string) {
+	if rc := GetRequestContext(r); rc != nil {
+		return rc.CorrelationId
+	}
 	h := r.Header.Get(CORRELATION_ID_HEADER)
+	if !ValidCorrelationId(h) {
+		return ""
+	}
 	return h
 }
 
@@ -63,7 +90,7 @@ func formatReqForLog(r *http.Request) (string) {
 	s := fmt.Sprintf("%s %s Headers:{", r.Method, r.URL)
 	for k, v := range r.Header {
 		s += k + ":[" 
-		for _, vv := range v { s += vv + ","}
+		for _, vv := range v { s += redactHeader(k, vv, nil) + ","}
 		s += "], "
 	}
 	s += "}"
@@ -74,8 +101,24 @@ func formatReqForLog(r *http.Request) (string) {
 // root dispatcher called by all WebHandlers to determine Method and dispatch to appropriate case handler
 func DispatchMethod(h WebHandler, w http.ResponseWriter, r *http.Request) {
 
-	logger.StdLogger.LOG(logger.INFO, getCorrelationId(r), fmt.Sprintf("Inbound request %s", formatReqForLog(r)), nil)
-	
+	// AppServer has normally done this already, but not for handlers served directly
+	r = withRequestContext(w, r)
+
+	// a server span for the handler, continuing the caller's trace if there is one.  Outbound
+	// calls made with r.Context() become its children.
+	span := startServerSpan(r, h.Name() + " " + r.Method)
+	span.SetAttribute("correlation_id", getCorrelationId(r))
+	rr := newResponseRecorder(w)
+	w = rr
+	r = r.WithContext(ContextWithSpan(r.Context(), span))
+	defer func() {
+		span.SetAttribute("http.status_code", strconv.Itoa(rr.Status()))
+		if rr.Status() >= 500 {
+			span.SetError(http.StatusText(rr.Status()))
+		}
+		span.End()
+	}()
+
 	switch {
 		case r.Method == "GET":
 			h.HandleGet(w, r)
@@ -83,25 +126,25 @@ func DispatchMethod(h WebHandler, w http.ResponseWriter, r *http.Request) {
 			h.HandlePost(w, r)
 
 		case r.Method == "HEAD":
-			logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Unsupported method %s called", r.Method), nil)
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Unsupported method %s called", r.Method), nil)
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 		case r.Method == "TRACE":
-			logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Unsupported method %s called", r.Method), nil)
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Unsupported method %s called", r.Method), nil)
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 		case r.Method == "OPTIONS":
-			logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Unsupported method %s called", r.Method), nil)
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Unsupported method %s called", r.Method), nil)
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 		case r.Method == "PUT":
-			logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Unsupported method %s called", r.Method), nil)
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Unsupported method %s called", r.Method), nil)
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 		case r.Method == "PATCH":
-			logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Unsupported method %s called", r.Method), nil)
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Unsupported method %s called", r.Method), nil)
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 		case r.Method == "DELETE":
-			logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Unsupported method %s called", r.Method), nil)
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Unsupported method %s called", r.Method), nil)
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 		case r.Method == "CONNECT":
-			logger.StdLogger.LOG(logger.WARN, "", fmt.Sprintf("Unsupported method %s called", r.Method), nil)
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("Unsupported method %s called", r.Method), nil)
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 	}
 
@@ -146,6 +189,7 @@ func ParsePathAndQueryFlat (r *http.Request, path string, pathVars map[int]strin
 	for k, v := range pathVars {
 		if len(pathParts) > (k-i) {
 			queryParams[v] = pathParts[k-i]
+			setRouteParam(r, v, pathParts[k-i])
 			pathParts = append(pathParts[:k-i], pathParts[k-i+1:]...)
 			i++
 		}
@@ -190,6 +234,7 @@ func ParsePathAndQuery (r *http.Request, path string, pathVars map[int]string) (
 	for k, v := range pathVars {
 		if len(pathParts) > (k-i) {
 			queryParams.Add(v, pathParts[k-i])
+			setRouteParam(r, v, pathParts[k-i])
 			pathParts = append(pathParts[:k-i], pathParts[k-i+1:]...)
 			i++
 		}
@@ -222,3 +267,32 @@ func ReturnJson ( w http.ResponseWriter, jsonDoc interface{} ) error  {
 
 }
 
+
+// ErrorResponse is the structured error body returned by ReturnError, and decoded into an
+// HttpError by the HttpClient json helpers
+type ErrorResponse struct {
+	Status int				`json:"status"`
+	Message string			`json:"message"`
+	CorrelationId string	`json:"correlation_id"`
+}
+
+// ReturnError writes a json ErrorResponse with the status, message and the request's correlation
+// id, so callers can tell what went wrong and find it in the logs.
+//
+// Parameters:
+//	w :	the responseWriter to use
+//	r : the request being responded to
+//	status : the http status, e.g. http.StatusNotFound
+//	msg : a description of the error
+//
+// Returns:
+//	none
+//
+func ReturnError ( w http.ResponseWriter, r *http.Request, status int, msg string ) {
+	e := ErrorResponse{Status: status, Message: msg, CorrelationId: getCorrelationId(r)}
+	jsonStr, _ := json.Marshal(e)
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(jsonStr)
+}
@@ -0,0 +1,464 @@
+// webber - WebServer package
+//
+// Copyright (c) 2018 - John M. Hawkins <jmhawkins@msn.com>
+//
+// All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package webber
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"strings"
+	"net/url"
+	"net/http"
+	"encoding/json"
+	"jmh/goweb/logger"
+	"github.com/gorilla/websocket"
+)
+
+// websocket message types, for Send and OnMessage
+const (
+	TextMessage = websocket.TextMessage
+	BinaryMessage = websocket.BinaryMessage
+)
+
+var ErrSendQueueFull = errors.New("websocket send queue is full")
+var ErrConnClosed = errors.New("websocket connection is closed")
+
+// WebSocketHandler is a WebHandler that upgrades GET requests to websockets.  Register it with
+// AppServer.RegisterHandler like any other handler; the OnConnect, OnMessage and OnClose callbacks
+// handle the connections, and Hub broadcasts to them.
+type WebSocketHandler struct {
+	Hub *Hub								// the connections, for broadcasting
+	Auth PrincipalLoader					// (optional) who the caller is.  If it returns nil the upgrade gets a 401
+	CheckOrigin func(r *http.Request) bool	// (optional) whether to accept the Origin.  Default is the same host only
+
+	OnConnect func(c *WebSocketConn) error	// (optional) called after the upgrade, e.g. to join groups.  An error closes the connection
+	OnMessage func(c *WebSocketConn, messageType int, data []byte)	// (optional) called for each message received
+	OnClose func(c *WebSocketConn)			// (optional) called once the connection is closed
+
+	PingInterval time.Duration		// how often to ping the client, default 30 seconds
+	PongWait time.Duration			// how long to wait for a pong (or any message) before closing, default 60 seconds
+	WriteWait time.Duration			// how long a write may take, default 10 seconds
+	SendQueueSize int				// messages queued per connection before Send returns ErrSendQueueFull, default 64
+	MaxMessageSize int64			// the largest message accepted from the client, default 64KB
+
+	basePath string
+	name string
+}
+
+// NewWebSocketHandler creates a WebSocketHandler with the default timeouts and queue size
+//
+// Parameters:
+//	basePath : the path to serve websockets on, e.g. "api/feed"
+//	name : the handler's name, for logs and metrics
+//	hub : the hub to add connections to, or nil for a new one
+//
+// Returns:
+//	*WebSocketHandler : the handler created
+//
+// Example:
+//	feed := webber.NewWebSocketHandler("api/feed", "FeedHandler", nil)
+//	feed.Auth = sessionLoader
+//	feed.OnConnect = func(c *webber.WebSocketConn) error { feed.Hub.Join(c, "hikes"); return nil }
+//	as.RegisterHandler(feed)
+//	...
+//	feed.Hub.BroadcastJSON("hikes", hike)
+//
+func NewWebSocketHandler(basePath string, name string, hub *Hub) *WebSocketHandler {
+	h := new(WebSocketHandler)
+	h.basePath = "/" + strings.Trim(basePath, "/") + "/"
+	h.name = name
+	if hub == nil {
+		hub = NewHub()
+	}
+	h.Hub = hub
+	h.PingInterval = 30 * time.Second
+	h.PongWait = 60 * time.Second
+	h.WriteWait = 10 * time.Second
+	h.SendQueueSize = 64
+	h.MaxMessageSize = 64 * 1024
+	return h
+}
+
+func (h *WebSocketHandler) Name() string {
+	return h.name
+}
+
+func (h *WebSocketHandler) BasePath() string {
+	return h.basePath
+}
+
+// HandleGet authenticates the caller, upgrades the connection and serves it until it closes
+func (h *WebSocketHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	var p *Principal
+	if h.Auth != nil {
+		if p = h.Auth(r); p == nil {
+			GetLogger(r).LOG(logger.WARN, fmt.Sprintf("%s websocket refused, not authenticated", h.name), nil)
+			ReturnError(w, r, http.StatusUnauthorized, "Not authenticated")
+			return
+		}
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: h.checkOrigin}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already written the error response
+		GetLogger(r).LOG(logger.WARN, fmt.Sprintf("%s websocket upgrade failed: %s", h.name, err), nil)
+		return
+	}
+	c := newWebSocketConn(h, ws, r, p)
+	GetLogger(r).LOG(logger.INFO, fmt.Sprintf("%s websocket %s connected", h.name, c.Id), nil)
+	h.Hub.add(c)
+	go c.writeLoop()
+	if h.OnConnect != nil {
+		if err := h.OnConnect(c); err != nil {
+			c.CloseWithReason(websocket.ClosePolicyViolation, err.Error())
+		}
+	}
+	c.readLoop()
+	if h.OnClose != nil {
+		h.OnClose(c)
+	}
+	GetLogger(r).LOG(logger.INFO, fmt.Sprintf("%s websocket %s closed", h.name, c.Id), nil)
+}
+
+func (h *WebSocketHandler) HandlePost(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+}
+
+// checkOrigin accepts requests without an Origin (non-browser clients), or from the host the
+// client asked for
+func (h *WebSocketHandler) checkOrigin(r *http.Request) bool {
+	if h.CheckOrigin != nil {
+		return h.CheckOrigin(r)
+	}
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, GetHost(r))
+}
+
+type wsMessage struct {
+	messageType int
+	data []byte
+}
+
+// WebSocketConn is one client's websocket.  Its methods are safe to call from any goroutine.
+type WebSocketConn struct {
+	Id string
+	Principal *Principal		// who the client is, if the handler has Auth
+
+	handler *WebSocketHandler
+	ws *websocket.Conn
+	request *http.Request
+	send chan wsMessage
+	ctx context.Context
+	cancel context.CancelFunc
+	done chan struct{}			// closed when the writer has stopped
+
+	mu sync.Mutex
+	closeCode int
+	closeText string
+	groups map[string]bool
+}
+
+func newWebSocketConn(h *WebSocketHandler, ws *websocket.Conn, r *http.Request, p *Principal) *WebSocketConn {
+	c := new(WebSocketConn)
+	c.Id = logger.GenerateCorrelationId()
+	c.Principal = p
+	c.handler = h
+	c.ws = ws
+	c.request = r
+	c.send = make(chan wsMessage, h.SendQueueSize)
+	c.ctx, c.cancel = context.WithCancel(r.Context())
+	c.done = make(chan struct{})
+	c.closeCode = websocket.CloseNormalClosure
+	c.groups = make(map[string]bool)
+	return c
+}
+
+// Request returns the upgrade request, for its route params, session etc.
+func (c *WebSocketConn) Request() *http.Request {
+	return c.request
+}
+
+// Context returns a context that is done when the connection closes
+func (c *WebSocketConn) Context() context.Context {
+	return c.ctx
+}
+
+// Send queues a message for the client without waiting.  If the client isn't keeping up and its
+// queue is full, it returns ErrSendQueueFull and the message is dropped.
+//
+// Parameters:
+//	messageType : TextMessage or BinaryMessage
+//	data : the message
+//
+// Returns:
+//	error : ErrSendQueueFull, ErrConnClosed or nil
+//
+func (c *WebSocketConn) Send(messageType int, data []byte) error {
+	if c.ctx.Err() != nil {
+		return ErrConnClosed
+	}
+	select {
+	case c.send <- wsMessage{messageType, data}:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// SendWait queues a message for the client, waiting for room in the queue until ctx is done
+func (c *WebSocketConn) SendWait(ctx context.Context, messageType int, data []byte) error {
+	select {
+	case c.send <- wsMessage{messageType, data}:
+		return nil
+	case <-c.ctx.Done():
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendJSON queues v, marshalled to json, as a text message without waiting
+func (c *WebSocketConn) SendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(TextMessage, data)
+}
+
+// Close closes the connection normally
+func (c *WebSocketConn) Close() {
+	c.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithReason closes the connection, sending the client a close code (e.g.
+// websocket.ClosePolicyViolation) and reason
+func (c *WebSocketConn) CloseWithReason(code int, reason string) {
+	c.mu.Lock()
+	if c.ctx.Err() == nil {
+		c.closeCode = code
+		c.closeText = reason
+		c.cancel()
+	}
+	c.mu.Unlock()
+	c.handler.Hub.remove(c)
+}
+
+// readLoop reads messages until the connection closes or the client stops answering pings
+func (c *WebSocketConn) readLoop() {
+	h := c.handler
+	c.ws.SetReadLimit(h.MaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(h.PongWait))
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(h.PongWait))
+		return nil
+	})
+	for {
+		messageType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) && c.ctx.Err() == nil {
+				GetLogger(c.request).LOG(logger.WARN, fmt.Sprintf("%s websocket %s read failed: %s", h.name, c.Id, err), nil)
+			}
+			break
+		}
+		c.ws.SetReadDeadline(time.Now().Add(h.PongWait))
+		if h.OnMessage != nil {
+			h.OnMessage(c, messageType, data)
+		}
+	}
+	c.CloseWithReason(websocket.CloseNormalClosure, "")
+	<-c.done
+}
+
+// writeLoop writes queued messages and pings until the connection is closed, then sends the
+// close message and closes the socket, which stops readLoop
+func (c *WebSocketConn) writeLoop() {
+	h := c.handler
+	ticker := time.NewTicker(h.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+		close(c.done)
+	}()
+	for {
+		select {
+		case m := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(h.WriteWait))
+			if err := c.ws.WriteMessage(m.messageType, m.data); err != nil {
+				c.CloseWithReason(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.WriteWait)); err != nil {
+				c.CloseWithReason(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.ctx.Done():
+			c.mu.Lock()
+			msg := websocket.FormatCloseMessage(c.closeCode, c.closeText)
+			c.mu.Unlock()
+			c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(h.WriteWait))
+			return
+		}
+	}
+}
+
+// Hub keeps track of open websockets and the groups they've joined, for broadcasting
+type Hub struct {
+	mu sync.RWMutex
+	conns map[*WebSocketConn]bool
+	groups map[string]map[*WebSocketConn]bool
+}
+
+// NewHub creates an empty Hub
+func NewHub() *Hub {
+	h := new(Hub)
+	h.conns = make(map[*WebSocketConn]bool)
+	h.groups = make(map[string]map[*WebSocketConn]bool)
+	return h
+}
+
+func (h *Hub) add(c *WebSocketConn) {
+	h.mu.Lock()
+	h.conns[c] = true
+	h.mu.Unlock()
+}
+
+// remove takes c out of the hub and all its groups
+func (h *Hub) remove(c *WebSocketConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, c)
+	c.mu.Lock()
+	for g := range c.groups {
+		h.leave(c, g)
+	}
+	c.groups = make(map[string]bool)
+	c.mu.Unlock()
+}
+
+// Join adds c to group, e.g. "hikes" or "user:" + c.Principal.Id
+func (h *Hub) Join(c *WebSocketConn, group string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.conns[c] {
+		// already closed
+		return
+	}
+	members, ok := h.groups[group]
+	if !ok {
+		members = make(map[*WebSocketConn]bool)
+		h.groups[group] = members
+	}
+	members[c] = true
+	c.mu.Lock()
+	c.groups[group] = true
+	c.mu.Unlock()
+}
+
+// Leave removes c from group
+func (h *Hub) Leave(c *WebSocketConn, group string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.mu.Lock()
+	delete(c.groups, group)
+	c.mu.Unlock()
+	h.leave(c, group)
+}
+
+// leave removes c from the group's members.  h.mu must be held.
+func (h *Hub) leave(c *WebSocketConn, group string) {
+	if members, ok := h.groups[group]; ok {
+		delete(members, c)
+		if len(members) == 0 {
+			delete(h.groups, group)
+		}
+	}
+}
+
+// members returns the connections in group, or all of them for ""
+func (h *Hub) members(group string) []*WebSocketConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	set := h.conns
+	if len(group) > 0 {
+		set = h.groups[group]
+	}
+	list := make([]*WebSocketConn, 0, len(set))
+	for c := range set {
+		list = append(list, c)
+	}
+	return list
+}
+
+// Count returns the number of connections in group, or all of them for ""
+func (h *Hub) Count(group string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(group) > 0 {
+		return len(h.groups[group])
+	}
+	return len(h.conns)
+}
+
+// Broadcast sends a message to every connection in group, or every connection for "".  Clients
+// whose queues are full are too slow to keep up, so they are disconnected rather than holding up
+// everyone else.
+//
+// Parameters:
+//	group : the group to send to, or "" for all
+//	messageType : TextMessage or BinaryMessage
+//	data : the message
+//
+// Returns:
+//	int : the number of connections the message was queued for
+//
+func (h *Hub) Broadcast(group string, messageType int, data []byte) int {
+	sent := 0
+	for _, c := range h.members(group) {
+		switch c.Send(messageType, data) {
+		case nil:
+			sent++
+		case ErrSendQueueFull:
+			GetLogger(c.request).LOG(logger.WARN, fmt.Sprintf("websocket %s can't keep up, closing it", c.Id), nil)
+			c.CloseWithReason(websocket.CloseTryAgainLater, "send queue full")
+		}
+	}
+	return sent
+}
+
+// BroadcastJSON sends v, marshalled to json, as a text message to group, or everyone for ""
+func (h *Hub) BroadcastJSON(group string, v interface{}) (int, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return h.Broadcast(group, TextMessage, data), nil
+}
@@ -0,0 +1,122 @@
+package webber
+
+import (
+	"time"
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/gorilla/websocket"
+)
+
+// waitFor polls cond for up to a second
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// connections are authenticated on upgrade, messages are broadcast to groups, and clients that
+// stop answering pings or can't keep up are dropped
+func TestWebSocket(t *testing.T) {
+	feed := NewWebSocketHandler("feed", "FeedHandler", nil)
+	feed.PingInterval = 20 * time.Millisecond
+	feed.PongWait = 100 * time.Millisecond
+	feed.Auth = func(r *http.Request) *Principal {
+		if u := r.Header.Get("X-Test-User"); len(u) > 0 {
+			return &Principal{Id: u}
+		}
+		return nil
+	}
+	feed.OnConnect = func(c *WebSocketConn) error {
+		feed.Hub.Join(c, "room")
+		return nil
+	}
+	feed.OnMessage = func(c *WebSocketConn, messageType int, data []byte) {
+		feed.Hub.Broadcast("room", messageType, []byte(c.Principal.Id + ": " + string(data)))
+	}
+
+	config := DefaultConfig()
+	config.WWWRoot = ""
+	as := NewAppServer(config)
+	as.RegisterHandler(feed)
+	server := httptest.NewServer(http.HandlerFunc(as.Handler))
+	defer server.Close()
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/feed/"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsUrl, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("TestWebSocket expected a 401 without a user, got %v", err)
+	}
+
+	dial := func(user string) *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"X-Test-User": {user}})
+		if err != nil {
+			t.Fatalf("TestWebSocket failed to connect: %s", err)
+		}
+		return ws
+	}
+	// gorilla clients only answer pings while reading
+	listen := func(ws *websocket.Conn) chan string {
+		received := make(chan string, 10)
+		go func() {
+			defer close(received)
+			for {
+				_, data, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				received <- string(data)
+			}
+		}()
+		return received
+	}
+	alice := dial("alice")
+	defer alice.Close()
+	bob := dial("bob")
+	defer bob.Close()
+	silent := dial("carol")
+	defer silent.Close()
+	toAlice, toBob := listen(alice), listen(bob)
+	if !waitFor(func() bool { return feed.Hub.Count("room") == 3 }) {
+		t.Fatalf("TestWebSocket expected 3 connections in the room, got %d", feed.Hub.Count("room"))
+	}
+
+	// the client that doesn't read doesn't answer pings, so it's dropped, and the others stay
+	if !waitFor(func() bool { return feed.Hub.Count("") == 2 }) {
+		t.Fatalf("TestWebSocket expected the silent client to be dropped, have %d", feed.Hub.Count(""))
+	}
+	time.Sleep(200 * time.Millisecond)
+	if feed.Hub.Count("room") != 2 {
+		t.Fatalf("TestWebSocket expected pongs to keep the others open, have %d", feed.Hub.Count("room"))
+	}
+
+	// alice's message goes to both of them
+	alice.WriteMessage(websocket.TextMessage, []byte("hello"))
+	for _, received := range []chan string{toAlice, toBob} {
+		select {
+		case msg := <-received:
+			if msg != "alice: hello" {
+				t.Fatalf("TestWebSocket expected the broadcast, got %q", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("TestWebSocket timed out waiting for the broadcast")
+		}
+	}
+
+	// a connection whose queue is full is closed by Broadcast
+	slow := NewWebSocketHandler("slow", "SlowHandler", nil)
+	slow.SendQueueSize = 1
+	c := newWebSocketConn(slow, nil, httptest.NewRequest("GET", "/slow/", nil), nil)
+	slow.Hub.add(c)
+	slow.Hub.Join(c, "room")
+	if n := slow.Hub.Broadcast("room", TextMessage, []byte("1")); n != 1 {
+		t.Fatalf("TestWebSocket expected the first message queued, got %d", n)
+	}
+	if n := slow.Hub.Broadcast("room", TextMessage, []byte("2")); n != 0 || slow.Hub.Count("") != 0 || c.Send(TextMessage, nil) != ErrConnClosed {
+		t.Fatalf("TestWebSocket expected the slow connection closed, got %d sent and %d connections", n, slow.Hub.Count(""))
+	}
+}
@@ -36,10 +36,12 @@ import (
 	"jmh/goweb/wtmcache"
 	"gopkg.in/mgo.v2"
 	"os"
+	"os/signal"
+	"syscall"
 	"flag"
-//	"time"
+	"time"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
 //	"math/rand"
 //	"gopkg.in/mgo.v2/bson"
 	"fmt"
@@ -55,13 +57,31 @@ var cDb *wtmcache.Db					// the db we will use
 
 var httpClient *webber.HttpClient
 
+var hikeFeed *webber.WebSocketHandler	// pushes new hikes to logged in users
+
 
 // this is the struct we use for keeping data about our logged in user
 // It's only a sample, so it doesn't store much, but you can add more information, such as
-// permissions or preferences.
+// preferences.  The roles and permissions are checked by the access policies the handlers
+// are registered with.
 //
 type UserSessionData struct {
 	Username string		`json:"username"`
+	Roles []string		`json:"roles"`
+	Permissions []string	`json:"permissions"`
+}
+
+// these implement webber.Authorizable, so webber can build a Principal from the session
+func (u *UserSessionData) GetPrincipalId() string {
+	return u.Username
+}
+
+func (u *UserSessionData) GetRoles() []string {
+	return u.Roles
+}
+
+func (u *UserSessionData) GetPermissions() []string {
+	return u.Permissions
 }
 
 // This is our api/auth handler, which will do a simple login and save session auth info
@@ -92,7 +112,7 @@ func (h AuthServer) Handler ( w http.ResponseWriter, r *http.Request) {
 func (h AuthServer) HandleGet (w http.ResponseWriter, r *http.Request) {
 	apiPath := r.URL.Path[len(h.basePath):]
 	pathVars := map[int]string{1:"a"}
-	logger.StdLogger.LOG(logger.INFO, "", fmt.Sprintf("AuthServer GET handler called for %s", apiPath), nil)
+	webber.GetLogger(r).Infof("AuthServer GET handler called for %s", apiPath)
 	pathParts, _ := webber.ParsePathAndQueryFlat(r, apiPath, pathVars )
 
 	switch pathParts[0] {
@@ -107,7 +127,7 @@ func (h AuthServer) HandleGet (w http.ResponseWriter, r *http.Request) {
 
 		if ( bHasSession ) {
 			//  log it and write back a page.  
-			logger.StdLogger.LOG(logger.INFO, "", fmt.Sprintf("found sesssion %s", session), nil)
+			webber.GetLogger(r).Infof("found session for %s", session.Username)
 			fmt.Fprintf(w, "<html><body>The session key is %s for username %s</body></html>", sessionKey, session.Username)
 		} else {
 			fmt.Fprintf(w, "<html><body>No active session found</body></html>")
@@ -124,7 +144,7 @@ func (h AuthServer) HandleGet (w http.ResponseWriter, r *http.Request) {
 func (h AuthServer) HandlePost (w http.ResponseWriter, r *http.Request) {
 	parseErr := r.ParseForm()
 	if parseErr != nil {
-		logger.StdLogger.LOG(logger.ERROR, "", fmt.Sprintf("error parsing login form: %s", parseErr), nil)
+		webber.GetLogger(r).Errorf("error parsing login form: %s", parseErr)
 	}
 	username := r.FormValue("username")
 	password := r.FormValue("password")
@@ -133,16 +153,18 @@ func (h AuthServer) HandlePost (w http.ResponseWriter, r *http.Request) {
 		// that's our login!  Go ahead and make a session
 		// store it in the db and set the header.
 		
-		// this is the session data we want to store.  For this example, it's just the username, but
-		// it could be anything we need to keep track of or check for each call, such as permissions,
-		// preferences, etc.
-		sessionData := UserSessionData{Username:username}
-		sk, err := webber.MakeSession(w, sessionData);
-		fmt.Println("Created a session with the key ", sk, " err = ", err)
+		// this is the session data we want to store.  For this example, it's just the username and
+		// the roles the user has, but it could be anything we need to keep track of or check for
+		// each call, such as preferences, etc.
+		sessionData := UserSessionData{Username:username, Roles:[]string{"hiker"}}
+		_, err := webber.MakeSession(w, sessionData);
+		if err != nil {
+			webber.GetLogger(r).Errorf("Can't save session for %s: %s", username, err)
+		}
 		fmt.Fprintf(w, "Success")
 		return		
 	} else {
-		logger.StdLogger.LOG(logger.INFO, "", fmt.Sprintf("Invalid login for username: %s", username), nil)
+		webber.GetLogger(r).Infof("Invalid login for username: %s", username)
 		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
 	}
 
@@ -180,7 +202,7 @@ func (h HikeServer) BasePath() string {
 
 func (h HikeServer) Handler ( w http.ResponseWriter, r *http.Request) { 
 	apiPath := r.URL.Path[len(h.basePath):]
-	logger.StdLogger.LOG(logger.INFO, "", fmt.Sprintf("HikeServer Handler  called for %s", apiPath), nil)
+	webber.GetLogger(r).Infof("HikeServer Handler  called for %s", apiPath)
 	webber.DispatchMethod(h, w, r);
 }
 
@@ -193,14 +215,12 @@ func (h HikeServer) HandleGet (w http.ResponseWriter, r *http.Request) {
 	pathParts, vars := webber.ParsePathAndQueryFlat(r, apiPath, pathVars )
 
 	url := "http://localhost:8090/api/cache/hikes/hikes/Name/" + vars["hike_name"]
-	resp, rerr := httpClient.Get(url, r)
-	fmt.Println("tried caache server, err=", rerr)
-
-
-
 	hikeInfo := new(HikeInfo)
-
-	json.NewDecoder(resp.Body).Decode(hikeInfo)
+	rerr := httpClient.GetJson(url, hikeInfo, r)
+	if rerr != nil {
+		returnCacheError(w, r, rerr)
+		return
+	}
 
 	if ( len(pathParts) == 0) {
 		// just return the hike info
@@ -219,6 +239,19 @@ func (h HikeServer) HandleGet (w http.ResponseWriter, r *http.Request) {
 	
 }
 
+// returnCacheError passes an error from the cache server back to our caller.  A missing hike is
+// a 404 for them too, but anything else (e.g. the cache server refusing our api key, rate limiting
+// us, or being down) is our problem, not theirs, so it's logged and they get a bad gateway
+func returnCacheError(w http.ResponseWriter, r *http.Request, err error) {
+	var herr *webber.HttpError
+	if errors.As(err, &herr) && herr.Status == http.StatusNotFound {
+		webber.ReturnError(w, r, herr.Status, herr.Message)
+		return
+	}
+	webber.GetLogger(r).Errorf("Error calling cache server: %s", err)
+	webber.ReturnError(w, r, http.StatusBadGateway, "Cache server unavailable")
+}
+
 // take information about a hike and store it to our cache server
 func (h HikeServer) HandlePost (w http.ResponseWriter, r *http.Request) {
 	apiPath := r.URL.Path[len(h.basePath):]
@@ -226,17 +259,20 @@ func (h HikeServer) HandlePost (w http.ResponseWriter, r *http.Request) {
 
 	if (len(pathParts) > 0) {
 		hikename := pathParts[0]
-		body, err := ioutil.ReadAll(r.Body)
+		hikeInfo := new(HikeInfo)
+		err := json.NewDecoder(r.Body).Decode(hikeInfo)
 		if ( err == nil ) {
+			hikeInfo.Name = hikename
 			url := "http://localhost:8090/api/cache/hikes/hikes/Name/" + hikename
-			resp, rerr := httpClient.Post(url, body, r.Header.Get("Content-Type"), r)
+			rerr := httpClient.PostJson(url, hikeInfo, nil, r)
 			if ( rerr == nil) {
-				fmt.Fprintf(w, "%d bytes written", len(body))
+				hikeFeed.Hub.BroadcastJSON("hikes", hikeInfo)
+				fmt.Fprintf(w, "hike %s written", hikename)
 			} else {
-				http.Error(w, rerr.Error(), resp.StatusCode)
+				returnCacheError(w, r, rerr)
 			}
 		} else {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			webber.ReturnError(w, r, http.StatusBadRequest, "Invalid hike: " + err.Error())
 		}
 	} else {
 		http.Error(w, "no hikename specified", http.StatusBadRequest)
@@ -275,26 +311,52 @@ func main() {
 	// set up our logger
 	// fill out the AppInfo struct so the logger knows who it is writting logs for:
 	app := logger.AppInfo{Name:config.AppName, Version:config.AppVersion, Instance:*AppInstance,Cluster:*AppCluster}
-	fhLogger := logger.NewFirehoseLogger(app, config.AWSRegion, config.AWSProfile, config.LoggerFirehoseDeliveryStream)
-	logger.StdLogger = fhLogger
-	logger.StdLogger.StdOutOn(true)
+	appLogger, err := webber.NewLoggerFromConfig(app, config)
+	if err != nil {
+		logger.Criticalf("Can't create logger: %s", err)
+		os.Exit(1)
+	}
+	logger.StdLogger = appLogger
 	logger.StdLogger.LOG(logger.INFO, "", "WebberTut starting up", nil)
 
+	// export trace spans if the config asks for it
+	if err := webber.EnableTracingFromConfig(config); err != nil {
+		logger.Errorf("Can't enable tracing: %s", err)
+	}
+
 	// connect to our db
 	dbSession, dbErr := mgo.Dial(config.DBPath)
 	if ( dbErr != nil ) {
 		// can't connect to our db
-		logger.StdLogger.LOG(logger.CRITICAL, "", fmt.Sprintf("Can't connect to db: %s", dbErr), nil)
+		logger.Criticalf("Can't connect to db: %s", dbErr)
 		os.Exit(1)
 	}
 	cDb = wtmcache.NewDb(dbSession, "tutorial")
 	webber.CreateSessionDbCollection(cDb, config.SessionCollName)
 
-	httpClient = webber.NewHttpClient(nil);
+	// calls to the cache server should be quick, so don't wait long for one
+	clientConfig := webber.DefaultHttpClientConfig()
+	clientConfig.Timeout = 5 * time.Second
+	httpClient = webber.NewHttpClientWithConfig(nil, clientConfig)
+	// the cache server may require an api key
+	httpClient.SetAPIKey(config.APIKey)
+	httpClient.RegisterMetrics(webber.DefaultMetrics, "cacheserver")
 
 	// create an App Server
 	as := webber.NewAppServer(config)
 
+	// rate limit logins etc. as the config says, sharing the counts with our other instances
+	// through the cache server
+	limitStore := webber.NewCacheServerRateLimitStore(httpClient, "http://localhost:8090/api/ratelimit")
+	limiter, err := webber.NewRateLimiterFromConfig(config, limitStore)
+	if err != nil {
+		logger.Criticalf("Invalid rate limits: %s", err)
+		os.Exit(1)
+	}
+	if limiter != nil {
+		as.Use(limiter.Middleware())
+	}
+
 	//////////////////////////////////
 	// create a couple of handlers
 
@@ -302,9 +364,48 @@ func main() {
 	auths := NewAuthServer(config.ApiBase + "/auth")
 	as.RegisterHandler(auths)
 
-	// add a hike handler and assing it <apibase>/hike
+	// add a hike handler and assing it <apibase>/hike.  Anyone can read about hikes, but
+	// you need to be logged in as a hiker to add one
+	sessionLoader := webber.SessionPrincipalLoader(func() webber.Authorizable { return &UserSessionData{} })
+	hikePolicy := webber.NewAccessPolicy(sessionLoader).Require("POST", webber.AccessRule{Roles:[]string{"hiker"}})
 	hikes := NewHikeServer(config.ApiBase + "/hike")
-	as.RegisterHandler(hikes)
+	as.RegisterHandler(hikes, webber.WithAccessPolicy(hikePolicy))
+
+	// and a websocket at <apibase>/hikefeed that tells logged in users about new hikes
+	hikeFeed = webber.NewWebSocketHandler(config.ApiBase + "/hikefeed", "HikeFeed", nil)
+	hikeFeed.Auth = sessionLoader
+	hikeFeed.OnConnect = func(c *webber.WebSocketConn) error {
+		hikeFeed.Hub.Join(c, "hikes")
+		return nil
+	}
+	as.RegisterHandler(hikeFeed)
+
+	// let admins change log levels on <apibase>/admin/loglevel while we're running
+	admins := webber.NewAccessPolicy(sessionLoader).Require("*", webber.AccessRule{Roles:[]string{"admin"}})
+	as.EnableLogLevels(config.ApiBase + "/admin/loglevel", admins)
+
+	// serve request, client and session cache metrics on /metrics
+	webber.RegisterCollectionMetrics(webber.DefaultMetrics, webber.SessionCollection())
+	as.EnableMetrics("metrics")
+
+	// health probes and version info on /healthz, /readyz and /version.  We aren't ready if we
+	// can't reach the db or the cache server
+	health := webber.NewHealth()
+	health.AddReadinessCheck("mongo", webber.MongoCheck(cDb))
+	health.AddReadinessCheck("cacheserver", webber.HttpCheck(httpClient, "http://localhost:8090/healthz"))
+	health.AddReadinessCheck("logger", webber.LoggerCheck(logger.StdLogger))
+	as.EnableHealth(health)
+
+	// send any buffered logs and spans before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		logger.StdLogger.LOG(logger.INFO, "", "Shutting down", nil)
+		webber.ShutdownTracing()
+		logger.CloseLogger(logger.StdLogger)
+		os.Exit(0)
+	}()
 
 	// now start the server
 	http.HandleFunc("/", as.Handler)
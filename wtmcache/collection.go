@@ -27,6 +27,7 @@ import (
 	"time"
 	"reflect"
 	"errors"
+	"sync/atomic"
 	"github.com/patrickmn/go-cache"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -42,6 +43,17 @@ type Collection struct {
 	KeyField string			// the name of the key 
 	Dbc      *mgo.Collection	// the actuall collection
 	C        *cache.Cache		// the cache for this collection
+
+	hits int64				// reads answered from the cache
+	misses int64			// reads that went to the db
+}
+
+// CollectionStats are the cache counters for a collection, see Collection.Stats
+//
+type CollectionStats struct {
+	Hits int64		// reads answered from the cache
+	Misses int64	// reads that had to go to the db
+	Items int		// number of documents in the cache (which may include expired ones not yet cleaned up)
 }
 
 
@@ -88,10 +100,12 @@ func newCollection ( db *Db, collectionName string, keyField string, cacheDur ti
 func (w *Collection) Read (key string, result interface{}) (interface{}, error) {
 	r, present := w.C.Get(key)
 	if present {
+		atomic.AddInt64(&w.hits, 1)
 		err := bson.Unmarshal(r.([]byte), result)
 		return result, err
 	} else {
 		// fetch from db
+		atomic.AddInt64(&w.misses, 1)
 		err := w.Dbc.Find(bson.M{w.KeyField: key}).One(result)
 		if err == nil {
 			// load it in the cache
@@ -286,3 +300,15 @@ func (w *Collection) QueryAndSort ( query interface{}, results interface{}, sort
 func (w *Collection) RawQuery ( query interface{} ) *mgo.Query {
 	return w.Dbc.Find(query) 
 }
+
+// Stats returns the cache hit and miss counts for Read, and the number of documents in the cache
+//
+// Parameters:
+//	none
+//
+// Returns:
+//	CollectionStats : the counters
+//
+func (w *Collection) Stats() CollectionStats {
+	return CollectionStats{Hits: atomic.LoadInt64(&w.hits), Misses: atomic.LoadInt64(&w.misses), Items: w.C.ItemCount()}
+}
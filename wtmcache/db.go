@@ -84,3 +84,31 @@ func (w *Db) NewCollection(collectionName string, keyField string, cacheDur time
 	
 }
 
+
+// Ping checks that the mongo server can be reached.  It uses a copy of the session, so a
+// connection that dropped earlier is retried without disturbing requests using the session.
+//
+// Returns:
+//	error : nil if the server answered
+//
+func (w *Db) Ping() error {
+	return w.PingTimeout(0)
+}
+
+// PingTimeout is Ping, giving up after timeout
+//
+// Params:
+//	timeout : how long to wait for the server, or 0 for the session's timeouts
+//
+// Returns:
+//	error : nil if the server answered
+//
+func (w *Db) PingTimeout(timeout time.Duration) error {
+	s := w.Db.Session.Copy()
+	defer s.Close()
+	if timeout > 0 {
+		s.SetSyncTimeout(timeout)
+		s.SetSocketTimeout(timeout)
+	}
+	return s.Ping()
+}